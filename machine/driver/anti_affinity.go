@@ -0,0 +1,291 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nutanix/docker-machine/utils"
+
+	v4 "github.com/nutanix-cloud-native/prism-go-client/v4"
+	prismConfig "github.com/nutanix/ntnx-api-golang-clients/prism-go-client/v4/models/prism/v4/config"
+	vmmConfig "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/prism/v4/config"
+	vmmPolicies "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/vmm/v4/ahv/policies"
+)
+
+// antiAffinityCategoryKey is the category key used to bind the VMs to their anti-affinity policy.
+// The category value is the name of the anti-affinity group.
+const antiAffinityCategoryKey = "RancherAntiAffinityGroup"
+
+// antiAffinityLockKind names the lock files of the anti-affinity groups
+const antiAffinityLockKind = "anti-affinity"
+
+// placementLockPath returns the path of the lock file serializing the changes of the placement policy of a group,
+// in the parent directory of the machine store like the GPU allocation lock.
+func (d *NutanixDriver) placementLockPath(kind, group string) string {
+	return throttlePath(d.throttleDir(), d.Endpoint, fmt.Sprintf("%s-%s.lock", kind, throttleFileChars.ReplaceAllString(group, "_")))
+}
+
+// lockPlacementPolicy serializes the creation of the policy of a group and of its category, the attachment of a new VM
+// and the cleanup of the policy between the driver processes sharing the machine store.
+// The lock is held until the VM carrying the category of the group is created.
+func (d *NutanixDriver) lockPlacementPolicy(kind, group string) (*fileLock, error) {
+	return lockFile(d.placementLockPath(kind, group), time.Duration(2*d.Timeout)*time.Second)
+}
+
+// EnsureAntiAffinityPolicy creates the category and the VM-VM anti-affinity policy of the group if they are missing.
+// The VMs tagged with the returned category key and value are part of the policy.
+// It returns an error if any issues occur during the creation.
+func EnsureAntiAffinityPolicy(conn *v4.Client, group string, timeout int) (string, string, error) {
+	categoryExtID, err := ensureCategory(conn, antiAffinityCategoryKey, group)
+	if err != nil {
+		return "", "", err
+	}
+
+	policy, err := getAntiAffinityPolicy(conn, group)
+	if err != nil {
+		return "", "", err
+	}
+
+	if policy == nil {
+		log.Infof("Creating anti-affinity policy %s", group)
+		body := vmmPolicies.NewVmAntiAffinityPolicy()
+		body.Name = utils.StringPtr(group)
+		body.Description = utils.StringPtr("Anti-affinity policy created by Nutanix Rancher Node Driver")
+		body.Categories = []vmmPolicies.CategoryReference{{ExtId: utils.StringPtr(categoryExtID)}}
+
+		resp, err := conn.VmAntiAffinityPoliciesApiInstance.CreateVmAntiAffinityPolicy(body)
+		if err != nil {
+			// The policy may have been created in the meantime by a driver process of another machine store
+			if existing, _ := getAntiAffinityPolicy(conn, group); existing != nil {
+				return antiAffinityCategoryKey, group, nil
+			}
+			return "", "", fmt.Errorf("failed to create anti-affinity policy %s: %v", group, err)
+		}
+
+		task, ok := resp.GetData().(vmmConfig.TaskReference)
+		if !ok {
+			return "", "", fmt.Errorf("unexpected response while creating anti-affinity policy %s", group)
+		}
+
+		err = waitForV4Task(conn, utils.StringValue(task.ExtId), timeout)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to create anti-affinity policy %s: %v", group, err)
+		}
+
+		log.Infof("Anti-affinity policy %s created", group)
+		return antiAffinityCategoryKey, group, nil
+	}
+
+	for _, category := range policy.Categories {
+		if utils.StringValue(category.ExtId) == categoryExtID {
+			log.Infof("Anti-affinity policy %s found with UUID: %s", group, utils.StringValue(policy.ExtId))
+			return antiAffinityCategoryKey, group, nil
+		}
+	}
+
+	// The policy exists but does not select the group category yet
+	log.Infof("Updating anti-affinity policy %s", group)
+	getResp, err := conn.VmAntiAffinityPoliciesApiInstance.GetVmAntiAffinityPolicyById(policy.ExtId)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get anti-affinity policy %s: %v", group, err)
+	}
+
+	current, ok := getResp.GetData().(vmmPolicies.VmAntiAffinityPolicy)
+	if !ok {
+		return "", "", fmt.Errorf("unexpected response while getting anti-affinity policy %s", group)
+	}
+	current.Categories = append(current.Categories, vmmPolicies.CategoryReference{ExtId: utils.StringPtr(categoryExtID)})
+
+	updateResp, err := conn.VmAntiAffinityPoliciesApiInstance.UpdateVmAntiAffinityPolicyById(policy.ExtId, &current)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to update anti-affinity policy %s: %v", group, err)
+	}
+
+	task, ok := updateResp.GetData().(vmmConfig.TaskReference)
+	if !ok {
+		return "", "", fmt.Errorf("unexpected response while updating anti-affinity policy %s", group)
+	}
+
+	err = waitForV4Task(conn, utils.StringValue(task.ExtId), timeout)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to update anti-affinity policy %s: %v", group, err)
+	}
+
+	return antiAffinityCategoryKey, group, nil
+}
+
+// RemoveFromAntiAffinityPolicy takes the VM out of the anti-affinity policy of the group and deletes the policy
+// and its category once no other VM is part of it.
+func RemoveFromAntiAffinityPolicy(conn *v4.Client, group, vmUUID string, timeout int) error {
+	policy, err := getAntiAffinityPolicy(conn, group)
+	if err != nil {
+		return err
+	}
+
+	if policy == nil {
+		log.Infof("Anti-affinity policy %s not found, nothing to remove", group)
+		return nil
+	}
+
+	resp, err := conn.VmAntiAffinityPoliciesApiInstance.ListVmAntiAffinityPolicyVmComplianceStates(policy.ExtId, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list VMs of anti-affinity policy %s: %v", group, err)
+	}
+
+	remaining := 0
+	if states, ok := resp.GetData().([]vmmPolicies.VmAntiAffinityPolicyVmComplianceState); ok {
+		for _, state := range states {
+			if utils.StringValue(state.ExtId) != vmUUID {
+				remaining++
+			}
+		}
+	}
+
+	if remaining > 0 {
+		log.Infof("VM %s removed from anti-affinity policy %s (%d VM(s) left)", vmUUID, group, remaining)
+		return nil
+	}
+
+	log.Infof("Anti-affinity policy %s is empty, deleting it", group)
+	deleteResp, err := conn.VmAntiAffinityPoliciesApiInstance.DeleteVmAntiAffinityPolicyById(policy.ExtId)
+	if err != nil {
+		return fmt.Errorf("failed to delete anti-affinity policy %s: %v", group, err)
+	}
+
+	task, ok := deleteResp.GetData().(vmmConfig.TaskReference)
+	if !ok {
+		return fmt.Errorf("unexpected response while deleting anti-affinity policy %s", group)
+	}
+
+	err = waitForV4Task(conn, utils.StringValue(task.ExtId), timeout)
+	if err != nil {
+		return fmt.Errorf("failed to delete anti-affinity policy %s: %v", group, err)
+	}
+
+	deleteCategory(conn, antiAffinityCategoryKey, group)
+	return nil
+}
+
+// getAntiAffinityPolicy retrieves the VM-VM anti-affinity policy with the provided name or nil if it does not exist
+func getAntiAffinityPolicy(conn *v4.Client, name string) (*vmmPolicies.VmAntiAffinityPolicy, error) {
+	filter := fmt.Sprintf("name eq '%s'", escapeODataString(name))
+	resp, err := conn.VmAntiAffinityPoliciesApiInstance.ListVmAntiAffinityPolicies(nil, nil, &filter, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list anti-affinity policies: %v", err)
+	}
+
+	policies, _ := resp.GetData().([]vmmPolicies.VmAntiAffinityPolicy)
+	for _, policy := range policies {
+		if utils.StringValue(policy.Name) == name {
+			return &policy, nil
+		}
+	}
+	return nil, nil
+}
+
+// ensureCategory creates the category key:value if it is missing and returns its UUID
+func ensureCategory(conn *v4.Client, key, value string) (string, error) {
+	extID, err := getCategory(conn, key, value)
+	if err != nil || extID != "" {
+		return extID, err
+	}
+
+	log.Infof("Creating category %s:%s", key, value)
+	body := prismConfig.NewCategory()
+	body.Key = utils.StringPtr(key)
+	body.Value = utils.StringPtr(value)
+	resp, err := conn.CategoriesApiInstance.CreateCategory(body)
+	if err != nil {
+		// The category may have been created in the meantime by a driver process of another machine store
+		if extID, _ := getCategory(conn, key, value); extID != "" {
+			return extID, nil
+		}
+		return "", fmt.Errorf("failed to create category %s:%s: %v", key, value, err)
+	}
+
+	category, ok := resp.GetData().(prismConfig.Category)
+	if !ok || category.ExtId == nil {
+		return "", fmt.Errorf("unexpected response while creating category %s:%s", key, value)
+	}
+	return *category.ExtId, nil
+}
+
+// deleteCategory deletes the category key:value if it exists.
+// Errors are only logged as a leftover category is harmless.
+func deleteCategory(conn *v4.Client, key, value string) {
+	extID, err := getCategory(conn, key, value)
+	if err == nil && extID != "" {
+		_, err = conn.CategoriesApiInstance.DeleteCategoryById(utils.StringPtr(extID))
+	}
+	if err != nil {
+		log.Warnf("Failed to delete category %s:%s: %v", key, value, err)
+	}
+}
+
+// getCategory retrieves the UUID of the category key:value or an empty string if it does not exist
+func getCategory(conn *v4.Client, key, value string) (string, error) {
+	filter := fmt.Sprintf("key eq '%s' and value eq '%s'", escapeODataString(key), escapeODataString(value))
+	resp, err := conn.CategoriesApiInstance.ListCategories(nil, nil, &filter, nil, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to list categories: %v", err)
+	}
+
+	categories, _ := resp.GetData().([]prismConfig.Category)
+	for _, category := range categories {
+		if utils.StringValue(category.Key) == key && utils.StringValue(category.Value) == value {
+			return utils.StringValue(category.ExtId), nil
+		}
+	}
+	return "", nil
+}
+
+// waitForV4Task waits for the end of a v4 task and returns an error if it does not succeed before the timeout
+func waitForV4Task(conn *v4.Client, taskUUID string, timeout int) error {
+	_, err := getV4TaskResult(conn, taskUUID, timeout)
+	return err
+}
+
+// getV4TaskResult waits for the end of a v4 task and returns the task, or an error with the task when it does not succeed
+func getV4TaskResult(conn *v4.Client, taskUUID string, timeout int) (*prismConfig.Task, error) {
+	logTask(taskUUID)
+	if taskUUID == "" {
+		return nil, fmt.Errorf("task UUID is empty")
+	}
+
+	for i := 0; i < timeout/5; i++ {
+		resp, err := conn.TasksApiInstance.GetTaskById(utils.StringPtr(taskUUID), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		task, ok := resp.GetData().(prismConfig.Task)
+		if !ok || task.Status == nil {
+			return nil, fmt.Errorf("unexpected response while getting task %s", taskUUID)
+		}
+
+		switch *task.Status {
+		case prismConfig.TASKSTATUS_SUCCEEDED:
+			return &task, nil
+		case prismConfig.TASKSTATUS_FAILED, prismConfig.TASKSTATUS_CANCELED:
+			messages := make([]string, 0)
+			for _, msg := range task.ErrorMessages {
+				messages = append(messages, utils.StringValue(msg.Message))
+			}
+			if task.LegacyErrorMessage != nil {
+				messages = append(messages, *task.LegacyErrorMessage)
+			}
+			return &task, fmt.Errorf("task %s %s: %s", taskUUID, task.Status.GetName(), strings.Join(messages, " "))
+		}
+
+		<-time.After(5 * time.Second)
+	}
+	return nil, fmt.Errorf("timeout waiting for task %s", taskUUID)
+}
+
+// escapeODataString escapes a string literal used in a v4 API filter
+func escapeODataString(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
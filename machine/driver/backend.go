@@ -0,0 +1,313 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nutanix/docker-machine/utils"
+
+	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
+)
+
+// API versions used for the resource resolution and the VM lifecycle
+const (
+	apiVersionAuto = "auto"
+	apiVersionV3   = "v3"
+	apiVersionV4   = "v4"
+)
+
+var apiVersions = []string{apiVersionAuto, apiVersionV3, apiVersionV4}
+
+// vmBackend resolves the images and subnets and manages the lifecycle of the VM with one version of the Prism Central API.
+// The VM is always described by a v3 intent, the v4 backend converts it.
+// The clusters, projects, users, hosts, storage containers and GPUs are deliberately out of its scope: they are only
+// read at the creation, always with the v3 API, which checkV3API requires up front.
+type vmBackend interface {
+	// GetImage retrieves the image with the exact name, or nil if it is not found
+	GetImage(ctx context.Context, name string) (*imageInfo, error)
+	// ListSubnets retrieves the subnets with the provided names
+	ListSubnets(ctx context.Context, names []string) ([]*subnetInfo, error)
+	// CreateVM creates the VM and waits for the end of the creation, the VM is deleted if the creation fails
+	CreateVM(ctx context.Context, request *v3.VMIntentInput) (string, error)
+	// GetVM retrieves the power state and the IP address of the VM
+	GetVM(ctx context.Context, uuid string) (*vmInfo, error)
+	// SetPowerState powers the VM on or off and waits for the end of the operation
+	SetPowerState(ctx context.Context, uuid string, on bool) error
+	// DeleteVM deletes the VM and waits for the end of the deletion, a VM already deleted is not an error
+	DeleteVM(ctx context.Context, uuid string) error
+}
+
+type imageInfo struct {
+	UUID      string
+	Name      string
+	Type      string
+	SizeBytes int64
+}
+
+type subnetInfo struct {
+	UUID        string
+	Name        string
+	Type        string
+	ClusterUUID string
+}
+
+type vmInfo struct {
+	PowerState string
+	IPAddress  string
+}
+
+// newBackend returns the backend of the API version of the driver.
+// In auto mode the v4 API is used when Prism Central serves it; the resolved version is kept in the driver.
+// Hosts created before the API version selection use the v3 API.
+func (d *NutanixDriver) newBackend(creds connConfig) (vmBackend, error) {
+	if d.APIVersion == apiVersionAuto {
+		d.APIVersion = detectAPIVersion(creds)
+		log.Infof("Using Prism Central %s API", d.APIVersion)
+	}
+
+	if d.APIVersion == apiVersionV4 {
+		conn, err := creds.newV4Client()
+		if err != nil {
+			return nil, err
+		}
+		return &v4Backend{conn: conn, timeout: d.Timeout}, nil
+	}
+
+	conn, err := creds.newV3Client()
+	if err != nil {
+		return nil, err
+	}
+	return &v3Backend{conn: conn, timeout: d.Timeout}, nil
+}
+
+// detectAPIVersion probes the v4 VM API of Prism Central and falls back to the v3 API if it is not available
+func detectAPIVersion(creds connConfig) string {
+	conn, err := creds.newV4Client()
+	if err != nil {
+		log.Debugf("v4 API not available: %v", err)
+		return apiVersionV3
+	}
+
+	limit := 1
+	_, err = conn.VmApiInstance.ListVms(nil, &limit, nil, nil, nil)
+	if err != nil {
+		log.Debugf("v4 API not available: %v", err)
+		return apiVersionV3
+	}
+	return apiVersionV4
+}
+
+// checkV3API checks that Prism Central serves the v3 API.
+// The creation resolves the projects, users, clusters, hosts, storage containers and GPUs with the v3 API,
+// even when the VM is managed with the v4 API, so a Prism Central serving only the v4 API is not supported.
+func checkV3API(ctx context.Context, conn *v3.Client) error {
+	_, err := conn.V3.ListCluster(ctx, &v3.DSMetadata{Length: utils.Int64Ptr(1)})
+	if err != nil {
+		return fmt.Errorf("the Prism Central v3 API is required to resolve the placement of the VM, even with the v4 API: %v", err)
+	}
+	return nil
+}
+
+// v3Backend implements the vmBackend with the v3 API
+type v3Backend struct {
+	conn    *v3.Client
+	timeout int
+}
+
+func (b *v3Backend) GetImage(ctx context.Context, name string) (*imageInfo, error) {
+	i := &url.URL{Path: name}
+	images, err := b.conn.V3.ListAllImage(ctx, fmt.Sprintf("name==%s", i.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range images.Entities {
+		if utils.StringValue(image.Status.Name) != name {
+			continue
+		}
+
+		info := &imageInfo{
+			UUID: *image.Metadata.UUID,
+			Name: name,
+		}
+		if image.Status.Resources.ImageType != nil {
+			info.Type = *image.Status.Resources.ImageType
+		}
+		if image.Status.Resources.SizeBytes != nil {
+			info.SizeBytes = *image.Status.Resources.SizeBytes
+		}
+		return info, nil
+	}
+	return nil, nil
+}
+
+func (b *v3Backend) ListSubnets(ctx context.Context, names []string) ([]*subnetInfo, error) {
+	filters := make([]string, 0, len(names))
+	for _, name := range names {
+		t := &url.URL{Path: name}
+		filters = append(filters, fmt.Sprintf("name==%s", t.String()))
+	}
+
+	responseSubnets, err := b.conn.V3.ListAllSubnet(ctx, strings.Join(filters, ","), getEmptyClientSideFilter())
+	if err != nil {
+		return nil, err
+	}
+
+	subnets := make([]*subnetInfo, 0, len(responseSubnets.Entities))
+	for _, subnet := range responseSubnets.Entities {
+		info := &subnetInfo{
+			UUID: *subnet.Metadata.UUID,
+			Name: utils.StringValue(subnet.Spec.Name),
+			Type: utils.StringValue(subnet.Spec.Resources.SubnetType),
+		}
+		if subnet.Spec.ClusterReference != nil {
+			info.ClusterUUID = utils.StringValue(subnet.Spec.ClusterReference.UUID)
+		}
+		subnets = append(subnets, info)
+	}
+	return subnets, nil
+}
+
+func (b *v3Backend) CreateVM(ctx context.Context, request *v3.VMIntentInput) (string, error) {
+	name := utils.StringValue(request.Spec.Name)
+
+	log.Infof("Launch VM creation")
+	resp, err := b.conn.V3.CreateVM(ctx, request)
+	if err != nil {
+		log.Errorf("Error creating vm: [%v]", err)
+		return "", err
+	}
+
+	uuid := *resp.Metadata.UUID
+	taskUUID := resp.Status.ExecutionContext.TaskUUID.(string)
+	logVM(uuid)
+	logTask(taskUUID)
+
+	log.Infof("waiting for vm %s (%s) to create: task %s", name, uuid, taskUUID)
+
+	// Wait end of the task
+	for i := 0; i < b.timeout/5; i++ {
+		resp, err := b.conn.V3.GetTask(ctx, taskUUID)
+		if err != nil {
+			log.Errorf("Error getting task: [%v]", err)
+			return "", err
+		}
+
+		switch *resp.Status {
+		case "SUCCEEDED":
+			log.Infof("VM %s creation task succeeded", name)
+			return uuid, nil
+		case "FAILED":
+			errMsg := strings.ReplaceAll(*resp.ErrorDetail, "\n", " ")
+			log.Errorf("Error creating vm: [%v]", errMsg)
+			log.Infof("Deleting VM %s (%s)", name, uuid)
+			_, err := b.conn.V3.DeleteVM(ctx, uuid)
+			if err != nil {
+				log.Errorf("Failed to delete VM %s (%s): %v", name, uuid, err)
+			}
+
+			return "", errors.New(errMsg)
+		}
+		log.Infof("VM %s creation is in %s state", name, *resp.Status)
+		<-time.After(5 * time.Second)
+	}
+
+	log.Errorf("Timeout waiting for vm %s to create", name)
+	return "", errors.New("timeout waiting for vm to create")
+}
+
+func (b *v3Backend) GetVM(ctx context.Context, uuid string) (*vmInfo, error) {
+	resp, err := b.conn.V3.GetVM(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &vmInfo{PowerState: utils.StringValue(resp.Status.Resources.PowerState)}
+	if len(resp.Status.Resources.NicList) != 0 && len(resp.Status.Resources.NicList[0].IPEndpointList) != 0 {
+		info.IPAddress = utils.StringValue(resp.Status.Resources.NicList[0].IPEndpointList[0].IP)
+	}
+	return info, nil
+}
+
+func (b *v3Backend) SetPowerState(ctx context.Context, uuid string, on bool) error {
+	vmResp, err := b.conn.V3.GetVM(ctx, uuid)
+	if err != nil {
+		return err
+	}
+
+	powerState := "OFF"
+	if on {
+		powerState = "ON"
+	}
+
+	// Prepare VM update request
+	request := &v3.VMIntentInput{}
+	request.Spec = vmResp.Spec
+	request.Metadata = vmResp.Metadata
+	request.Spec.Resources.PowerState = utils.StringPtr(powerState)
+
+	resp, err := b.conn.V3.UpdateVM(ctx, uuid, request)
+	if err != nil {
+		return err
+	}
+
+	taskUUID := resp.Status.ExecutionContext.TaskUUID.(string)
+	logTask(taskUUID)
+
+	// Wait for the VM power state update
+	for i := 0; i < 1200; i++ {
+		resp, err := b.conn.V3.GetTask(ctx, taskUUID)
+		if err != nil || *resp.Status != "SUCCEEDED" {
+			<-time.After(1 * time.Second)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("timeout waiting for power state %s", powerState)
+}
+
+func (b *v3Backend) DeleteVM(ctx context.Context, uuid string) error {
+	resp, err := b.conn.V3.DeleteVM(ctx, uuid)
+	if err != nil {
+		return fmt.Errorf("error launching deleting VM %s: %v", uuid, err)
+	}
+
+	taskUUID := resp.Status.ExecutionContext.TaskUUID.(string)
+	logTask(taskUUID)
+
+	log.Infof("waiting to delete vm %s: task %s", uuid, taskUUID)
+
+	// Wait end of the task
+	for i := 0; i < b.timeout/5; i++ {
+		resp, err := b.conn.V3.GetTask(ctx, taskUUID)
+		if err != nil {
+			log.Errorf("Error getting task: [%v]", err)
+			return err
+		}
+
+		switch *resp.Status {
+		case "SUCCEEDED":
+			log.Infof("VM %s deletion task succeeded", uuid)
+			return nil
+		case "FAILED":
+			errMsg := strings.ReplaceAll(*resp.ErrorDetail, "\n", " ")
+			if strings.Contains(errMsg, "ENTITY_NOT_FOUND") {
+				log.Infof("VM %s already deleted", uuid)
+				return nil
+			}
+			log.Errorf("Error deleting vm: %v", errMsg)
+			return errors.New(errMsg)
+		}
+		log.Infof("VM %s deletion is in %s state", uuid, *resp.Status)
+		<-time.After(5 * time.Second)
+	}
+
+	log.Errorf("Timeout waiting to delete vm %s", uuid)
+	return errors.New("timeout waiting to delete vm")
+}
@@ -0,0 +1,522 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nutanix/docker-machine/utils"
+
+	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
+	v4 "github.com/nutanix-cloud-native/prism-go-client/v4"
+	networkingConfig "github.com/nutanix/ntnx-api-golang-clients/networking-go-client/v4/models/networking/v4/config"
+	vmmClient "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/client"
+	vmmConfig "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/prism/v4/config"
+	vmmAhvConfig "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/vmm/v4/ahv/config"
+	vmmContent "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/vmm/v4/content"
+)
+
+// v4VMEntityType is the type of the VM entities affected by the v4 tasks
+const v4VMEntityType = "vmm:ahv:config:vm"
+
+// v4Backend implements the vmBackend with the v4 API
+type v4Backend struct {
+	conn    *v4.Client
+	timeout int
+}
+
+func (b *v4Backend) GetImage(ctx context.Context, name string) (*imageInfo, error) {
+	filter := fmt.Sprintf("name eq '%s'", escapeODataString(name))
+	resp, err := b.conn.ImagesApiInstance.ListImages(nil, nil, &filter, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	images, _ := resp.GetData().([]vmmContent.Image)
+	for _, image := range images {
+		if utils.StringValue(image.Name) != name {
+			continue
+		}
+
+		info := &imageInfo{
+			UUID: utils.StringValue(image.ExtId),
+			Name: name,
+		}
+		if image.Type != nil {
+			info.Type = image.Type.GetName()
+		}
+		if image.SizeBytes != nil {
+			info.SizeBytes = *image.SizeBytes
+		}
+		return info, nil
+	}
+	return nil, nil
+}
+
+func (b *v4Backend) ListSubnets(ctx context.Context, names []string) ([]*subnetInfo, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	filters := make([]string, 0, len(names))
+	for _, name := range names {
+		filters = append(filters, fmt.Sprintf("name eq '%s'", escapeODataString(name)))
+	}
+	filter := strings.Join(filters, " or ")
+
+	resp, err := b.conn.SubnetsApiInstance.ListSubnets(nil, nil, &filter, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _ := resp.GetData().([]networkingConfig.Subnet)
+	subnets := make([]*subnetInfo, 0, len(data))
+	for _, subnet := range data {
+		info := &subnetInfo{
+			UUID:        utils.StringValue(subnet.ExtId),
+			Name:        utils.StringValue(subnet.Name),
+			ClusterUUID: utils.StringValue(subnet.ClusterReference),
+		}
+		if subnet.SubnetType != nil {
+			info.Type = subnet.SubnetType.GetName()
+		}
+		subnets = append(subnets, info)
+	}
+	return subnets, nil
+}
+
+func (b *v4Backend) CreateVM(ctx context.Context, request *v3.VMIntentInput) (string, error) {
+	name := utils.StringValue(request.Spec.Name)
+
+	vm, err := b.buildVM(request)
+	if err != nil {
+		log.Errorf("Error preparing vm: [%v]", err)
+		return "", err
+	}
+
+	log.Infof("Launch VM creation")
+	resp, err := b.conn.VmApiInstance.CreateVm(vm)
+	if err != nil {
+		log.Errorf("Error creating vm: [%v]", err)
+		return "", err
+	}
+
+	taskRef, ok := resp.GetData().(vmmConfig.TaskReference)
+	if !ok {
+		return "", fmt.Errorf("unexpected response while creating VM %s", name)
+	}
+
+	log.Infof("waiting for vm %s to create: task %s", name, utils.StringValue(taskRef.ExtId))
+
+	task, err := getV4TaskResult(b.conn, utils.StringValue(taskRef.ExtId), b.timeout)
+	uuid := ""
+	if task != nil {
+		for _, entity := range task.EntitiesAffected {
+			if utils.StringValue(entity.Rel) == v4VMEntityType {
+				uuid = utils.StringValue(entity.ExtId)
+			}
+		}
+		logVM(uuid)
+	}
+
+	if err != nil {
+		log.Errorf("Error creating vm: [%v]", err)
+		if uuid != "" {
+			log.Infof("Deleting VM %s (%s)", name, uuid)
+			if err := b.DeleteVM(ctx, uuid); err != nil {
+				log.Errorf("Failed to delete VM %s (%s): %v", name, uuid, err)
+			}
+		}
+		return "", err
+	}
+	if uuid == "" {
+		return "", fmt.Errorf("no VM found in the creation task of VM %s", name)
+	}
+
+	log.Infof("VM %s creation task succeeded", name)
+
+	// The v4 API creates the VM powered off
+	if utils.StringValue(request.Spec.Resources.PowerState) == "ON" {
+		err = b.SetPowerState(ctx, uuid, true)
+		if err != nil {
+			log.Errorf("Error powering on vm: [%v]", err)
+			return "", err
+		}
+	}
+
+	return uuid, nil
+}
+
+func (b *v4Backend) GetVM(ctx context.Context, uuid string) (*vmInfo, error) {
+	vm, _, err := b.getVM(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &vmInfo{}
+	if vm.PowerState != nil {
+		info.PowerState = vm.PowerState.GetName()
+	}
+	if len(vm.Nics) != 0 {
+		info.IPAddress = v4NicIPAddress(&vm.Nics[0])
+	}
+	return info, nil
+}
+
+func (b *v4Backend) SetPowerState(ctx context.Context, uuid string, on bool) error {
+	_, args, err := b.getVM(uuid)
+	if err != nil {
+		return err
+	}
+
+	var data interface{}
+	if on {
+		resp, err := b.conn.VmApiInstance.PowerOnVm(utils.StringPtr(uuid), args)
+		if err != nil {
+			return err
+		}
+		data = resp.GetData()
+	} else {
+		resp, err := b.conn.VmApiInstance.PowerOffVm(utils.StringPtr(uuid), args)
+		if err != nil {
+			return err
+		}
+		data = resp.GetData()
+	}
+
+	task, ok := data.(vmmConfig.TaskReference)
+	if !ok {
+		return fmt.Errorf("unexpected response while updating power state of VM %s", uuid)
+	}
+	return waitForV4Task(b.conn, utils.StringValue(task.ExtId), b.timeout)
+}
+
+func (b *v4Backend) DeleteVM(ctx context.Context, uuid string) error {
+	_, args, err := b.getVM(uuid)
+	if isV4NotFound(err) {
+		log.Infof("VM %s already deleted", uuid)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.conn.VmApiInstance.DeleteVmById(utils.StringPtr(uuid), args)
+	if err != nil {
+		return fmt.Errorf("error launching deleting VM %s: %v", uuid, err)
+	}
+
+	task, ok := resp.GetData().(vmmConfig.TaskReference)
+	if !ok {
+		return fmt.Errorf("unexpected response while deleting VM %s", uuid)
+	}
+
+	log.Infof("waiting to delete vm %s: task %s", uuid, utils.StringValue(task.ExtId))
+
+	err = waitForV4Task(b.conn, utils.StringValue(task.ExtId), b.timeout)
+	if err != nil {
+		log.Errorf("Error deleting vm: %v", err)
+		return err
+	}
+
+	log.Infof("VM %s deletion task succeeded", uuid)
+	return nil
+}
+
+// getVM retrieves the VM and the If-Match header required to update it
+func (b *v4Backend) getVM(uuid string) (*vmmAhvConfig.Vm, map[string]interface{}, error) {
+	resp, err := b.conn.VmApiInstance.GetVmById(utils.StringPtr(uuid))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vm, ok := resp.GetData().(vmmAhvConfig.Vm)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected response while getting VM %s", uuid)
+	}
+
+	etag := b.conn.VmApiInstance.ApiClient.GetEtag(resp)
+	return &vm, map[string]interface{}{"If-Match": utils.StringPtr(etag)}, nil
+}
+
+// buildVM converts the v3 VM intent to a v4 VM
+func (b *v4Backend) buildVM(request *v3.VMIntentInput) (*vmmAhvConfig.Vm, error) {
+	spec := request.Spec
+	res := spec.Resources
+	vm := vmmAhvConfig.NewVm()
+
+	vm.Name = spec.Name
+	vm.Description = spec.Description
+	if spec.ClusterReference != nil {
+		vm.Cluster = vmmAhvConfig.NewClusterReference()
+		vm.Cluster.ExtId = spec.ClusterReference.UUID
+	}
+
+	if res.MemorySizeMib != nil {
+		vm.MemorySizeBytes = utils.Int64Ptr(*res.MemorySizeMib * mib)
+	}
+	if res.NumSockets != nil {
+		vm.NumSockets = utils.IntPtr(int(*res.NumSockets))
+	}
+	if res.NumVcpusPerSocket != nil {
+		vm.NumCoresPerSocket = utils.IntPtr(int(*res.NumVcpusPerSocket))
+	}
+	if res.VMVnumaConfig != nil && res.VMVnumaConfig.NumVnumaNodes != nil {
+		vm.NumNumaNodes = utils.IntPtr(int(*res.VMVnumaConfig.NumVnumaNodes))
+	}
+	vm.IsCpuPassthroughEnabled = res.EnableCPUPassthrough
+	vm.IsVcpuHardPinningEnabled = res.EnableCPUPinning
+	if utils.BoolValue(res.HardwareVirtualizationEnabled) {
+		vm.EnabledCpuFeatures = []vmmAhvConfig.CpuFeature{vmmAhvConfig.CPUFEATURE_HARDWARE_VIRTUALIZATION}
+	}
+	if utils.StringValue(res.MachineType) == "Q35" {
+		vm.MachineType = vmmAhvConfig.MACHINETYPE_Q35.Ref()
+	}
+	if res.VtpmConfig != nil && utils.BoolValue(res.VtpmConfig.VtpmEnabled) {
+		vm.VtpmConfig = vmmAhvConfig.NewVtpmConfig()
+		vm.VtpmConfig.IsVtpmEnabled = utils.BoolPtr(true)
+	}
+
+	if res.BootConfig != nil {
+		var err error
+		switch utils.StringValue(res.BootConfig.BootType) {
+		case "LEGACY":
+			boot := vmmAhvConfig.NewLegacyBoot()
+			for _, device := range res.BootConfig.BootDeviceOrderList {
+				if utils.StringValue(device) == "DISK" {
+					boot.BootOrder = append(boot.BootOrder, vmmAhvConfig.BOOTDEVICETYPE_DISK)
+				}
+			}
+			err = vm.SetBootConfig(*boot)
+		case "UEFI", "SECURE_BOOT":
+			boot := vmmAhvConfig.NewUefiBoot()
+			boot.IsSecureBootEnabled = utils.BoolPtr(utils.StringValue(res.BootConfig.BootType) == "SECURE_BOOT")
+			err = vm.SetBootConfig(*boot)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, port := range res.SerialPortList {
+		serialPort := vmmAhvConfig.NewSerialPort()
+		if port.Index != nil {
+			serialPort.Index = utils.IntPtr(int(*port.Index))
+		}
+		serialPort.IsConnected = port.IsConnected
+		vm.SerialPorts = append(vm.SerialPorts, *serialPort)
+	}
+
+	for _, disk := range res.DiskList {
+		err := addV4Disk(vm, disk)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, nic := range res.NicList {
+		networkInfo := vmmAhvConfig.NewVirtualEthernetNicNetworkInfo()
+		networkInfo.Subnet = vmmAhvConfig.NewSubnetReference()
+		networkInfo.Subnet.ExtId = nic.SubnetReference.UUID
+
+		n := vmmAhvConfig.NewNic()
+		err := n.SetNicNetworkInfo(*networkInfo)
+		if err != nil {
+			return nil, err
+		}
+		vm.Nics = append(vm.Nics, *n)
+	}
+
+	for _, gpu := range res.GpuList {
+		g := vmmAhvConfig.NewGpu()
+		if gpu.DeviceID != nil {
+			g.DeviceId = utils.IntPtr(int(*gpu.DeviceID))
+		}
+		g.Mode = new(vmmAhvConfig.GpuMode)
+		g.Vendor = new(vmmAhvConfig.GpuVendor)
+		err := errors.Join(parseV4Enum(g.Mode, utils.StringValue(gpu.Mode)), parseV4Enum(g.Vendor, utils.StringValue(gpu.Vendor)))
+		if err != nil {
+			return nil, err
+		}
+		vm.Gpus = append(vm.Gpus, *g)
+	}
+
+	if res.GuestTools != nil && res.GuestTools.NutanixGuestTools != nil {
+		vm.GuestTools = vmmAhvConfig.NewGuestTools()
+		vm.GuestTools.IsEnabled = utils.BoolPtr(utils.StringValue(res.GuestTools.NutanixGuestTools.State) == "ENABLED")
+		for _, capability := range res.GuestTools.NutanixGuestTools.EnabledCapabilityList {
+			c := new(vmmAhvConfig.NgtCapability)
+			err := parseV4Enum(c, utils.StringValue(capability))
+			if err != nil {
+				return nil, err
+			}
+			vm.GuestTools.Capabilities = append(vm.GuestTools.Capabilities, *c)
+		}
+	}
+
+	if res.GuestCustomization != nil && res.GuestCustomization.CloudInit != nil {
+		userdata := vmmAhvConfig.NewUserdata()
+		userdata.Value = res.GuestCustomization.CloudInit.UserData
+
+		cloudInit := vmmAhvConfig.NewCloudInit()
+		cloudInit.Metadata = res.GuestCustomization.CloudInit.MetaData
+		err := cloudInit.SetCloudInitScript(*userdata)
+		if err != nil {
+			return nil, err
+		}
+
+		vm.GuestCustomization = vmmAhvConfig.NewGuestCustomizationParams()
+		err = vm.GuestCustomization.SetConfig(*cloudInit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	metadata := request.Metadata
+	if metadata != nil {
+		if metadata.ProjectReference != nil {
+			vm.Project = vmmAhvConfig.NewProjectReference()
+			vm.Project.ExtId = metadata.ProjectReference.UUID
+		}
+		if metadata.OwnerReference != nil {
+			vm.OwnershipInfo = vmmAhvConfig.NewOwnershipInfo()
+			vm.OwnershipInfo.Owner = vmmAhvConfig.NewOwnerReference()
+			vm.OwnershipInfo.Owner.ExtId = metadata.OwnerReference.UUID
+		}
+
+		categories := make(map[string][]string)
+		for key, value := range metadata.Categories {
+			categories[key] = append(categories[key], value)
+		}
+		for key, values := range metadata.CategoriesMapping {
+			categories[key] = append(categories[key], values...)
+		}
+		for key, values := range categories {
+			for _, value := range values {
+				extID, err := getCategory(b.conn, key, value)
+				if err != nil {
+					return nil, err
+				}
+				if extID == "" {
+					return nil, fmt.Errorf("category %s:%s not found", key, value)
+				}
+
+				category := vmmAhvConfig.NewCategoryReference()
+				category.ExtId = utils.StringPtr(extID)
+				vm.Categories = append(vm.Categories, *category)
+			}
+		}
+	}
+
+	return vm, nil
+}
+
+// addV4Disk converts a v3 disk or CD-ROM and adds it to the v4 VM
+func addV4Disk(vm *vmmAhvConfig.Vm, disk *v3.VMDisk) error {
+	deviceType, adapterType := "DISK", ""
+	var index *int
+	if disk.DeviceProperties != nil {
+		deviceType = utils.StringValue(disk.DeviceProperties.DeviceType)
+		if disk.DeviceProperties.DiskAddress != nil {
+			adapterType = utils.StringValue(disk.DeviceProperties.DiskAddress.AdapterType)
+			if disk.DeviceProperties.DiskAddress.DeviceIndex != nil {
+				index = utils.IntPtr(int(*disk.DeviceProperties.DiskAddress.DeviceIndex))
+			}
+		}
+	}
+
+	if deviceType == "CDROM" {
+		cdrom := vmmAhvConfig.NewCdRom()
+		if adapterType != "" {
+			cdrom.DiskAddress = vmmAhvConfig.NewCdRomAddress()
+			cdrom.DiskAddress.BusType = new(vmmAhvConfig.CdRomBusType)
+			cdrom.DiskAddress.Index = index
+			err := parseV4Enum(cdrom.DiskAddress.BusType, adapterType)
+			if err != nil {
+				return err
+			}
+		}
+		vm.CdRoms = append(vm.CdRoms, *cdrom)
+		return nil
+	}
+
+	vmDisk := vmmAhvConfig.NewVmDisk()
+	if disk.DiskSizeMib != nil {
+		vmDisk.DiskSizeBytes = utils.Int64Ptr(*disk.DiskSizeMib * mib)
+	}
+	if disk.DiskSizeBytes != nil {
+		vmDisk.DiskSizeBytes = disk.DiskSizeBytes
+	}
+	if disk.DataSourceReference != nil {
+		image := vmmAhvConfig.NewImageReference()
+		image.ImageExtId = disk.DataSourceReference.UUID
+
+		vmDisk.DataSource = vmmAhvConfig.NewDataSource()
+		err := vmDisk.DataSource.SetReference(*image)
+		if err != nil {
+			return err
+		}
+	}
+	if disk.StorageConfig != nil && disk.StorageConfig.StorageContainerReference != nil {
+		vmDisk.StorageContainer = vmmAhvConfig.NewVmDiskContainerReference()
+		vmDisk.StorageContainer.ExtId = utils.StringPtr(disk.StorageConfig.StorageContainerReference.UUID)
+	}
+
+	d := vmmAhvConfig.NewDisk()
+	if adapterType != "" {
+		d.DiskAddress = vmmAhvConfig.NewDiskAddress()
+		d.DiskAddress.BusType = new(vmmAhvConfig.DiskBusType)
+		d.DiskAddress.Index = index
+		err := parseV4Enum(d.DiskAddress.BusType, adapterType)
+		if err != nil {
+			return err
+		}
+	}
+	err := d.SetBackingInfo(*vmDisk)
+	if err != nil {
+		return err
+	}
+	vm.Disks = append(vm.Disks, *d)
+	return nil
+}
+
+// v4NicIPAddress returns the first IP address of the NIC, either assigned or learned from the guest
+func v4NicIPAddress(nic *vmmAhvConfig.Nic) string {
+	var networkInfo *vmmAhvConfig.VirtualEthernetNicNetworkInfo
+	if nic.NicNetworkInfo != nil {
+		if info, ok := nic.NicNetworkInfo.GetValue().(vmmAhvConfig.VirtualEthernetNicNetworkInfo); ok {
+			networkInfo = &info
+		}
+	}
+	if networkInfo == nil {
+		return ""
+	}
+
+	if networkInfo.Ipv4Config != nil && networkInfo.Ipv4Config.IpAddress != nil {
+		return utils.StringValue(networkInfo.Ipv4Config.IpAddress.Value)
+	}
+	if networkInfo.Ipv4Info != nil && len(networkInfo.Ipv4Info.LearnedIpAddresses) != 0 {
+		return utils.StringValue(networkInfo.Ipv4Info.LearnedIpAddresses[0].Value)
+	}
+	return ""
+}
+
+// parseV4Enum sets a v4 enumeration from its name
+func parseV4Enum(enum json.Unmarshaler, name string) error {
+	err := enum.UnmarshalJSON([]byte(strconv.Quote(name)))
+	if err != nil {
+		return fmt.Errorf("invalid value %s: %v", name, err)
+	}
+	return nil
+}
+
+// isV4NotFound checks if a v4 API call failed because the entity does not exist
+func isV4NotFound(err error) bool {
+	var apiErr vmmClient.GenericOpenAPIError
+	return errors.As(err, &apiErr) && strings.HasPrefix(apiErr.Status, "404")
+}
@@ -0,0 +1,159 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
+)
+
+// Capacity check modes
+const (
+	capacityCheckOff  = "off"
+	capacityCheckWarn = "warn"
+	capacityCheckFail = "fail"
+)
+
+var capacityCheckModes = []string{capacityCheckOff, capacityCheckWarn, capacityCheckFail}
+
+const mib = 1024 * 1024
+
+// CapacityRequest is the capacity required by the VM
+type CapacityRequest struct {
+	MemoryBytes  int64
+	VCPUs        int64
+	StorageBytes int64
+}
+
+// CheckClusterCapacity compares the memory and storage required by the VM with the free capacity of the cluster.
+// The vCPUs are compared by CheckClusterVCPUs as AHV allows their overcommitment.
+// It returns the list of shortfalls or an error if the cluster statistics cannot be retrieved.
+func CheckClusterCapacity(ctx context.Context, creds connConfig, cluster *ClusterCandidate, request CapacityRequest) ([]string, error) {
+	stats, err := getGroupsAttributes(ctx, creds, "cluster", "", "memory_capacity_bytes", "hypervisor_memory_usage_ppm", "storage.capacity_bytes", "storage.usage_bytes")
+	if err != nil {
+		return nil, err
+	}
+
+	clusterStats, ok := stats[cluster.UUID]
+	if !ok {
+		return nil, fmt.Errorf("no statistics found for cluster %s", cluster.Name)
+	}
+
+	shortfalls := make([]string, 0)
+
+	memoryCapacity, err := strconv.ParseInt(clusterStats["memory_capacity_bytes"], 10, 64)
+	if err == nil {
+		memoryUsage, _ := strconv.ParseInt(clusterStats["hypervisor_memory_usage_ppm"], 10, 64)
+		freeMemory := memoryCapacity - memoryCapacity/1000000*memoryUsage
+		log.Infof("Cluster %s has %d MiB of free memory", cluster.Name, freeMemory/mib)
+		if request.MemoryBytes > freeMemory {
+			shortfalls = append(shortfalls, fmt.Sprintf("cluster %s: %d MiB of memory requested, %d MiB free (short by %d MiB)",
+				cluster.Name, request.MemoryBytes/mib, freeMemory/mib, (request.MemoryBytes-freeMemory)/mib))
+		}
+	}
+
+	storageCapacity, err := strconv.ParseInt(clusterStats["storage.capacity_bytes"], 10, 64)
+	if err == nil {
+		storageUsage, _ := strconv.ParseInt(clusterStats["storage.usage_bytes"], 10, 64)
+		freeStorage := storageCapacity - storageUsage
+		log.Infof("Cluster %s has %d GiB of free storage", cluster.Name, freeStorage/mib/1024)
+		if request.StorageBytes > freeStorage {
+			shortfalls = append(shortfalls, fmt.Sprintf("cluster %s: %d GiB of storage requested, %d GiB free (short by %d GiB)",
+				cluster.Name, request.StorageBytes/mib/1024, freeStorage/mib/1024, (request.StorageBytes-freeStorage)/mib/1024))
+		}
+	}
+
+	return shortfalls, nil
+}
+
+// CheckClusterVCPUs compares the vCPUs required by the VM with the physical CPU cores of the cluster
+// not allocated to the powered on VMs.
+// AHV allows the overcommitment of the vCPUs, so the shortfalls are only warnings.
+// It returns the list of shortfalls or an error if the hosts or the VMs of the cluster cannot be retrieved.
+func CheckClusterVCPUs(ctx context.Context, conn *v3.Client, creds connConfig, cluster *ClusterCandidate, vcpus int64) ([]string, error) {
+	hosts, err := GetHostsForPE(ctx, conn, cluster.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	cores := int64(0)
+	for _, host := range hosts {
+		if host.Status.Resources != nil && host.Status.Resources.NumCPUCores != nil {
+			cores += *host.Status.Resources.NumCPUCores
+		}
+	}
+	if cores == 0 {
+		return nil, fmt.Errorf("no CPU core found for cluster %s", cluster.Name)
+	}
+
+	vms, err := getGroupsAttributes(ctx, creds, "mh_vm", "", "cluster", "power_state", "num_vcpus")
+	if err != nil {
+		return nil, err
+	}
+
+	allocated := int64(0)
+	for _, vm := range vms {
+		if vm["cluster"] != cluster.UUID || !strings.EqualFold(vm["power_state"], "on") {
+			continue
+		}
+		n, _ := strconv.ParseInt(vm["num_vcpus"], 10, 64)
+		allocated += n
+	}
+
+	free := cores - allocated
+	log.Infof("Cluster %s has %d vCPUs allocated on %d CPU cores", cluster.Name, allocated, cores)
+
+	shortfalls := make([]string, 0)
+	if vcpus > free {
+		shortfalls = append(shortfalls, fmt.Sprintf("cluster %s: %d vCPUs requested, %d CPU cores free without overcommitment (short by %d vCPUs)",
+			cluster.Name, vcpus, max(free, 0), vcpus-max(free, 0)))
+	}
+	return shortfalls, nil
+}
+
+// CheckProjectQuota compares the memory, vCPUs and storage required by the VM with the quota left in the project.
+// A resource without limit is not restricted.
+// It returns the list of shortfalls.
+func CheckProjectQuota(project *v3.Project, request CapacityRequest) []string {
+	shortfalls := make([]string, 0)
+
+	if project == nil || project.Status == nil || project.Status.Resources == nil || project.Status.Resources.ResourceDomain == nil {
+		return shortfalls
+	}
+
+	for _, resource := range project.Status.Resources.ResourceDomain.Resources {
+		if resource == nil || resource.Limit == nil || *resource.Limit <= 0 {
+			continue
+		}
+
+		used := int64(0)
+		if resource.Value != nil {
+			used = *resource.Value
+		}
+		left := *resource.Limit - used
+
+		switch resource.ResourceType {
+		case "MEMORY":
+			if request.MemoryBytes > left {
+				shortfalls = append(shortfalls, fmt.Sprintf("project %s: %d MiB of memory requested, %d MiB left in quota (short by %d MiB)",
+					project.Status.Name, request.MemoryBytes/mib, left/mib, (request.MemoryBytes-left)/mib))
+			}
+		case "VCPUS":
+			if request.VCPUs > left {
+				shortfalls = append(shortfalls, fmt.Sprintf("project %s: %d vCPUs requested, %d vCPUs left in quota (short by %d vCPUs)",
+					project.Status.Name, request.VCPUs, left, request.VCPUs-left))
+			}
+		case "STORAGE":
+			if request.StorageBytes > left {
+				shortfalls = append(shortfalls, fmt.Sprintf("project %s: %d GiB of storage requested, %d GiB left in quota (short by %d GiB)",
+					project.Status.Name, request.StorageBytes/mib/1024, left/mib/1024, (request.StorageBytes-left)/mib/1024))
+			}
+		}
+	}
+
+	return shortfalls
+}
@@ -0,0 +1,162 @@
+package driver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	client "github.com/nutanix-cloud-native/prism-go-client"
+	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
+	v4 "github.com/nutanix-cloud-native/prism-go-client/v4"
+	networkingClient "github.com/nutanix/ntnx-api-golang-clients/networking-go-client/v4/client"
+	prismClient "github.com/nutanix/ntnx-api-golang-clients/prism-go-client/v4/client"
+	vmmClient "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/client"
+)
+
+// connConfig holds the Prism Central credentials, the TLS configuration, the retry policy, the rate limit and the tracing of the connections.
+// All the API clients of the driver are built from it.
+type connConfig struct {
+	client.Credentials
+	// TLSConfig replaces the default certificate verification when it is set
+	TLSConfig *tls.Config
+	// Retry is the retry policy of the API calls failing with a transient error
+	Retry retryPolicy
+	// RateLimiter limits the requests per second sent to Prism Central when it is set
+	RateLimiter *rateLimiter
+	// Tracer dumps the requests and the responses when it is set
+	Tracer *wireTracer
+}
+
+// tlsClientConfig returns the TLS configuration of a connection
+func (c connConfig) tlsClientConfig() *tls.Config {
+	if c.TLSConfig != nil {
+		return c.TLSConfig.Clone()
+	}
+	return &tls.Config{InsecureSkipVerify: c.Insecure} // #nosec G402 -- explicitly requested by nutanix-insecure
+}
+
+// proxy returns the proxy function of the connection, nil for a direct connection
+func (c connConfig) proxy() (func(*http.Request) (*url.URL, error), error) {
+	if c.ProxyURL == "" {
+		return nil, nil
+	}
+	proxy, err := url.Parse(c.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing proxy url: %v", err)
+	}
+	return http.ProxyURL(proxy), nil
+}
+
+// transport returns an HTTP transport with the TLS configuration and the proxy of the connection.
+// The proxy resolved when the machine was configured is used rather than the proxy environment variables.
+func (c connConfig) transport() (*http.Transport, error) {
+	proxy, err := c.proxy()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = c.tlsClientConfig()
+	transport.Proxy = proxy
+	return transport, nil
+}
+
+// roundTripper returns the transport of the connection retrying the idempotent requests on transient failures.
+// Each attempt waits for the rate limiter and is traced.
+func (c connConfig) roundTripper() (http.RoundTripper, error) {
+	transport, err := c.transport()
+	if err != nil {
+		return nil, err
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if c.Tracer != nil {
+		roundTripper = &traceTransport{next: roundTripper, tracer: c.Tracer}
+	}
+	if c.RateLimiter != nil {
+		roundTripper = &rateLimitTransport{next: roundTripper, limiter: c.RateLimiter}
+	}
+	if c.Retry.MaxRetries != 0 {
+		roundTripper = &retryTransport{next: roundTripper, policy: c.Retry}
+	}
+	return roundTripper, nil
+}
+
+// newV3Client returns a v3 API client
+func (c connConfig) newV3Client() (*v3.Client, error) {
+	transport, err := c.roundTripper()
+	if err != nil {
+		return nil, err
+	}
+	return v3.NewV3Client(c.Credentials, v3.WithRoundTripper(transport))
+}
+
+// newV4Client returns a v4 API client.
+// Its API clients send their requests through a loopback proxy applying the same transport as the v3 client,
+// the proxy stops when the API clients are garbage collected.
+func (c connConfig) newV4Client() (*v4.Client, error) {
+	conn, err := v4.NewV4Client(c.Credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SDK takes the port from the endpoint only, defaulting to 9440
+	port := conn.VmApiInstance.ApiClient.Port
+	if c.Port != "" {
+		port, err = strconv.Atoi(c.Port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s: %v", c.Port, err)
+		}
+	}
+
+	roundTripper, err := c.roundTripper()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := startV4Proxy(net.JoinHostPort(conn.VmApiInstance.ApiClient.Host, strconv.Itoa(port)), roundTripper)
+	if err != nil {
+		return nil, err
+	}
+
+	// The images and the anti-affinity policies share the API client of the VMs, the tasks the one of the categories
+	for _, apiClient := range []v4APIClient{conn.VmApiInstance.ApiClient, conn.SubnetsApiInstance.ApiClient, conn.CategoriesApiInstance.ApiClient} {
+		err = configureV4Client(apiClient, proxy)
+		if err != nil {
+			proxy.close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// v4APIClient is the configuration exposed by the API clients of the v4 SDK
+type v4APIClient interface {
+	AddDefaultHeader(headerName string, headerValue string)
+	SetMaxRetryAttempts(maxRetryAttempts int)
+}
+
+// configureV4Client sends the requests of a v4 API client in plain HTTP to the loopback proxy, which connects to Prism Central.
+// The retries are left to the proxy, which retries the creations too: they reuse their NTNX-Request-Id, which Prism Central deduplicates.
+func configureV4Client(apiClient v4APIClient, proxy *v4Proxy) error {
+	// Each SDK declares its own API client type
+	switch apiClient := apiClient.(type) {
+	case *vmmClient.ApiClient:
+		apiClient.Scheme, apiClient.Host, apiClient.Port = "http", "127.0.0.1", proxy.port
+		retainV4Proxy(apiClient, proxy)
+	case *networkingClient.ApiClient:
+		apiClient.Scheme, apiClient.Host, apiClient.Port = "http", "127.0.0.1", proxy.port
+		retainV4Proxy(apiClient, proxy)
+	case *prismClient.ApiClient:
+		apiClient.Scheme, apiClient.Host, apiClient.Port = "http", "127.0.0.1", proxy.port
+		retainV4Proxy(apiClient, proxy)
+	default:
+		return fmt.Errorf("unsupported v4 API client %T", apiClient)
+	}
+
+	apiClient.AddDefaultHeader(v4ProxyTokenHeader, proxy.token)
+	apiClient.SetMaxRetryAttempts(0)
+	return nil
+}
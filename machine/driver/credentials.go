@@ -0,0 +1,358 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	client "github.com/nutanix-cloud-native/prism-go-client"
+)
+
+// Credential source kinds of the nutanix-credentials-source flag
+const (
+	credentialsSourceFile   = "file"
+	credentialsSourceHelper = "helper"
+	credentialsSourceNetrc  = "netrc"
+)
+
+// credentialHelperTimeout is the maximum duration of a credential helper execution
+const credentialHelperTimeout = 30 * time.Second
+
+// credentialsSource resolves the Prism Central username and password from an external source.
+// Only the reference of the source is persisted with the machine.
+type credentialsSource struct {
+	Kind string
+	Path string
+}
+
+// parseCredentialsSource parses a source reference: file:<path>, helper:<executable> or netrc:[<path>]
+func parseCredentialsSource(reference string) (*credentialsSource, error) {
+	kind, path, ok := strings.Cut(strings.TrimSpace(reference), ":")
+	if !ok {
+		return nil, fmt.Errorf("malformed credentials source %s, expecting file:<path>, helper:<executable> or netrc:[<path>]", reference)
+	}
+
+	source := &credentialsSource{Kind: strings.ToLower(kind), Path: strings.TrimSpace(path)}
+	switch source.Kind {
+	case credentialsSourceFile, credentialsSourceHelper:
+		if source.Path == "" {
+			return nil, fmt.Errorf("credentials source %s requires a path", source.Kind)
+		}
+	case credentialsSourceNetrc:
+	default:
+		return nil, fmt.Errorf("unknown credentials source %s", kind)
+	}
+	return source, nil
+}
+
+// Resolve reads the username and password of the endpoint from the source
+func (s *credentialsSource) Resolve(endpoint string) (string, string, error) {
+	var username, password string
+	var err error
+
+	switch s.Kind {
+	case credentialsSourceFile:
+		username, password, err = readCredentialsFile(s.Path)
+	case credentialsSourceHelper:
+		username, password, err = runCredentialHelper(s.Path, endpoint)
+	case credentialsSourceNetrc:
+		username, password, err = readNetrc(s.Path, endpoint)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read credentials from %s source: %v", s.Kind, err)
+	}
+	if username == "" || password == "" {
+		return "", "", fmt.Errorf("%s source did not provide a username and a password for %s", s.Kind, endpoint)
+	}
+	return username, password, nil
+}
+
+// readCredentialsFile reads the credentials from a directory holding username and password files,
+// like a mounted Kubernetes secret, or from a file with the username and the password on the first two lines.
+func readCredentialsFile(path string) (string, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	if info.IsDir() {
+		username, err := os.ReadFile(filepath.Join(path, "username"))
+		if err != nil {
+			return "", "", err
+		}
+		password, err := os.ReadFile(filepath.Join(path, "password"))
+		if err != nil {
+			return "", "", err
+		}
+		return strings.TrimSpace(string(username)), strings.TrimRight(string(password), "\r\n"), nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	lines := strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n")
+	if len(lines) < 2 {
+		return "", "", fmt.Errorf("%s must hold the username and the password on two lines", path)
+	}
+	return strings.TrimSpace(lines[0]), lines[1], nil
+}
+
+// runCredentialHelper runs the helper with the docker credential helpers protocol:
+// "<helper> get" receives the endpoint on stdin and prints {"Username": ..., "Secret": ...} on stdout.
+func runCredentialHelper(helper, endpoint string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialHelperTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, helper, "get") // #nosec G204 -- the helper is configured by the operator
+	cmd.Stdin = strings.NewReader(endpoint)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return "", "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	resp := struct {
+		Username string
+		Secret   string
+	}{}
+	err = json.Unmarshal(stdout.Bytes(), &resp)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid helper output: %v", err)
+	}
+	return resp.Username, resp.Secret, nil
+}
+
+// readNetrc reads the login and password of the endpoint machine, or of the default entry, from a .netrc file.
+// Without path, $NETRC or ~/.netrc is used.
+func readNetrc(path, endpoint string) (string, string, error) {
+	if path == "" {
+		path = os.Getenv("NETRC")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", err
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	var login, password string
+	found, inEntry := false, false
+	tokens := strings.Fields(string(content))
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "machine", "default":
+			if found {
+				return login, password, nil
+			}
+			inEntry = tokens[i] == "default"
+			if tokens[i] == "machine" && i+1 < len(tokens) {
+				i++
+				inEntry = tokens[i] == endpoint
+			}
+			found = inEntry
+			login, password = "", ""
+		case "login", "password":
+			if i+1 < len(tokens) {
+				if inEntry && tokens[i] == "login" {
+					login = tokens[i+1]
+				} else if inEntry {
+					password = tokens[i+1]
+				}
+				i++
+			}
+		}
+	}
+	if !found {
+		return "", "", fmt.Errorf("no entry for %s in %s", endpoint, path)
+	}
+	return login, password, nil
+}
+
+// readAPIKeyFile reads a service account API key from a file
+func readAPIKeyFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the API key file: %v", err)
+	}
+	apiKey := strings.TrimSpace(string(content))
+	if apiKey == "" {
+		return "", fmt.Errorf("API key file %s is empty", path)
+	}
+	return apiKey, nil
+}
+
+// errAPIKeyRejected is returned by checkAPIKey when Prism Central rejects the API key
+var errAPIKeyRejected = errors.New("the Nutanix API key was rejected by Prism Central")
+
+// checkAPIKey validates the API key with a lightweight authenticated request
+func checkAPIKey(ctx context.Context, creds connConfig) error {
+	request := map[string]interface{}{"kind": "cluster", "length": 1}
+	err := doPrismRequest(ctx, creds, http.MethodPost, "/clusters/list", request, nil)
+	if errors.Is(err, errUnauthorized) {
+		return fmt.Errorf("%w %s, it is invalid, expired or revoked", errAPIKeyRejected, creds.Endpoint)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to validate the Nutanix API key: %v", err)
+	}
+	return nil
+}
+
+// usesAPIKey reports whether the driver authenticates with a service account API key
+func (d *NutanixDriver) usesAPIKey() bool {
+	return d.APIKey != "" || d.APIKeyFile != "" || strings.EqualFold(d.Username, apiKeyUsername)
+}
+
+// apiKeyError replaces the error of an operation on an existing machine with the explicit error of checkAPIKey
+// when the failure comes from an API key rejected by Prism Central. Other errors are returned unchanged.
+func apiKeyError(ctx context.Context, creds connConfig, err error) error {
+	if err == nil || creds.APIKey == "" {
+		return err
+	}
+
+	keyErr := checkAPIKey(ctx, creds)
+	if errors.Is(keyErr, errAPIKeyRejected) {
+		return keyErr
+	}
+	return err
+}
+
+// PreCreateCheck validates the API key of the service account before the creation
+func (d *NutanixDriver) PreCreateCheck() error {
+	if !d.usesAPIKey() {
+		return nil
+	}
+
+	creds, err := d.prismCredentials()
+	if err != nil {
+		return err
+	}
+	return checkAPIKey(context.Background(), creds)
+}
+
+// Environment variables overriding the stored credentials for the operations on existing machines,
+// like after a password rotation
+const (
+	overrideUsernameEnv          = "NUTANIX_OVERRIDE_USERNAME"
+	overridePasswordEnv          = "NUTANIX_OVERRIDE_PASSWORD"
+	overrideAPIKeyEnv            = "NUTANIX_OVERRIDE_API_KEY"
+	overrideCredentialsSourceEnv = "NUTANIX_OVERRIDE_CREDENTIALS_SOURCE"
+)
+
+// readCredentialsOverride returns the credentials overriding the stored ones for the endpoint, or nil without override.
+// The API key takes precedence over the username and password, which take precedence over the credentials source.
+func readCredentialsOverride(endpoint string) (*client.Credentials, error) {
+	if apiKey := os.Getenv(overrideAPIKeyEnv); apiKey != "" {
+		return &client.Credentials{APIKey: apiKey}, nil
+	}
+
+	username, password := os.Getenv(overrideUsernameEnv), os.Getenv(overridePasswordEnv)
+	if username != "" || password != "" {
+		if username == "" || password == "" {
+			return nil, fmt.Errorf("%s and %s must be set together", overrideUsernameEnv, overridePasswordEnv)
+		}
+		return &client.Credentials{Username: username, Password: password}, nil
+	}
+
+	if reference := os.Getenv(overrideCredentialsSourceEnv); reference != "" {
+		source, err := parseCredentialsSource(reference)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", overrideCredentialsSourceEnv, err)
+		}
+		username, password, err := source.Resolve(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return &client.Credentials{Username: username, Password: password}, nil
+	}
+	return nil, nil
+}
+
+// prismCredentials builds the Prism Central credentials and TLS configuration of the creation, reading the API key file
+// or resolving the username and password from the credentials source when one is configured.
+// With the trust on first use, the certificate is pinned by these credentials.
+func (d *NutanixDriver) prismCredentials() (connConfig, error) {
+	return d.buildCredentials(nil, true)
+}
+
+// operationCredentials builds the Prism Central credentials of the operations on the existing VM,
+// the credentials override taking precedence over the stored credentials.
+func (d *NutanixDriver) operationCredentials() (connConfig, error) {
+	override, err := readCredentialsOverride(d.Endpoint)
+	if err != nil {
+		return connConfig{}, err
+	}
+	if override != nil {
+		log.Infof("Using the credentials override of the environment")
+	}
+	return d.buildCredentials(override, false)
+}
+
+func (d *NutanixDriver) buildCredentials(override *client.Credentials, creation bool) (connConfig, error) {
+	creds := connConfig{Credentials: client.Credentials{
+		URL:         fmt.Sprintf("%s:%s", d.Endpoint, d.Port),
+		Endpoint:    d.Endpoint,
+		Port:        d.Port,
+		Insecure:    d.Insecure,
+		SessionAuth: d.SessionAuth,
+		ProxyURL:    d.ProxyURL,
+	}, Retry: d.apiRetryPolicy(), RateLimiter: newRateLimiter(d.throttleDir(), d.Endpoint, d.APIRateLimit), Tracer: d.newWireTracer()}
+
+	switch {
+	case override != nil:
+		creds.APIKey = override.APIKey
+		creds.Username = override.Username
+		creds.Password = override.Password
+	case d.APIKey != "":
+		creds.APIKey = d.APIKey
+	case d.APIKeyFile != "":
+		apiKey, err := readAPIKeyFile(d.APIKeyFile)
+		if err != nil {
+			return connConfig{}, err
+		}
+		creds.APIKey = apiKey
+	case d.CredentialsSource != "":
+		source, err := parseCredentialsSource(d.CredentialsSource)
+		if err != nil {
+			return connConfig{}, err
+		}
+		creds.Username, creds.Password, err = source.Resolve(d.Endpoint)
+		if err != nil {
+			return connConfig{}, err
+		}
+	default:
+		creds.Username = d.Username
+		creds.Password = d.Password
+	}
+
+	tlsConfig, err := d.tlsConfig(creds, creation)
+	if err != nil {
+		return connConfig{}, err
+	}
+	creds.TLSConfig = tlsConfig
+
+	err = d.setupLogRedaction(creds)
+	if err != nil {
+		return connConfig{}, err
+	}
+	return creds, nil
+}
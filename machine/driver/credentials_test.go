@@ -0,0 +1,202 @@
+package driver
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+func writeTestFile(t *testing.T, path, content string, perm os.FileMode) string {
+	t.Helper()
+
+	err := os.WriteFile(path, []byte(content), perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCredentialsSources(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	err := os.Mkdir(secret, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(secret, "username"), "admin\n", 0600)
+	writeTestFile(t, filepath.Join(secret, "password"), "nutanix/4u\n", 0600)
+
+	lines := writeTestFile(t, filepath.Join(dir, "creds"), "admin\nnutanix/4u\n", 0600)
+	netrc := writeTestFile(t, filepath.Join(dir, "netrc"), "machine other login foo password bar\nmachine pc.example.com\n  login admin\n  password nutanix/4u\ndefault login anonymous password none\n", 0600)
+	helper := writeTestFile(t, filepath.Join(dir, "helper"), "#!/bin/sh\nread endpoint\n[ \"$1\" = get ] && [ \"$endpoint\" = pc.example.com ] && echo '{\"Username\": \"admin\", \"Secret\": \"nutanix/4u\"}'\n", 0700)
+
+	tests := []struct {
+		name      string
+		reference string
+		endpoint  string
+		username  string
+		password  string
+		expected  string
+	}{
+		{"secret directory", "file:" + secret, "pc.example.com", "admin", "nutanix/4u", ""},
+		{"two lines file", "file:" + lines, "pc.example.com", "admin", "nutanix/4u", ""},
+		{"netrc machine", "netrc:" + netrc, "pc.example.com", "admin", "nutanix/4u", ""},
+		{"netrc default", "netrc:" + netrc, "pc2.example.com", "anonymous", "none", ""},
+		{"helper", "helper:" + helper, "pc.example.com", "admin", "nutanix/4u", ""},
+		{"helper failure", "helper:" + helper, "pc2.example.com", "", "", "failed to read credentials from helper source"},
+		{"missing file", "file:" + filepath.Join(dir, "missing"), "pc.example.com", "", "", "failed to read credentials from file source"},
+		{"unknown kind", "vault:secret/pc", "pc.example.com", "", "", "unknown credentials source"},
+		{"malformed", secret, "pc.example.com", "", "", "malformed credentials source"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := parseCredentialsSource(tt.reference)
+			var username, password string
+			if err == nil {
+				username, password, err = source.Resolve(tt.endpoint)
+			}
+			if tt.expected != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expected) {
+					t.Fatalf("expected error %q, got %v", tt.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != tt.username || password != tt.password {
+				t.Errorf("expected %s/%s, got %s/%s", tt.username, tt.password, username, password)
+			}
+		})
+	}
+}
+
+func TestCreateWithCredentialsSource(t *testing.T) {
+	env := newTestEnv(t)
+	path := writeTestFile(t, filepath.Join(t.TempDir(), "creds"), simUsername+"\n"+simPassword+"\n", 0600)
+	d := env.newDriver(t, testFlags{
+		"nutanix-username":           "",
+		"nutanix-password":           "",
+		"nutanix-credentials-source": "file:" + path,
+	})
+
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	config, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(config), simPassword) {
+		t.Errorf("the password is persisted with the machine: %s", config)
+	}
+
+	// The credentials are read again on each operation
+	writeTestFile(t, path, simUsername+"\nwrong\n", 0600)
+	_, err = d.GetState()
+	if err == nil {
+		t.Fatal("expected GetState to fail with the rotated out password")
+	}
+	writeTestFile(t, path, simUsername+"\n"+simPassword+"\n", 0600)
+	assertState(t, d, state.Running)
+}
+
+func TestAPIKey(t *testing.T) {
+	env := newTestEnv(t)
+	path := writeTestFile(t, filepath.Join(t.TempDir(), "api-key"), simAPIKey+"\n", 0600)
+	d := env.newDriver(t, testFlags{
+		"nutanix-username":     "",
+		"nutanix-password":     "",
+		"nutanix-api-key-file": path,
+	})
+
+	err := d.PreCreateCheck()
+	if err != nil {
+		t.Fatalf("PreCreateCheck: %v", err)
+	}
+	err = d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	assertState(t, d, state.Running)
+
+	// A key revoked after the creation is reported by the operations on the machine
+	writeTestFile(t, path, "revoked\n", 0600)
+	_, err = d.GetState()
+	if err == nil || !strings.Contains(err.Error(), "expired or revoked") {
+		t.Errorf("GetState: expected a rejected API key error, got %v", err)
+	}
+	for name, operation := range map[string]func() error{"Start": d.Start, "Stop": d.Stop, "Remove": d.Remove} {
+		err = operation()
+		if err == nil || !strings.Contains(err.Error(), "expired or revoked") {
+			t.Errorf("%s: expected a rejected API key error, got %v", name, err)
+		}
+	}
+	if env.sim.vmCount() != 1 {
+		t.Errorf("expected the VM to be kept")
+	}
+
+	// A revoked key is reported before the creation
+	d = env.newDriver(t, testFlags{
+		"nutanix-username": "",
+		"nutanix-password": "",
+		"nutanix-api-key":  "revoked",
+	})
+	err = d.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), "expired or revoked") {
+		t.Fatalf("expected a rejected API key error, got %v", err)
+	}
+}
+
+func TestCredentialsOverride(t *testing.T) {
+	for _, key := range []string{overrideUsernameEnv, overridePasswordEnv, overrideAPIKeyEnv, overrideCredentialsSourceEnv} {
+		t.Setenv(key, "")
+	}
+
+	env := newTestEnv(t)
+	d := env.newDriver(t, nil)
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// The password stored with the machine was rotated
+	d.Password = "rotated-out"
+	_, err = d.GetState()
+	if err == nil {
+		t.Fatal("expected GetState to fail with the old password")
+	}
+
+	t.Setenv(overrideUsernameEnv, simUsername)
+	_, err = d.GetState()
+	if err == nil || !strings.Contains(err.Error(), "must be set together") {
+		t.Fatalf("expected an incomplete override error, got %v", err)
+	}
+
+	t.Setenv(overridePasswordEnv, simPassword)
+	assertState(t, d, state.Running)
+
+	t.Setenv(overrideUsernameEnv, "")
+	t.Setenv(overridePasswordEnv, "")
+	t.Setenv(overrideAPIKeyEnv, simAPIKey)
+	assertState(t, d, state.Running)
+
+	t.Setenv(overrideAPIKeyEnv, "")
+	host, _ := env.sim.endpoint()
+	netrc := writeTestFile(t, filepath.Join(t.TempDir(), "netrc"), "machine "+host+" login "+simUsername+" password "+simPassword+"\n", 0600)
+	t.Setenv(overrideCredentialsSourceEnv, "netrc:"+netrc)
+	err = d.Remove()
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if env.sim.vmCount() != 0 {
+		t.Error("expected the VM to be deleted")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -31,36 +32,74 @@ const (
 	defaultBootType = "legacy"
 )
 
+var (
+	bootTypes     = []string{"legacy", "uefi", "secure_boot"}
+	bootDiskBuses = []string{"scsi", "pci", "ide", "sata"}
+)
+
 // NutanixDriver driver structure
 type NutanixDriver struct {
 	*drivers.BaseDriver
-	Endpoint         string
-	Username         string
-	Password         string
-	Port             string
-	Insecure         bool
-	Cluster          string
-	VMVCPUs          int
-	VMCores          int
-	VMCPUPassthrough bool
-	VMMem            int
-	SSHPass          string
-	Subnet           []string
-	Image            string
-	ImageSize        int
-	VMId             string
-	SessionAuth      bool
-	ProxyURL         string
-	Categories       []string
-	StorageContainer string
-	DiskSize         int
-	CloudInit        string
-	SerialPort       bool
-	Project          string
-	BootType         string
-	Timeout          int
-	GPUs             []string
-	Description      string
+	Endpoint          string
+	Username          string
+	Password          string
+	Port              string
+	Insecure          bool
+	Cluster           string
+	VMVCPUs           int
+	VMCores           int
+	VMCPUPassthrough  bool
+	VMMem             int
+	SSHPass           string
+	Subnet            []string
+	Image             string
+	ImageSize         int
+	VMId              string
+	SessionAuth       bool
+	ProxyURL          string
+	Categories        []string
+	StorageContainer  string
+	DiskSize          int
+	CloudInit         string
+	SerialPort        bool
+	Project           string
+	BootType          string
+	Timeout           int
+	GPUs              []string
+	Description       string
+	Owner             string
+	AntiAffinityGroup string
+	HostCategory      string
+	Hosts             []string
+	HostAffinityValue string
+	ClusterCategory   string
+	ClusterPlacement  string
+	ClusterUUID       string
+	CapacityCheck     string
+	VTPM              bool
+	BootDiskBus       string
+	VMTotalVCPUs      int
+	VMVnumaNodes      int
+	VMNestedVirt      bool
+	VMCPUPinning      bool
+	GuestTools        bool
+	GuestToolsCaps    []string
+	APIVersion        string
+	CredentialsSource string
+	APIKey            string
+	APIKeyFile        string
+	CABundle          string
+	TLSFingerprint    string
+	TrustOnFirstUse   bool
+	ClientCert        string
+	ClientKey         string
+	APIRetries        int
+	APIRetryMaxWait   int
+	APIRateLimit      int
+	MaxCreations      int
+	LogRedactPatterns []string
+	UnredactedLogs    bool
+	Trace             bool
 }
 
 // NewDriver create new instance
@@ -76,27 +115,47 @@ func NewDriver(hostname, storePath string) *NutanixDriver {
 // Create a host using the driver's config
 func (d *NutanixDriver) Create() error {
 	name := d.GetMachineName()
+	defer d.beginOperation("create")()
 
-	configCreds := client.Credentials{
-		URL:         fmt.Sprintf("%s:%s", d.Endpoint, d.Port),
-		Endpoint:    d.Endpoint,
-		Username:    d.Username,
-		Password:    d.Password,
-		Port:        d.Port,
-		Insecure:    d.Insecure,
-		SessionAuth: d.SessionAuth,
-		ProxyURL:    d.ProxyURL,
+	configCreds, err := d.prismCredentials()
+	if err != nil {
+		return err
 	}
 
 	ctx := context.Background()
 
+	// Limit the concurrent creations with the other driver processes sharing the machine store
+	if d.MaxCreations > 0 {
+		logPhase("throttle")
+		slot, err := acquireCreationSlot(ctx, d.throttleDir(), d.Endpoint, d.MaxCreations, time.Duration(d.Timeout)*time.Second)
+		if err != nil {
+			log.Errorf("Error waiting for a creation slot: [%v]", err)
+			return err
+		}
+		defer slot.release()
+	}
+
+	logPhase("configure")
 	log.Infof("Connecting on: %s", configCreds.URL)
 
-	conn, err := v3.NewV3Client(configCreds)
+	conn, err := configCreds.newV3Client()
+	if err != nil {
+		return err
+	}
+
+	backend, err := d.newBackend(configCreds)
 	if err != nil {
 		return err
 	}
 
+	if d.APIVersion == apiVersionV4 {
+		err = checkV3API(ctx, conn)
+		if err != nil {
+			log.Errorf("Error checking v3 API: [%v]", err)
+			return err
+		}
+	}
+
 	// Prepare VM creation request
 	request := &v3.VMIntentInput{}
 	spec := &v3.VM{}
@@ -115,11 +174,42 @@ func (d *NutanixDriver) Create() error {
 		res.BootConfig.BootDeviceOrderList = append(res.BootConfig.BootDeviceOrderList, utils.StringPtr("DISK"))
 	}
 
+	// Secure Boot requires the Q35 machine type
+	if d.BootType == "secure_boot" {
+		res.MachineType = utils.StringPtr("Q35")
+	}
+
+	// Add vTPM
+	if d.VTPM {
+		log.Infof("Enable vTPM")
+		res.VtpmConfig = &v3.VMVtpmConfig{
+			VtpmEnabled: utils.BoolPtr(true),
+		}
+	}
+
 	// Configure CPU Passthrough
 	if d.VMCPUPassthrough {
 		res.EnableCPUPassthrough = utils.BoolPtr(d.VMCPUPassthrough)
 	}
 
+	// Configure vNUMA
+	if d.VMVnumaNodes > 0 {
+		log.Infof("Set vNUMA nodes to %d", d.VMVnumaNodes)
+		res.VMVnumaConfig = &v3.VMVnumaConfig{
+			NumVnumaNodes: utils.Int64Ptr(int64(d.VMVnumaNodes)),
+		}
+	}
+
+	// Configure nested virtualization
+	if d.VMNestedVirt {
+		res.HardwareVirtualizationEnabled = utils.BoolPtr(true)
+	}
+
+	// Configure vCPU hard pinning
+	if d.VMCPUPinning {
+		res.EnableCPUPinning = utils.BoolPtr(true)
+	}
+
 	// Add Serial Port
 	if d.SerialPort {
 		SerialPort := &v3.VMSerialPort{
@@ -130,144 +220,141 @@ func (d *NutanixDriver) Create() error {
 		res.SerialPortList = append(res.SerialPortList, SerialPort)
 	}
 
-	// Assign to project
+	// Assign to project, the default project of the user when no project is set
+	logPhase("placement")
+	var project *v3.Project
 	if d.Project != "" {
-
-		projectFilter := fmt.Sprintf("name==%s", d.Project)
-		projects, err := conn.V3.ListAllProject(ctx, projectFilter)
+		project, err = GetProject(ctx, conn, d.Project)
 		if err != nil {
+			log.Errorf("Error getting project: [%v]", err)
 			return err
 		}
-
-		if len(projects.Entities) == 0 {
-			log.Infof("Project %s not found", d.Project)
-			return fmt.Errorf("project %s not found", d.Project)
-		} else if len(projects.Entities) > 1 {
-			log.Infof("Multiple projects found with name %s", d.Project)
-			return fmt.Errorf("multiple projects found with name %s", d.Project)
+	} else {
+		project, err = GetUserDefaultProject(ctx, conn)
+		if err != nil {
+			log.Warnf("Unable to resolve the default project of the user, the VM is created without project: %v", err)
 		}
+	}
 
-		log.Infof("Select project %s", projects.Entities[0].Status.Name)
+	projectAccess := &ProjectAccess{}
+	if project != nil {
+		log.Infof("Select project %s", project.Status.Name)
 
 		metadata.ProjectReference = &v3.Reference{
 			Kind: utils.StringPtr("project"),
-			UUID: projects.Entities[0].Metadata.UUID,
+			UUID: project.Metadata.UUID,
 		}
 
+		projectAccess, err = GetProjectAccess(ctx, configCreds, project)
+		if err != nil {
+			log.Warnf("Unable to validate resources against project %s: %v", project.Status.Name, err)
+			projectAccess = &ProjectAccess{Name: project.Status.Name}
+		}
 	}
 
-	// Search target cluster
-
-	log.Infof("Searching cluster %s", d.Cluster)
+	// Assign owner
+	if d.Owner != "" {
+		ownerReference, err := GetOwnerReference(ctx, conn, d.Owner, project)
+		if err != nil {
+			log.Errorf("Error getting owner: [%v]", err)
+			return err
+		}
 
-	c := &url.URL{Path: d.Cluster}
-	encodedCluster := c.String()
-	clusterFilter := fmt.Sprintf("name==%s", encodedCluster)
+		metadata.OwnerReference = ownerReference
+	}
 
-	clusters, err := conn.V3.ListAllCluster(ctx, clusterFilter)
+	// Search target clusters
+	candidates, err := GetClusterCandidates(ctx, conn, d.clusterNames(), d.ClusterCategory)
 	if err != nil {
 		log.Errorf("Error getting clusters: [%v]", err)
 		return err
 	}
 
-	// Validate filtered Clusters
-
-	foundClusters := make([]*v3.ClusterIntentResponse, 0)
-	for _, s := range clusters.Entities {
-		peSpec := s.Spec
-		if peSpec.Name == d.Cluster {
-			foundClusters = append(foundClusters, s)
+	allowedCandidates := make([]*ClusterCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		err = projectAccess.ValidateCluster(candidate.UUID, candidate.Name)
+		if err != nil {
+			if len(candidates) == 1 {
+				log.Errorf("Error validating cluster: [%v]", err)
+				return err
+			}
+			log.Warnf("Skipping cluster %s: %v", candidate.Name, err)
+			continue
 		}
+		allowedCandidates = append(allowedCandidates, candidate)
 	}
 
-	if len(foundClusters) == 0 {
-		return fmt.Errorf("failed to retrieve cluster %s", d.Cluster)
-	} else if len(foundClusters) > 1 {
-		return fmt.Errorf("more than one Cluster found with name %s", d.Cluster)
+	if len(allowedCandidates) == 0 {
+		return fmt.Errorf("none of the clusters is allowed in project %s", projectAccess.Name)
 	}
 
-	log.Infof("Cluster %s found with UUID: %s", foundClusters[0].Status.Name, *foundClusters[0].Metadata.UUID)
-	spec.ClusterReference = utils.BuildReference(*foundClusters[0].Metadata.UUID, "cluster")
-
-	// Search target subnet
+	if len(allowedCandidates) > 1 {
+		err = RankClusterCandidates(ctx, conn, configCreds, allowedCandidates, d.ClusterPlacement, name)
+		if err != nil {
+			log.Warnf("Unable to apply placement policy %s, using first-fit: %v", d.ClusterPlacement, err)
+		}
+	}
 
 	for index, subnet := range d.Subnet {
 		// Trim extraneous whitespace
 		d.Subnet[index] = strings.TrimSpace(subnet)
 	}
 
-	subnetFilter := ""
-
-	// Create subnets filter query and add UUID subnets directly
-	for _, subnet := range d.Subnet {
-
-		if isUUID(subnet) {
-			n := &v3.VMNic{
-				SubnetReference: utils.BuildReference(*utils.StringPtr(subnet), "subnet"),
-			}
-
-			res.NicList = append(res.NicList, n)
-			log.Infof("UUID subnet added %s", subnet)
-		} else {
-			if len(subnetFilter) != 0 {
-				subnetFilter += ","
-			}
-
-			t := &url.URL{Path: subnet}
-			encodedSubnet := t.String()
-			subnetFilter += fmt.Sprintf("name==%s", encodedSubnet)
+	// Serialize the GPU allocation with the other driver processes sharing the machine store
+	var gpuLock *fileLock
+	releaseGPULock := func() {
+		if gpuLock != nil {
+			gpuLock.unlock()
+			gpuLock = nil
 		}
-
 	}
+	defer releaseGPULock()
 
-	// Retrieve all subnets
-	responseSubnets, err := conn.V3.ListAllSubnet(ctx, subnetFilter, getEmptyClientSideFilter())
-	if err != nil {
-		log.Errorf("Error getting subnets: [%v]", err)
-		return err
+	// Serialize the changes of the placement policies of the groups of the VM
+	var placementLocks []*fileLock
+	releasePlacementLocks := func() {
+		for _, lock := range placementLocks {
+			lock.unlock()
+		}
+		placementLocks = nil
 	}
+	defer releasePlacementLocks()
 
-	// Search for non UUID Subnets
-	for _, query := range d.Subnet {
-		if isUUID(query) {
-			continue
+	if len(d.GPUs) > 0 {
+		lockTimeout := time.Duration(d.Timeout*(gpuAllocationRetries+1)) * time.Second
+		gpuLock, err = lockFile(d.gpuLockPath(), lockTimeout)
+		if err != nil {
+			log.Errorf("Error locking GPU allocation: [%v]", err)
+			return err
 		}
+	}
 
-		log.Infof("Searching subnet %s", query)
-
-		for _, subnet := range responseSubnets.Entities {
-
-			if *subnet.Spec.Name == query {
-				if *subnet.Spec.Resources.SubnetType == "OVERLAY" {
-					n := &v3.VMNic{
-						SubnetReference: utils.BuildReference(*subnet.Metadata.UUID, "subnet"),
-					}
-
-					res.NicList = append(res.NicList, n)
-					log.Infof("Overlay subnet %s found with UUID: %s", *subnet.Status.Name, *subnet.Metadata.UUID)
-					break
-				} else if *subnet.Spec.Resources.SubnetType == "VLAN" {
-
-					if *subnet.Spec.ClusterReference.UUID == *spec.ClusterReference.UUID {
-						n := &v3.VMNic{
-							SubnetReference: utils.BuildReference(*subnet.Metadata.UUID, "subnet"),
-						}
-
-						res.NicList = append(res.NicList, n)
-						log.Infof("VLAN subnet %s found with UUID: %s", *subnet.Status.Name, *subnet.Metadata.UUID)
-						break
-					}
-				}
+	// Resolve subnets, storage container, hosts and GPUs on the first suitable cluster
+	var cluster *ClusterCandidate
+	var clusterRes *clusterResources
+	for _, candidate := range allowedCandidates {
+		clusterRes, err = d.resolveClusterResources(ctx, conn, configCreds, backend, candidate, projectAccess, len(allowedCandidates) > 1)
+		if err != nil {
+			if len(allowedCandidates) == 1 {
+				return err
 			}
-
+			log.Warnf("Skipping cluster %s: %v", candidate.Name, err)
+			continue
 		}
+		cluster = candidate
+		break
 	}
 
-	if len(res.NicList) < 1 {
-		log.Errorf("Network %s not found in cluster %s", d.Subnet, d.Cluster)
-		return fmt.Errorf("network %s not found in cluster %s", d.Subnet, d.Cluster)
+	if cluster == nil {
+		return fmt.Errorf("no suitable cluster found among %s", d.clusterSelector())
 	}
 
+	log.Infof("Select cluster %s", cluster.Name)
+	d.ClusterUUID = cluster.UUID
+	spec.ClusterReference = utils.BuildReference(cluster.UUID, "cluster")
+	res.NicList = clusterRes.NicList
+	hosts := clusterRes.Hosts
+
 	if len(d.Categories) != 0 {
 		log.Infof("Categories provided: %s", d.Categories)
 		metadata.CategoriesMapping = make(map[string][]string)
@@ -290,41 +377,107 @@ func (d *NutanixDriver) Create() error {
 		}
 	}
 
+	// Add to anti-affinity group, the group is locked until the VM is created
+	if d.AntiAffinityGroup != "" {
+		conn4, err := configCreds.newV4Client()
+		if err != nil {
+			return err
+		}
+
+		lock, err := d.lockPlacementPolicy(antiAffinityLockKind, d.AntiAffinityGroup)
+		if err != nil {
+			log.Errorf("Error locking anti-affinity group: [%v]", err)
+			return err
+		}
+		placementLocks = append(placementLocks, lock)
+
+		key, value, err := EnsureAntiAffinityPolicy(conn4, d.AntiAffinityGroup, d.Timeout)
+		if err != nil {
+			log.Errorf("Error preparing anti-affinity group: [%v]", err)
+			return err
+		}
+
+		if metadata.CategoriesMapping == nil {
+			metadata.CategoriesMapping = make(map[string][]string)
+			metadata.UseCategoriesMapping = utils.BoolPtr(true)
+		}
+		metadata.CategoriesMapping[key] = append(metadata.CategoriesMapping[key], value)
+		log.Infof("Added to anti-affinity group %s", d.AntiAffinityGroup)
+	}
+
+	// Add to VM-host affinity policy, the policy is locked until the VM is created
+	if len(hosts) != 0 {
+		conn4, err := configCreds.newV4Client()
+		if err != nil {
+			return err
+		}
+
+		value, err := HostAffinityValue(d.HostCategory, hosts)
+		if err != nil {
+			return err
+		}
+
+		lock, err := d.lockPlacementPolicy(hostAffinityLockKind, value)
+		if err != nil {
+			log.Errorf("Error locking VM-host affinity policy: [%v]", err)
+			return err
+		}
+		placementLocks = append(placementLocks, lock)
+
+		err = EnsureHostAffinityPolicy(ctx, conn, conn4, configCreds, d.HostCategory, value, hosts, d.Timeout)
+		if err != nil {
+			log.Errorf("Error preparing VM-host affinity policy: [%v]", err)
+			return err
+		}
+
+		if metadata.CategoriesMapping == nil {
+			metadata.CategoriesMapping = make(map[string][]string)
+			metadata.UseCategoriesMapping = utils.BoolPtr(true)
+		}
+		metadata.CategoriesMapping[hostAffinityCategoryKey] = append(metadata.CategoriesMapping[hostAffinityCategoryKey], value)
+		d.HostAffinityValue = value
+		log.Infof("Added to VM-host affinity policy %s", hostAffinityPolicyName(value))
+	}
+
 	// Search image template
-	i := &url.URL{Path: d.Image}
-	encodedImage := i.String()
-	imageFilter := fmt.Sprintf("name==%s", encodedImage)
-	images, err := conn.V3.ListAllImage(ctx, imageFilter)
+	image, err := backend.GetImage(ctx, d.Image)
 	if err != nil {
 		log.Errorf("Error getting images: [%v]", err)
 		return err
 	}
 
-	for _, image := range images.Entities {
-		if *image.Status.Name == d.Image {
+	var imageSizeBytes int64
+	if image != nil {
+		log.Infof("Image %s found with UUID: %s", image.Name, image.UUID)
 
-			log.Infof("Image %s found with UUID: %s", *image.Status.Name, *image.Metadata.UUID)
+		if image.Type != "DISK_IMAGE" {
+			log.Errorf("Image %s is not a disk template", d.Image)
+			return fmt.Errorf("image %s is not a disk template", d.Image)
+		}
 
-			if *image.Status.Resources.ImageType != "DISK_IMAGE" {
-				log.Errorf("Image %s is not a disk template", d.Image)
-				return fmt.Errorf("image %s is not a disk template", d.Image)
-			}
+		err = projectAccess.ValidateImage(image.UUID, d.Image)
+		if err != nil {
+			log.Errorf("Error validating image: [%v]", err)
+			return err
+		}
 
-			if d.ImageSize > 0 {
-				newSize := int64(d.ImageSize * 1024)
-				n := &v3.VMDisk{
-					DataSourceReference: utils.BuildReference(*image.Metadata.UUID, "image"),
-					DiskSizeMib:         &newSize,
-				}
-				res.DiskList = append(res.DiskList, n)
-			} else {
-				n := &v3.VMDisk{
-					DataSourceReference: utils.BuildReference(*image.Metadata.UUID, "image"),
-				}
-				res.DiskList = append(res.DiskList, n)
-			}
+		imageSizeBytes = image.SizeBytes
 
-			break
+		if d.ImageSize > 0 {
+			newSize := int64(d.ImageSize * 1024)
+			imageSizeBytes = newSize * 1024 * 1024
+			n := &v3.VMDisk{
+				DataSourceReference: utils.BuildReference(image.UUID, "image"),
+				DeviceProperties:    d.bootDiskProperties(),
+				DiskSizeMib:         &newSize,
+			}
+			res.DiskList = append(res.DiskList, n)
+		} else {
+			n := &v3.VMDisk{
+				DataSourceReference: utils.BuildReference(image.UUID, "image"),
+				DeviceProperties:    d.bootDiskProperties(),
+			}
+			res.DiskList = append(res.DiskList, n)
 		}
 	}
 
@@ -334,35 +487,70 @@ func (d *NutanixDriver) Create() error {
 	}
 
 	// Add additional disks
-	if len(d.StorageContainer) != 0 && d.DiskSize > 0 {
+	if clusterRes.StorageContainer != "" {
 		n := &v3.VMDisk{
 			DiskSizeBytes: utils.Int64Ptr(int64(d.DiskSize) * 1024 * 1024 * 1024),
 			StorageConfig: &v3.VMStorageConfig{
 				StorageContainerReference: &v3.StorageContainerReference{
 					Kind: "storage_container",
-					UUID: d.StorageContainer,
+					UUID: clusterRes.StorageContainer,
 				},
 			},
 		}
 
 		res.DiskList = append(res.DiskList, n)
-		log.Infof("Added disk with %d GiB on storage container with UUID: %s", d.DiskSize, d.StorageContainer)
+		log.Infof("Added disk with %d GiB on storage container with UUID: %s", d.DiskSize, clusterRes.StorageContainer)
+	}
+
+	// Enable Nutanix Guest Tools and mount its ISO
+	if d.GuestTools {
+		log.Infof("Enable Nutanix Guest Tools with capabilities %s", d.GuestToolsCaps)
+		res.GuestTools = buildGuestTools(d.GuestToolsCaps)
+		res.DiskList = append(res.DiskList, buildNGTCdrom(d.BootType))
 	}
 
 	// Add GPU devices
-	if len(d.GPUs) > 0 {
+	res.GpuList = clusterRes.GpuList
+
+	// Check cluster capacity and project quota
+	if d.CapacityCheck != capacityCheckOff {
+		capacityRequest := CapacityRequest{
+			MemoryBytes:  int64(d.VMMem) * 1024 * 1024,
+			VCPUs:        int64(d.VMVCPUs) * int64(d.VMCores),
+			StorageBytes: imageSizeBytes,
+		}
+		if clusterRes.StorageContainer != "" {
+			capacityRequest.StorageBytes += int64(d.DiskSize) * 1024 * 1024 * 1024
+		}
 
-		gpuList, err := GetGPUList(ctx, conn, d.GPUs, *foundClusters[0].Metadata.UUID)
+		shortfalls, err := CheckClusterCapacity(ctx, configCreds, cluster, capacityRequest)
 		if err != nil {
-			log.Errorf("failed to get the GPU list to create the VM %s. %v", name, err)
-			return err
+			log.Warnf("Unable to check capacity of cluster %s: %v", cluster.Name, err)
 		}
+		shortfalls = append(shortfalls, CheckProjectQuota(project, capacityRequest)...)
 
-		res.GpuList = gpuList
+		if len(shortfalls) != 0 {
+			if d.CapacityCheck == capacityCheckFail {
+				log.Errorf("Not enough capacity to create VM %s: %s", name, strings.Join(shortfalls, "; "))
+				return fmt.Errorf("not enough capacity to create VM %s: %s", name, strings.Join(shortfalls, "; "))
+			}
+			for _, shortfall := range shortfalls {
+				log.Warnf("Not enough capacity: %s", shortfall)
+			}
+		}
 
+		// The vCPUs can be overcommitted, their shortfall never fails the creation
+		vcpuShortfalls, err := CheckClusterVCPUs(ctx, conn, configCreds, cluster, capacityRequest.VCPUs)
+		if err != nil {
+			log.Warnf("Unable to check vCPUs of cluster %s: %v", cluster.Name, err)
+		}
+		for _, shortfall := range vcpuShortfalls {
+			log.Warnf("Not enough CPU cores, the vCPUs will be overcommitted: %s", shortfall)
+		}
 	}
 
 	// SSH Key generation
+	logPhase("cloud-init")
 	err = ssh.GenerateSSHKey(d.GetSSHKeyPath())
 	if err != nil {
 		log.Errorf("Error generating ssh key")
@@ -375,7 +563,11 @@ func (d *NutanixDriver) Create() error {
 		return err
 	}
 
-	log.Infof("SSH pub key ready (%s)", pubKey)
+	if d.UnredactedLogs {
+		log.Infof("SSH pub key ready (%s)", pubKey)
+	} else {
+		log.Infof("SSH pub key ready (%s)", sshKeyFingerprint(string(pubKey)))
+	}
 
 	// CloudInit preparation
 
@@ -391,7 +583,7 @@ func (d *NutanixDriver) Create() error {
 		r1 := strings.Replace(d.CloudInit, "\\n", "\n", -1)
 		r2 := strings.Replace(r1, "\\r", "\r", -1)
 
-		log.Infof("processed cloudinit: %s", r2)
+		log.Infof("processed cloudinit: %s", redactCloudInit(r2))
 
 		err = yaml.Unmarshal([]byte(r2), &t)
 		if err != nil {
@@ -429,13 +621,22 @@ func (d *NutanixDriver) Create() error {
 			if err != nil {
 				log.Fatal(err)
 			}
-			log.Infof("Cloud-init userdata: %s", string(userdata))
+			log.Infof("Cloud-init userdata: %s", redactCloudInit(string(userdata)))
 		}
 	} else {
 		log.Infof("No Cloud-init provided: Use Rancher default")
 		userdata = []byte("#cloud-config\r\nusers:\r\n - name: root\r\n   ssh_authorized_keys:\r\n    - " + string(pubKey))
 	}
 
+	// Install Nutanix Guest Tools on first boot
+	if d.GuestTools {
+		userdata, err = addNGTInstallCommands(userdata)
+		if err != nil {
+			log.Errorf("Error adding Nutanix Guest Tools installation to cloud-init: [%v]", err)
+			return err
+		}
+	}
+
 	// Generate metadata for the VM
 	specUUID := uuid.New()
 	cloudMetadata := fmt.Sprintf("{\"hostname\": \"%s\", \"uuid\": \"%s\"}", name, specUUID)
@@ -462,72 +663,50 @@ func (d *NutanixDriver) Create() error {
 	request.Metadata = metadata
 	request.Spec = spec
 
-	log.Infof("Launch VM creation")
-	resp, err := conn.V3.CreateVM(ctx, request)
-	if err != nil {
-		log.Errorf("Error creating vm: [%v]", err)
-		return err
-	}
-
-	uuid := *resp.Metadata.UUID
-	taskUUID := resp.Status.ExecutionContext.TaskUUID.(string)
-
-	log.Infof("waiting for vm %s (%s) to create: task %s", name, uuid, taskUUID)
-
-	// Wait end of the task
-waitTask:
-	for i := 0; i < d.Timeout/5; i++ {
-		resp, err := conn.V3.GetTask(ctx, taskUUID)
-		if err != nil {
-			log.Errorf("Error getting task: [%v]", err)
+	logPhase("create-vm")
+	var uuid string
+	for attempt := 0; ; attempt++ {
+		uuid, err = backend.CreateVM(ctx, request)
+		if err == nil {
+			break
+		}
+		if len(res.GpuList) == 0 || attempt >= gpuAllocationRetries || !isGPUAllocationError(err) {
 			return err
 		}
 
-		switch *resp.Status {
-		case "SUCCEEDED":
-			log.Infof("VM %s creation task succeeded", name)
-			break waitTask
-		case "FAILED":
-			errMsg := strings.ReplaceAll(*resp.ErrorDetail, "\n", " ")
-			log.Errorf("Error creating vm: [%v]", errMsg)
-			log.Infof("Deleting VM %s (%s)", name, uuid)
-			_, err := conn.V3.DeleteVM(ctx, uuid)
-			if err != nil {
-				log.Errorf("Failed to delete VM %s (%s): %v", name, uuid, err)
-			}
-
-			return errors.New(errMsg)
-		}
-		if i == (d.Timeout/5)-1 {
-			log.Errorf("Timeout waiting for vm %s to create", name)
-			return errors.New("timeout waiting for vm to create")
+		// The GPU devices were taken in the meantime, select the next free ones
+		log.Warnf("GPU devices not available anymore, selecting other devices (retry %d/%d)", attempt+1, gpuAllocationRetries)
+		res.GpuList, err = GetGPUList(ctx, conn, clusterRes.GPURequests, cluster.UUID, clusterRes.AffinityHosts)
+		if err != nil {
+			log.Errorf("failed to get the GPU list to create the VM %s. %v", name, err)
+			return err
 		}
-		log.Infof("VM %s creation is in %s state", name, *resp.Status)
-		<-time.After(5 * time.Second)
-
 	}
+	releaseGPULock()
+	releasePlacementLocks()
 
 	d.VMId = uuid
 
 	log.Infof("VM %s successfully created", name)
 
 	// Wait for the VM obtain an IP address
+	logPhase("wait-ip")
 	for i := 0; i < d.Timeout/5; i++ {
-		vmInfo, err := conn.V3.GetVM(ctx, uuid)
+		vmInfo, err := backend.GetVM(ctx, uuid)
 		if err != nil {
 			log.Errorf("Error getting vm: [%v]", err)
 			return err
 		}
 
-		if len(vmInfo.Status.Resources.NicList[0].IPEndpointList) != 0 {
-			d.IPAddress = *vmInfo.Status.Resources.NicList[0].IPEndpointList[0].IP
+		if vmInfo.IPAddress != "" {
+			d.IPAddress = vmInfo.IPAddress
 			break
 		}
 
 		if i == (d.Timeout/5)-1 {
 			log.Errorf("Timeout waiting for vm %s to obtain an IP address", name)
 			log.Infof("Deleting VM %s (%s)", name, uuid)
-			_, err := conn.V3.DeleteVM(ctx, uuid)
+			err := backend.DeleteVM(ctx, uuid)
 			if err != nil {
 				log.Errorf("Failed to delete VM %s (%s): %v", name, uuid, err)
 			}
@@ -563,6 +742,21 @@ func (d *NutanixDriver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "nutanix-password",
 			Usage:  "Nutanix management password",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_CREDENTIALS_SOURCE",
+			Name:   "nutanix-credentials-source",
+			Usage:  "Source of the Nutanix management credentials, resolved on each operation: file:<path>, helper:<executable> or netrc:[<path>]",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_API_KEY",
+			Name:   "nutanix-api-key",
+			Usage:  "API key of the Nutanix service account",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_API_KEY_FILE",
+			Name:   "nutanix-api-key-file",
+			Usage:  "File holding the API key of the Nutanix service account, read on each operation",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "NUTANIX_ENDPOINT",
 			Name:   "nutanix-endpoint",
@@ -574,15 +768,120 @@ func (d *NutanixDriver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "Nutanix management endpoint port (default: 9440)",
 			Value:  "9440",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_PROXY_URL",
+			Name:   "nutanix-proxy-url",
+			Usage:  "Proxy for the Prism Central API traffic (default: HTTPS_PROXY environment variable)",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_PROXY_USERNAME",
+			Name:   "nutanix-proxy-username",
+			Usage:  "Username of the proxy authentication",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_PROXY_PASSWORD",
+			Name:   "nutanix-proxy-password",
+			Usage:  "Password of the proxy authentication",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_NO_PROXY",
+			Name:   "nutanix-no-proxy",
+			Usage:  "Comma separated list of hosts, domains and CIDRs reached without proxy (default: NO_PROXY environment variable)",
+		},
 		mcnflag.BoolFlag{
 			EnvVar: "NUTANIX_INSECURE",
 			Name:   "nutanix-insecure",
 			Usage:  "Explicitly allow the provider to perform \"insecure\" SSL requests",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_CA_BUNDLE",
+			Name:   "nutanix-ca-bundle",
+			Usage:  "CA certificates trusted for the Prism Central certificate, as a PEM file path or inline PEM",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_TLS_FINGERPRINT",
+			Name:   "nutanix-tls-fingerprint",
+			Usage:  "SHA-256 fingerprint pinned for the Prism Central certificate",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "NUTANIX_TLS_TRUST_ON_FIRST_USE",
+			Name:   "nutanix-tls-trust-on-first-use",
+			Usage:  "Pin the fingerprint of the Prism Central certificate served at the creation",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_CLIENT_CERT",
+			Name:   "nutanix-client-cert",
+			Usage:  "Client certificate for the mutual TLS authentication to Prism Central, as a PEM file path or inline PEM",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_CLIENT_KEY",
+			Name:   "nutanix-client-key",
+			Usage:  "Private key of the client certificate, as a PEM file path or inline PEM",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "NUTANIX_LOG_REDACT_PATTERNS",
+			Name:   "nutanix-log-redact-patterns",
+			Usage:  "Regular expressions masked in the driver logs, in addition to the credentials and the known secrets (only the groups are masked when the expression has groups)",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "NUTANIX_LOG_UNREDACTED",
+			Name:   "nutanix-log-unredacted",
+			Usage:  "Debug only: disable the redaction of the secrets in the driver logs",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "NUTANIX_TRACE",
+			Name:   "nutanix-trace",
+			Usage:  "Dump the Prism Central requests and responses, redacted, to the prism-trace.log file of the machine store",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_API_VERSION",
+			Name:   "nutanix-api-version",
+			Usage:  "The Prism Central API version used to manage the VM (auto, v3 or v4)",
+			Value:  apiVersionAuto,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "NUTANIX_API_RETRIES",
+			Name:   "nutanix-api-retries",
+			Usage:  "Number of retries of the Prism Central API reads failing with a transient error (0 to disable)",
+			Value:  defaultAPIRetries,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "NUTANIX_API_RETRY_MAX_WAIT",
+			Name:   "nutanix-api-retry-max-wait",
+			Usage:  "Maximum wait between two retries of a Prism Central API call (in seconds)",
+			Value:  defaultAPIRetryMaxWait,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "NUTANIX_API_RATE_LIMIT",
+			Name:   "nutanix-api-rate-limit",
+			Usage:  "Maximum Prism Central API requests per second of all the driver processes sharing the machine store (0 for no limit)",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "NUTANIX_MAX_CONCURRENT_CREATIONS",
+			Name:   "nutanix-max-concurrent-creations",
+			Usage:  "Maximum concurrent VM creations on the Prism Central of all the driver processes sharing the machine store (0 for no limit)",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "NUTANIX_CLUSTER",
 			Name:   "nutanix-cluster",
-			Usage:  "Nutanix Cluster to install VM on",
+			Usage:  "Nutanix Cluster to install VM on (comma separated list of candidate clusters accepted)",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_CLUSTER_CATEGORY",
+			Name:   "nutanix-cluster-category",
+			Usage:  "The category (key=value) of the candidate clusters to install VM on",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_CLUSTER_PLACEMENT",
+			Name:   "nutanix-cluster-placement",
+			Usage:  "The placement policy used to select the cluster among the candidates (first-fit, most-free-memory, fewest-vms or round-robin)",
+			Value:  placementFirstFit,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_CAPACITY_CHECK",
+			Name:   "nutanix-capacity-check",
+			Usage:  "Behavior when the cluster or the project lacks capacity for the VM (off, warn or fail)",
+			Value:  capacityCheckWarn,
 		},
 		mcnflag.IntFlag{
 			EnvVar: "NUTANIX_VM_MEM",
@@ -607,6 +906,26 @@ func (d *NutanixDriver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "nutanix-vm-cpu-passthrough",
 			Usage:  "Enable passthrough the host's CPU features to the newly created VM",
 		},
+		mcnflag.IntFlag{
+			EnvVar: "NUTANIX_VM_TOTAL_VCPUS",
+			Name:   "nutanix-vm-total-vcpus",
+			Usage:  "Total number of vCPUs of the VM to be created, split in sockets and cores automatically",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "NUTANIX_VM_VNUMA_NODES",
+			Name:   "nutanix-vm-vnuma-nodes",
+			Usage:  "Number of vNUMA nodes of the VM to be created",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "NUTANIX_VM_NESTED_VIRTUALIZATION",
+			Name:   "nutanix-vm-nested-virtualization",
+			Usage:  "Enable hardware virtualization (nested virtualization) in the newly created VM",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "NUTANIX_VM_CPU_PINNING",
+			Name:   "nutanix-vm-cpu-pinning",
+			Usage:  "Enable vCPU hard pinning of the newly created VM",
+		},
 		mcnflag.StringSliceFlag{
 			Name:  "nutanix-vm-network",
 			Usage: "The name of the network to attach to the newly created VM",
@@ -629,7 +948,7 @@ func (d *NutanixDriver) GetCreateFlags() []mcnflag.Flag {
 		mcnflag.StringFlag{
 			EnvVar: "NUTANIX_STORAGE_CONTAINER",
 			Name:   "nutanix-storage-container",
-			Usage:  "The UUID of the storage container",
+			Usage:  "The UUID or name of the storage container",
 			Value:  "",
 		},
 		mcnflag.IntFlag{
@@ -657,9 +976,29 @@ func (d *NutanixDriver) GetCreateFlags() []mcnflag.Flag {
 		mcnflag.StringFlag{
 			EnvVar: "NUTANIX_BOOT_TYPE",
 			Name:   "nutanix-boot-type",
-			Usage:  "The boot type of the VM (legacy or uefi)",
+			Usage:  "The boot type of the VM (legacy, uefi or secure_boot)",
 			Value:  defaultBootType,
 		},
+		mcnflag.BoolFlag{
+			EnvVar: "NUTANIX_VM_VTPM",
+			Name:   "nutanix-vm-vtpm",
+			Usage:  "Add a vTPM to the newly created VM (uefi or secure_boot boot type only)",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_VM_BOOT_DISK_BUS",
+			Name:   "nutanix-vm-boot-disk-bus",
+			Usage:  "The bus of the boot disk of the VM (scsi, pci, ide or sata)",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "NUTANIX_VM_GUEST_TOOLS",
+			Name:   "nutanix-vm-guest-tools",
+			Usage:  "Mount the Nutanix Guest Tools ISO on the newly created VM and install NGT on first boot",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "nutanix-vm-guest-tools-capabilities",
+			Usage: "The Nutanix Guest Tools capabilities to enable (vss_snapshot, self_service_restore)",
+		},
 		mcnflag.IntFlag{
 			EnvVar: "NUTANIX_TIMEOUT",
 			Name:   "nutanix-timeout",
@@ -668,12 +1007,31 @@ func (d *NutanixDriver) GetCreateFlags() []mcnflag.Flag {
 		},
 		mcnflag.StringSliceFlag{
 			Name:  "nutanix-vm-gpu",
-			Usage: "The list of GPU devices to attach to the newly created VM",
+			Usage: "The list of GPU devices to attach to the newly created VM (GPU name or name, vendor, mode and count key=value pairs)",
 		},
 		mcnflag.StringFlag{
 			Name:  "nutanix-vm-description",
 			Usage: "The description of the newly created VM",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_VM_OWNER",
+			Name:   "nutanix-vm-owner",
+			Usage:  "The name of the Prism Central user who will own the newly created VM",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_VM_ANTI_AFFINITY_GROUP",
+			Name:   "nutanix-vm-anti-affinity-group",
+			Usage:  "The name of the VM-VM anti-affinity group of the newly created VM",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "NUTANIX_VM_HOST_CATEGORY",
+			Name:   "nutanix-vm-host-category",
+			Usage:  "The category (key=value) of the hosts the newly created VM must run on",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "nutanix-vm-hosts",
+			Usage: "The names or UUIDs of the hosts the newly created VM must run on",
+		},
 	}
 }
 
@@ -693,32 +1051,27 @@ func (d *NutanixDriver) GetURL() (string, error) {
 
 // GetState returns the state that the host is in (running, stopped, etc)
 func (d *NutanixDriver) GetState() (state.State, error) {
+	defer d.beginOperation("state")()
 
-	configCreds := client.Credentials{
-		URL:         fmt.Sprintf("%s:%s", d.Endpoint, d.Port),
-		Endpoint:    d.Endpoint,
-		Username:    d.Username,
-		Password:    d.Password,
-		Port:        d.Port,
-		Insecure:    d.Insecure,
-		SessionAuth: d.SessionAuth,
-		ProxyURL:    d.ProxyURL,
+	configCreds, err := d.operationCredentials()
+	if err != nil {
+		return state.Error, err
 	}
 
 	ctx := context.Background()
 
 	log.Infof("Connecting on: %s", configCreds.URL)
 
-	conn, err := v3.NewV3Client(configCreds)
+	backend, err := d.newBackend(configCreds)
 	if err != nil {
 		return state.Error, err
 	}
 
-	resp, err := conn.V3.GetVM(ctx, d.VMId)
+	vmInfo, err := backend.GetVM(ctx, d.VMId)
 	if err != nil {
-		return state.Error, err
+		return state.Error, apiKeyError(ctx, configCreds, err)
 	}
-	switch *resp.Status.Resources.PowerState {
+	switch vmInfo.PowerState {
 	case "ON":
 		return state.Running, nil
 	case "OFF":
@@ -735,16 +1088,11 @@ func (d *NutanixDriver) Kill() error {
 // Remove a host
 func (d *NutanixDriver) Remove() error {
 	name := d.GetMachineName()
+	defer d.beginOperation("remove")()
 
-	configCreds := client.Credentials{
-		URL:         fmt.Sprintf("%s:%s", d.Endpoint, d.Port),
-		Endpoint:    d.Endpoint,
-		Username:    d.Username,
-		Password:    d.Password,
-		Port:        d.Port,
-		Insecure:    d.Insecure,
-		SessionAuth: d.SessionAuth,
-		ProxyURL:    d.ProxyURL,
+	configCreds, err := d.operationCredentials()
+	if err != nil {
+		return err
 	}
 
 	if d.VMId == "" {
@@ -756,53 +1104,96 @@ func (d *NutanixDriver) Remove() error {
 
 	log.Infof("Connecting on: %s", configCreds.URL)
 
-	conn, err := v3.NewV3Client(configCreds)
+	backend, err := d.newBackend(configCreds)
 	if err != nil {
 		return fmt.Errorf("error connecting to Nutanix: %v", err)
 	}
 
 	log.Infof("Deleting VM %s (%s)", name, d.VMId)
-	resp, err := conn.V3.DeleteVM(ctx, d.VMId)
+	err = backend.DeleteVM(ctx, d.VMId)
 	if err != nil {
-		return fmt.Errorf("error launching deleting VM %s: %v", name, err)
+		err = apiKeyError(ctx, configCreds, err)
+		log.Errorf("Error deleting vm %s: %v", name, err)
+		return err
 	}
 
-	taskUUID := resp.Status.ExecutionContext.TaskUUID.(string)
+	d.removeFromAntiAffinityGroup(configCreds)
+	d.removeFromHostAffinityPolicy(ctx, configCreds)
 
-	log.Infof("waiting to delete vm %s (%s): task %s", name, d.VMId, taskUUID)
+	return nil
+}
 
-	// Wait end of the task
-waitTask:
-	for i := 0; i < d.Timeout/5; i++ {
-		resp, err := conn.V3.GetTask(ctx, taskUUID)
-		if err != nil {
-			log.Errorf("Error getting task: [%v]", err)
-			return err
-		}
+// removeFromAntiAffinityGroup takes the deleted VM out of its anti-affinity group.
+// Errors are only logged as they must not prevent the removal of the host.
+func (d *NutanixDriver) removeFromAntiAffinityGroup(configCreds connConfig) {
+	if d.AntiAffinityGroup == "" {
+		return
+	}
 
-		switch *resp.Status {
-		case "SUCCEEDED":
-			log.Infof("VM %s deletion task succeeded", name)
-			break waitTask
-		case "FAILED":
-			errMsg := strings.ReplaceAll(*resp.ErrorDetail, "\n", " ")
-			if strings.Contains(errMsg, "ENTITY_NOT_FOUND") {
-				log.Infof("VM %s already deleted", name)
-				return nil
-			}
-			log.Errorf("Error deleting vm: %v", errMsg)
-			return errors.New(errMsg)
-		}
-		if i == (d.Timeout/5)-1 {
-			log.Errorf("Timeout waiting to delete vm %s", name)
-			return errors.New("timeout waiting to delete vm")
-		}
-		log.Infof("VM %s deletion is in %s state", name, *resp.Status)
-		<-time.After(5 * time.Second)
+	conn4, err := configCreds.newV4Client()
+	if err != nil {
+		log.Warnf("Failed to connect to Nutanix v4 API: %v", err)
+		return
+	}
 
+	lock, err := d.lockPlacementPolicy(antiAffinityLockKind, d.AntiAffinityGroup)
+	if err != nil {
+		log.Warnf("Failed to lock anti-affinity group %s: %v", d.AntiAffinityGroup, err)
+		return
 	}
+	defer lock.unlock()
 
-	return nil
+	err = RemoveFromAntiAffinityPolicy(conn4, d.AntiAffinityGroup, d.VMId, d.Timeout)
+	if err != nil {
+		log.Warnf("Failed to remove VM %s from anti-affinity group %s: %v", d.VMId, d.AntiAffinityGroup, err)
+	}
+}
+
+// removeFromHostAffinityPolicy takes the deleted VM out of its VM-host affinity policy.
+// Errors are only logged as they must not prevent the removal of the host.
+func (d *NutanixDriver) removeFromHostAffinityPolicy(ctx context.Context, configCreds connConfig) {
+	if d.HostAffinityValue == "" {
+		return
+	}
+
+	conn, err := configCreds.newV3Client()
+	if err != nil {
+		log.Warnf("Failed to connect to Nutanix v3 API: %v", err)
+		return
+	}
+
+	conn4, err := configCreds.newV4Client()
+	if err != nil {
+		log.Warnf("Failed to connect to Nutanix v4 API: %v", err)
+		return
+	}
+
+	lock, err := d.lockPlacementPolicy(hostAffinityLockKind, d.HostAffinityValue)
+	if err != nil {
+		log.Warnf("Failed to lock VM-host affinity policy %s: %v", hostAffinityPolicyName(d.HostAffinityValue), err)
+		return
+	}
+	defer lock.unlock()
+
+	err = RemoveFromHostAffinityPolicy(ctx, conn, conn4, configCreds, d.HostAffinityValue, d.ClusterUUID, d.VMId, d.Timeout)
+	if err != nil {
+		log.Warnf("Failed to remove VM %s from VM-host affinity policy %s: %v", d.VMId, hostAffinityPolicyName(d.HostAffinityValue), err)
+	}
+}
+
+// bootDiskProperties returns the device properties of the boot disk or nil to keep the AHV default bus
+func (d *NutanixDriver) bootDiskProperties() *v3.VMDiskDeviceProperties {
+	if d.BootDiskBus == "" {
+		return nil
+	}
+
+	return &v3.VMDiskDeviceProperties{
+		DeviceType: utils.StringPtr("DISK"),
+		DiskAddress: &v3.DiskAddress{
+			AdapterType: utils.StringPtr(strings.ToUpper(d.BootDiskBus)),
+			DeviceIndex: utils.Int64Ptr(0),
+		},
+	}
 }
 
 // Restart a host. This may just call Stop(); Start() if the provider does not
@@ -818,28 +1209,173 @@ func (d *NutanixDriver) Restart() error {
 // SetConfigFromFlags configures the driver with the object that was returned
 // by RegisterCreateFlags
 func (d *NutanixDriver) SetConfigFromFlags(opts drivers.DriverOptions) error {
-	d.Username = opts.String("nutanix-username")
-	if d.Username == "" {
-		return fmt.Errorf("nutanix-username cannot be empty")
-	}
-	d.Password = opts.String("nutanix-password")
-	if d.Password == "" {
-		return fmt.Errorf("nutanix-password cannot be empty")
-	}
 	d.Endpoint = opts.String("nutanix-endpoint")
 	if d.Endpoint == "" {
 		return fmt.Errorf("nutanix-endpoint cannot be empty")
 	}
+
+	d.Username = opts.String("nutanix-username")
+	d.Password = opts.String("nutanix-password")
+	d.CredentialsSource = strings.TrimSpace(opts.String("nutanix-credentials-source"))
+	d.APIKey = strings.TrimSpace(opts.String("nutanix-api-key"))
+	d.APIKeyFile = strings.TrimSpace(opts.String("nutanix-api-key-file"))
+	if d.APIKey != "" || d.APIKeyFile != "" {
+		if d.APIKey != "" && d.APIKeyFile != "" {
+			return fmt.Errorf("nutanix-api-key and nutanix-api-key-file are mutually exclusive")
+		}
+		if d.Username != "" || d.Password != "" || d.CredentialsSource != "" {
+			return fmt.Errorf("nutanix-api-key and nutanix-username/nutanix-password/nutanix-credentials-source are mutually exclusive")
+		}
+		if d.APIKeyFile != "" {
+			_, err := readAPIKeyFile(d.APIKeyFile)
+			if err != nil {
+				return err
+			}
+		}
+	} else if d.CredentialsSource != "" {
+		if d.Username != "" || d.Password != "" {
+			return fmt.Errorf("nutanix-credentials-source and nutanix-username/nutanix-password are mutually exclusive")
+		}
+		// Resolve the credentials once to fail early, only the source reference is kept with the machine
+		source, err := parseCredentialsSource(d.CredentialsSource)
+		if err != nil {
+			return err
+		}
+		_, _, err = source.Resolve(d.Endpoint)
+		if err != nil {
+			return err
+		}
+	} else {
+		if d.Username == "" {
+			return fmt.Errorf("nutanix-username cannot be empty")
+		}
+		if d.Password == "" {
+			return fmt.Errorf("nutanix-password cannot be empty")
+		}
+	}
 	d.Port = opts.String("nutanix-port")
 
+	proxyURL, err := resolveProxy(d.Endpoint, d.Port,
+		strings.TrimSpace(opts.String("nutanix-proxy-url")),
+		strings.TrimSpace(opts.String("nutanix-no-proxy")),
+		opts.String("nutanix-proxy-username"),
+		opts.String("nutanix-proxy-password"))
+	if err != nil {
+		return err
+	}
+	d.ProxyURL = proxyURL
+	if d.ProxyURL != "" {
+		u, _ := url.Parse(d.ProxyURL)
+		log.Infof("Prism Central is reached through the proxy %s", u.Redacted())
+	}
+
 	d.Insecure = opts.Bool("nutanix-insecure")
 
+	d.CABundle = strings.TrimSpace(opts.String("nutanix-ca-bundle"))
+	d.TLSFingerprint = opts.String("nutanix-tls-fingerprint")
+	d.TrustOnFirstUse = opts.Bool("nutanix-tls-trust-on-first-use")
+	if d.Insecure && (d.CABundle != "" || d.TLSFingerprint != "" || d.TrustOnFirstUse) {
+		return fmt.Errorf("nutanix-insecure and nutanix-ca-bundle/nutanix-tls-fingerprint/nutanix-tls-trust-on-first-use are mutually exclusive")
+	}
+	if d.TLSFingerprint != "" && d.TrustOnFirstUse {
+		return fmt.Errorf("nutanix-tls-fingerprint and nutanix-tls-trust-on-first-use are mutually exclusive")
+	}
+	if d.TLSFingerprint != "" {
+		fingerprint, err := normalizeFingerprint(d.TLSFingerprint)
+		if err != nil {
+			return err
+		}
+		d.TLSFingerprint = fingerprint
+	}
+	if d.CABundle != "" {
+		_, err := loadCABundle(d.CABundle)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.ClientCert = strings.TrimSpace(opts.String("nutanix-client-cert"))
+	d.ClientKey = strings.TrimSpace(opts.String("nutanix-client-key"))
+	if (d.ClientCert == "") != (d.ClientKey == "") {
+		return fmt.Errorf("nutanix-client-cert and nutanix-client-key must be set together")
+	}
+	if d.ClientCert != "" {
+		_, err := loadClientCertificate(d.ClientCert, d.ClientKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.LogRedactPatterns = opts.StringSlice("nutanix-log-redact-patterns")
+	d.UnredactedLogs = opts.Bool("nutanix-log-unredacted")
+	err = d.setupLogRedaction(connConfig{})
+	if err != nil {
+		return err
+	}
+	if d.UnredactedLogs {
+		log.Warnf("nutanix-log-unredacted is set, the driver logs expose the secrets")
+	}
+	d.Trace = opts.Bool("nutanix-trace")
+	if d.Trace {
+		log.Infof("The Prism Central requests are traced to %s", d.ResolveStorePath(traceFile))
+	}
+
+	d.APIVersion = opts.String("nutanix-api-version")
+	if d.APIVersion == "" {
+		d.APIVersion = apiVersionAuto
+	}
+	if !slices.Contains(apiVersions, d.APIVersion) {
+		return fmt.Errorf("nutanix-api-version %s is not supported (%s)", d.APIVersion, strings.Join(apiVersions, ", "))
+	}
+
+	d.APIRetries = opts.Int("nutanix-api-retries")
+	d.APIRetryMaxWait = opts.Int("nutanix-api-retry-max-wait")
+	err = validateRetryPolicy(d.APIRetries, d.APIRetryMaxWait)
+	if err != nil {
+		return err
+	}
+	if d.APIRetries == 0 {
+		d.APIRetries = apiRetriesDisabled
+	}
+
+	d.APIRateLimit = opts.Int("nutanix-api-rate-limit")
+	if d.APIRateLimit < 0 {
+		return fmt.Errorf("nutanix-api-rate-limit must be positive")
+	}
+	d.MaxCreations = opts.Int("nutanix-max-concurrent-creations")
+	if d.MaxCreations < 0 {
+		return fmt.Errorf("nutanix-max-concurrent-creations must be positive")
+	}
+
 	d.Categories = opts.StringSlice("nutanix-vm-categories")
 
 	d.Cluster = opts.String("nutanix-cluster")
-	if d.Cluster == "" {
+	d.ClusterCategory = strings.TrimSpace(opts.String("nutanix-cluster-category"))
+	if d.Cluster == "" && d.ClusterCategory == "" {
 		return fmt.Errorf("nutanix-cluster cannot be empty")
 	}
+	if d.Cluster != "" && d.ClusterCategory != "" {
+		return fmt.Errorf("nutanix-cluster and nutanix-cluster-category are mutually exclusive")
+	}
+	if d.ClusterCategory != "" && !strings.Contains(d.ClusterCategory, "=") {
+		return fmt.Errorf("nutanix-cluster-category %s must be in the key=value format", d.ClusterCategory)
+	}
+
+	d.ClusterPlacement = opts.String("nutanix-cluster-placement")
+	if d.ClusterPlacement == "" {
+		d.ClusterPlacement = placementFirstFit
+	}
+	if !slices.Contains(placementPolicies, d.ClusterPlacement) {
+		return fmt.Errorf("nutanix-cluster-placement %s is not supported (%s)", d.ClusterPlacement, strings.Join(placementPolicies, ", "))
+	}
+
+	d.CapacityCheck = opts.String("nutanix-capacity-check")
+	if d.CapacityCheck == "" {
+		d.CapacityCheck = capacityCheckWarn
+	}
+	if !slices.Contains(capacityCheckModes, d.CapacityCheck) {
+		return fmt.Errorf("nutanix-capacity-check %s is not supported (%s)", d.CapacityCheck, strings.Join(capacityCheckModes, ", "))
+	}
 
 	d.DiskSize = opts.Int("nutanix-disk-size")
 	d.StorageContainer = opts.String("nutanix-storage-container")
@@ -850,6 +1386,32 @@ func (d *NutanixDriver) SetConfigFromFlags(opts drivers.DriverOptions) error {
 
 	d.VMCPUPassthrough = opts.Bool("nutanix-vm-cpu-passthrough")
 
+	d.VMVnumaNodes = opts.Int("nutanix-vm-vnuma-nodes")
+	if d.VMVnumaNodes < 0 {
+		return fmt.Errorf("nutanix-vm-vnuma-nodes %d is invalid", d.VMVnumaNodes)
+	}
+
+	d.VMTotalVCPUs = opts.Int("nutanix-vm-total-vcpus")
+	if d.VMTotalVCPUs < 0 {
+		return fmt.Errorf("nutanix-vm-total-vcpus %d is invalid", d.VMTotalVCPUs)
+	}
+	if d.VMTotalVCPUs > 0 {
+		// The options do not tell the flags set explicitly: a number of vCPUs other than the default is one
+		if d.VMVCPUs != defaultVCPUs {
+			return fmt.Errorf("nutanix-vm-total-vcpus and nutanix-vm-cpus are mutually exclusive")
+		}
+		sockets, cores, err := splitVCPUs(d.VMTotalVCPUs, d.VMCores, d.VMVnumaNodes)
+		if err != nil {
+			return err
+		}
+		log.Infof("Split %d vCPUs in %d socket(s) of %d core(s)", d.VMTotalVCPUs, sockets, cores)
+		d.VMVCPUs = sockets
+		d.VMCores = cores
+	}
+
+	d.VMNestedVirt = opts.Bool("nutanix-vm-nested-virtualization")
+	d.VMCPUPinning = opts.Bool("nutanix-vm-cpu-pinning")
+
 	d.Subnet = opts.StringSlice("nutanix-vm-network")
 	if len(d.Subnet) == 0 {
 		return fmt.Errorf("nutanix-vm-network cannot be empty")
@@ -864,10 +1426,23 @@ func (d *NutanixDriver) SetConfigFromFlags(opts drivers.DriverOptions) error {
 	d.Project = opts.String("nutanix-project")
 
 	d.BootType = opts.String("nutanix-boot-type")
-	if d.BootType != "uefi" && d.BootType != "legacy" {
+	if !slices.Contains(bootTypes, d.BootType) {
 		return fmt.Errorf("nutanix-boot-type %s is invalid", d.BootType)
 	}
 
+	d.VTPM = opts.Bool("nutanix-vm-vtpm")
+	if d.VTPM && d.BootType == "legacy" {
+		return fmt.Errorf("nutanix-vm-vtpm requires the uefi or secure_boot boot type")
+	}
+
+	d.BootDiskBus = strings.ToLower(strings.TrimSpace(opts.String("nutanix-vm-boot-disk-bus")))
+	if d.BootDiskBus != "" && !slices.Contains(bootDiskBuses, d.BootDiskBus) {
+		return fmt.Errorf("nutanix-vm-boot-disk-bus %s is invalid", d.BootDiskBus)
+	}
+	if d.BootType == "secure_boot" && (d.BootDiskBus == "ide" || d.BootDiskBus == "sata") {
+		return fmt.Errorf("nutanix-boot-type secure_boot does not support a %s boot disk", d.BootDiskBus)
+	}
+
 	if d.Timeout < 300 {
 		log.Warnf("nutanix-timeout is too low, setting to 300 seconds")
 		d.Timeout = 300
@@ -875,7 +1450,23 @@ func (d *NutanixDriver) SetConfigFromFlags(opts drivers.DriverOptions) error {
 		d.Timeout = opts.Int("nutanix-timeout")
 	}
 
+	d.GuestTools = opts.Bool("nutanix-vm-guest-tools")
+	d.GuestToolsCaps = make([]string, 0)
+	for _, capability := range opts.StringSlice("nutanix-vm-guest-tools-capabilities") {
+		capability = strings.ToUpper(strings.TrimSpace(capability))
+		if !slices.Contains(ngtCapabilities, capability) {
+			return fmt.Errorf("nutanix-vm-guest-tools-capabilities %s is not supported", capability)
+		}
+		d.GuestToolsCaps = append(d.GuestToolsCaps, capability)
+	}
+	if len(d.GuestToolsCaps) != 0 && !d.GuestTools {
+		return fmt.Errorf("nutanix-vm-guest-tools-capabilities requires nutanix-vm-guest-tools")
+	}
+
 	d.GPUs = opts.StringSlice("nutanix-vm-gpu")
+	if _, err := ParseGPURequests(d.GPUs); err != nil {
+		return fmt.Errorf("nutanix-vm-gpu is invalid: %v", err)
+	}
 
 	d.Description = opts.String("nutanix-vm-description")
 	if d.Description == "" {
@@ -884,115 +1475,81 @@ func (d *NutanixDriver) SetConfigFromFlags(opts drivers.DriverOptions) error {
 		d.Description = d.Description[:1000]
 	}
 
-	return nil
+	d.Owner = strings.TrimSpace(opts.String("nutanix-vm-owner"))
+
+	d.AntiAffinityGroup = strings.TrimSpace(opts.String("nutanix-vm-anti-affinity-group"))
+	if len(d.AntiAffinityGroup) > 64 {
+		return fmt.Errorf("nutanix-vm-anti-affinity-group %s is too long (64 characters max)", d.AntiAffinityGroup)
+	}
+
+	d.HostCategory = strings.TrimSpace(opts.String("nutanix-vm-host-category"))
+	if d.HostCategory != "" && !strings.Contains(d.HostCategory, "=") {
+		return fmt.Errorf("nutanix-vm-host-category %s must be in the key=value format", d.HostCategory)
+	}
+
+	d.Hosts = make([]string, 0)
+	for _, host := range opts.StringSlice("nutanix-vm-hosts") {
+		if host = strings.TrimSpace(host); host != "" {
+			d.Hosts = append(d.Hosts, host)
+		}
+	}
+	if d.HostCategory != "" && len(d.Hosts) != 0 {
+		return fmt.Errorf("nutanix-vm-host-category and nutanix-vm-hosts are mutually exclusive")
+	}
+
+	return d.checkPlaintextSecrets()
 }
 
 // Start a host
 func (d *NutanixDriver) Start() error {
 	name := d.GetMachineName()
+	defer d.beginOperation("start")()
 
-	configCreds := client.Credentials{
-		URL:         fmt.Sprintf("%s:%s", d.Endpoint, d.Port),
-		Endpoint:    d.Endpoint,
-		Username:    d.Username,
-		Password:    d.Password,
-		Port:        d.Port,
-		Insecure:    d.Insecure,
-		SessionAuth: d.SessionAuth,
-		ProxyURL:    d.ProxyURL,
+	configCreds, err := d.operationCredentials()
+	if err != nil {
+		return err
 	}
 
 	ctx := context.Background()
 
 	log.Infof("Connecting on: %s", configCreds.URL)
 
-	conn, err := v3.NewV3Client(configCreds)
+	backend, err := d.newBackend(configCreds)
 	if err != nil {
 		return err
 	}
 
-	vmResp, err := conn.V3.GetVM(ctx, d.VMId)
+	err = backend.SetPowerState(ctx, d.VMId, true)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to Start VM %s: %v", name, apiKeyError(ctx, configCreds, err))
 	}
-
-	// Prepare VM update request
-	request := &v3.VMIntentInput{}
-	request.Spec = vmResp.Spec
-	request.Metadata = vmResp.Metadata
-	request.Spec.Resources.PowerState = utils.StringPtr("ON")
-
-	resp, err := conn.V3.UpdateVM(ctx, d.VMId, request)
-	if err != nil {
-		return err
-	}
-
-	taskUUID := resp.Status.ExecutionContext.TaskUUID.(string)
-
-	// Wait for the VM to be deleted
-	for i := 0; i < 1200; i++ {
-		resp, err := conn.V3.GetTask(ctx, taskUUID)
-		if err != nil || *resp.Status != "SUCCEEDED" {
-			<-time.After(1 * time.Second)
-			continue
-		}
-		return err
-	}
-	return fmt.Errorf("unable to Start VM %s", name)
+	return nil
 }
 
 // Stop a host gracefully
 func (d *NutanixDriver) Stop() error {
 	name := d.GetMachineName()
+	defer d.beginOperation("stop")()
 
-	configCreds := client.Credentials{
-		URL:         fmt.Sprintf("%s:%s", d.Endpoint, d.Port),
-		Endpoint:    d.Endpoint,
-		Username:    d.Username,
-		Password:    d.Password,
-		Port:        d.Port,
-		Insecure:    d.Insecure,
-		SessionAuth: d.SessionAuth,
-		ProxyURL:    d.ProxyURL,
+	configCreds, err := d.operationCredentials()
+	if err != nil {
+		return err
 	}
 
 	ctx := context.Background()
 
 	log.Infof("Connecting on: %s", configCreds.URL)
 
-	conn, err := v3.NewV3Client(configCreds)
+	backend, err := d.newBackend(configCreds)
 	if err != nil {
 		return err
 	}
 
-	vmResp, err := conn.V3.GetVM(ctx, d.VMId)
+	err = backend.SetPowerState(ctx, d.VMId, false)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to Stop VM %s: %v", name, apiKeyError(ctx, configCreds, err))
 	}
-
-	// Prepare VM update request
-	request := &v3.VMIntentInput{}
-	request.Spec = vmResp.Spec
-	request.Metadata = vmResp.Metadata
-	request.Spec.Resources.PowerState = utils.StringPtr("OFF")
-
-	resp, err := conn.V3.UpdateVM(ctx, d.VMId, request)
-	if err != nil {
-		return err
-	}
-
-	taskUUID := resp.Status.ExecutionContext.TaskUUID.(string)
-
-	// Wait for the VM to be deleted
-	for i := 0; i < 1200; i++ {
-		resp, err := conn.V3.GetTask(ctx, taskUUID)
-		if err != nil || *resp.Status != "SUCCEEDED" {
-			<-time.After(1 * time.Second)
-			continue
-		}
-		return err
-	}
-	return fmt.Errorf("unable to Stop VM %s", name)
+	return nil
 }
 
 func getEmptyClientSideFilter() []*client.AdditionalFilter {
@@ -0,0 +1,845 @@
+package driver
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/libmachine/state"
+
+	"github.com/nutanix/docker-machine/utils"
+
+	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
+	vmmClient "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/client"
+)
+
+// testFlags implements drivers.DriverOptions for the tests
+type testFlags map[string]interface{}
+
+func (f testFlags) String(key string) string {
+	v, _ := f[key].(string)
+	return v
+}
+
+func (f testFlags) StringSlice(key string) []string {
+	v, _ := f[key].([]string)
+	return v
+}
+
+func (f testFlags) Int(key string) int {
+	v, _ := f[key].(int)
+	return v
+}
+
+func (f testFlags) Bool(key string) bool {
+	v, _ := f[key].(bool)
+	return v
+}
+
+// testEnv is a simulator populated with a cluster, a VLAN subnet, a disk image, and the default project of the user
+type testEnv struct {
+	sim     *prismSimulator
+	cluster string
+	subnet  string
+	image   string
+	project string
+}
+
+func newTestEnv(t *testing.T, clientCAs ...*x509.Certificate) *testEnv {
+	t.Helper()
+
+	sim := newPrismSimulator(t, clientCAs...)
+	env := &testEnv{sim: sim}
+	env.cluster = sim.addCluster("PE1", nil)
+	env.subnet = sim.addSubnet("vlan-100", "VLAN", env.cluster)
+	env.image = sim.addImage("ubuntu-22.04", "DISK_IMAGE", 2*1024*mib)
+	env.project = sim.addProject("default", true)
+	sim.addUser(simUsername, env.project)
+	return env
+}
+
+// newDriver configures a driver against the simulator, the flags overriding the defaults
+func (env *testEnv) newDriver(t *testing.T, flags testFlags) *NutanixDriver {
+	t.Helper()
+
+	host, port := env.sim.endpoint()
+	opts := testFlags{
+		"nutanix-username":    simUsername,
+		"nutanix-password":    simPassword,
+		"nutanix-endpoint":    host,
+		"nutanix-port":        port,
+		"nutanix-insecure":    true,
+		"nutanix-cluster":     "PE1",
+		"nutanix-vm-mem":      2048,
+		"nutanix-vm-cpus":     2,
+		"nutanix-vm-cores":    1,
+		"nutanix-vm-network":  []string{"vlan-100"},
+		"nutanix-vm-image":    "ubuntu-22.04",
+		"nutanix-boot-type":   "legacy",
+		"nutanix-api-version": apiVersionV3,
+	}
+	for key, value := range flags {
+		opts[key] = value
+	}
+
+	d := NewDriver("pool1-abcde", t.TempDir())
+	err := os.MkdirAll(d.ResolveStorePath("."), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.SetConfigFromFlags(opts)
+	if err != nil {
+		t.Fatalf("SetConfigFromFlags: %v", err)
+	}
+	d.Timeout = 5
+	return d
+}
+
+func assertState(t *testing.T, d *NutanixDriver, expected state.State) {
+	t.Helper()
+
+	s, err := d.GetState()
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+	if s != expected {
+		t.Fatalf("expected state %s, got %s", expected, s)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	for _, apiVersion := range []string{apiVersionV3, apiVersionV4} {
+		t.Run(apiVersion, func(t *testing.T) {
+			env := newTestEnv(t)
+			d := env.newDriver(t, testFlags{"nutanix-api-version": apiVersion})
+
+			err := d.Create()
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+
+			if d.ClusterUUID != env.cluster {
+				t.Errorf("expected cluster %s, got %s", env.cluster, d.ClusterUUID)
+			}
+
+			vm := env.sim.vm("pool1-abcde")
+			if vm == nil {
+				t.Fatal("VM not created")
+			}
+			if (vm.v4 != nil) != (apiVersion == apiVersionV4) {
+				t.Errorf("expected the VM to be created with the %s API", apiVersion)
+			}
+			if d.VMId != vm.uuid || d.IPAddress != vm.ip {
+				t.Errorf("expected VM %s with IP %s, got %s with IP %s", vm.uuid, vm.ip, d.VMId, d.IPAddress)
+			}
+
+			assertState(t, d, state.Running)
+
+			err = d.Stop()
+			if err != nil {
+				t.Fatalf("Stop: %v", err)
+			}
+			assertState(t, d, state.Stopped)
+
+			err = d.Start()
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			assertState(t, d, state.Running)
+
+			err = d.Remove()
+			if err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+			if env.sim.vmCount() != 0 {
+				t.Errorf("expected the VM to be deleted")
+			}
+		})
+	}
+}
+
+func TestAPIVersionDetection(t *testing.T) {
+	env := newTestEnv(t)
+	d := env.newDriver(t, testFlags{"nutanix-api-version": apiVersionAuto})
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if d.APIVersion != apiVersionV4 {
+		t.Errorf("expected API version %s to be detected, got %s", apiVersionV4, d.APIVersion)
+	}
+	if env.sim.requestCount(http.MethodPost, "/api/vmm/v4.2/ahv/config/vms") != 1 {
+		t.Errorf("expected the VM to be created with the v4 API")
+	}
+
+	// A Prism Central without the v4 API
+	env = newTestEnv(t)
+	env.sim.injectFaults(http.MethodGet, "/api/vmm/v4.2/ahv/config/vms", http.StatusNotFound)
+	d = env.newDriver(t, testFlags{"nutanix-api-version": apiVersionAuto})
+	err = d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if d.APIVersion != apiVersionV3 {
+		t.Errorf("expected API version %s to be detected, got %s", apiVersionV3, d.APIVersion)
+	}
+	if env.sim.requestCount(http.MethodPost, "/api/nutanix/v3/vms") != 1 {
+		t.Errorf("expected the VM to be created with the v3 API")
+	}
+}
+
+func TestV4Etag(t *testing.T) {
+	env := newTestEnv(t)
+	d := env.newDriver(t, testFlags{"nutanix-api-version": apiVersionV4})
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	creds, err := d.prismCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := creds.newV4Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &v4Backend{conn: conn, timeout: d.Timeout}
+
+	_, stale, err := b.getVM(d.VMId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stale["If-Match"].(*string) == "" {
+		t.Fatal("expected the ETag of the VM to be read")
+	}
+
+	// Each change is made with the ETag of the last read, a change with an outdated ETag is rejected
+	err = b.SetPowerState(context.Background(), d.VMId, false)
+	if err != nil {
+		t.Fatalf("SetPowerState: %v", err)
+	}
+	_, err = conn.VmApiInstance.PowerOnVm(&d.VMId, stale)
+	var apiErr vmmClient.GenericOpenAPIError
+	if !errors.As(err, &apiErr) || !strings.HasPrefix(apiErr.Status, "412") {
+		t.Errorf("expected the outdated ETag to be rejected, got %v", err)
+	}
+	err = b.DeleteVM(context.Background(), d.VMId)
+	if err != nil {
+		t.Fatalf("DeleteVM: %v", err)
+	}
+	if env.sim.vmCount() != 0 {
+		t.Errorf("expected the VM to be deleted")
+	}
+}
+
+func TestCreateSpec(t *testing.T) {
+	env := newTestEnv(t)
+	container := "11111111-2222-3333-4444-555555555555"
+	d := env.newDriver(t, testFlags{
+		"nutanix-vm-categories":     []string{"Environment = Dev"},
+		"nutanix-disk-size":         10,
+		"nutanix-storage-container": container,
+		"nutanix-vm-serial-port":    true,
+		"nutanix-vm-total-vcpus":    4,
+		"nutanix-vm-cores":          2,
+	})
+
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	vm := env.sim.vm("pool1-abcde")
+	resources := vm.spec["resources"].(map[string]interface{})
+	if resources["num_sockets"] != float64(2) || resources["num_vcpus_per_socket"] != float64(2) {
+		t.Errorf("expected 2 sockets of 2 cores, got %v sockets of %v cores", resources["num_sockets"], resources["num_vcpus_per_socket"])
+	}
+
+	disks := resources["disk_list"].([]interface{})
+	if len(disks) != 2 {
+		t.Fatalf("expected the image disk and the additional disk, got %d disks", len(disks))
+	}
+	if !strings.Contains(mustJSON(t, disks[0]), env.image) || !strings.Contains(mustJSON(t, disks[1]), container) {
+		t.Errorf("unexpected disks %s", mustJSON(t, disks))
+	}
+	if !strings.Contains(mustJSON(t, resources["nic_list"]), env.subnet) {
+		t.Errorf("expected a NIC on subnet %s, got %s", env.subnet, mustJSON(t, resources["nic_list"]))
+	}
+	if !strings.Contains(mustJSON(t, vm.metadata["categories_mapping"]), `"Environment":["Dev"]`) {
+		t.Errorf("unexpected categories %s", mustJSON(t, vm.metadata["categories_mapping"]))
+	}
+}
+
+func TestCreateTaskFailure(t *testing.T) {
+	env := newTestEnv(t)
+	env.sim.createErrors = []string{"INTERNAL_ERROR: not enough resources"}
+	d := env.newDriver(t, nil)
+
+	err := d.Create()
+	if err == nil || !strings.Contains(err.Error(), "not enough resources") {
+		t.Fatalf("expected the task error, got %v", err)
+	}
+	if env.sim.vmCount() != 0 {
+		t.Errorf("expected the failed VM to be deleted")
+	}
+}
+
+func TestCreateDelayedIP(t *testing.T) {
+	env := newTestEnv(t)
+	env.sim.ipDelay = 1
+	d := env.newDriver(t, nil)
+	d.Timeout = 10
+
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if d.IPAddress == "" {
+		t.Errorf("expected an IP address")
+	}
+}
+
+func TestCreateIPTimeout(t *testing.T) {
+	env := newTestEnv(t)
+	env.sim.ipDelay = -1
+	d := env.newDriver(t, nil)
+
+	err := d.Create()
+	if err == nil || !strings.Contains(err.Error(), "IP address") {
+		t.Fatalf("expected an IP address timeout, got %v", err)
+	}
+	if env.sim.vmCount() != 0 {
+		t.Errorf("expected the VM without IP address to be deleted")
+	}
+}
+
+func TestCreateGPURetry(t *testing.T) {
+	env := newTestEnv(t)
+	env.sim.addHost("host1", env.cluster,
+		map[string]interface{}{"name": "Tesla T4", "vendor": "NVIDIA", "mode": "PASSTHROUGH_COMPUTE", "status": "UNUSED", "device_id": 7864},
+		map[string]interface{}{"name": "Tesla T4", "vendor": "NVIDIA", "mode": "PASSTHROUGH_COMPUTE", "status": "UNUSED", "device_id": 7864},
+	)
+	env.sim.createErrors = []string{"GPU device 7864 is already in use"}
+	d := env.newDriver(t, testFlags{"nutanix-vm-gpu": []string{"vendor=nvidia,count=2"}})
+
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if count := env.sim.requestCount("POST", "/api/nutanix/v3/vms"); count != 2 {
+		t.Errorf("expected 2 creation attempts, got %d", count)
+	}
+
+	vm := env.sim.vm("pool1-abcde")
+	gpus, _ := vm.spec["resources"].(map[string]interface{})["gpu_list"].([]interface{})
+	if len(gpus) != 2 {
+		t.Errorf("expected 2 GPUs, got %d", len(gpus))
+	}
+}
+
+func TestIsGPUAllocationError(t *testing.T) {
+	for message, expected := range map[string]bool{
+		"GPU device 7864 is already in use":                            true,
+		"Requested GPU is already assigned to VM 1234":                 true,
+		"GPU 0000:3b:00.0 not available":                               true,
+		"NoHostResources: No host has enough available GPU for VM":     true,
+		"Insufficient GPU resources on the cluster":                    true,
+		"InvalidArgument: invalid GPU mode PASSTHROUGH":                false,
+		"User is not authorized to assign GPU devices":                 false,
+		"NoHostResources: not enough memory for VM pool1-abcde":        false,
+		"spec.resources.gpu_list[0].device_id: must be greater than 0": false,
+	} {
+		if isGPUAllocationError(errors.New(message)) != expected {
+			t.Errorf("%q: expected GPU allocation error %t", message, expected)
+		}
+	}
+}
+
+func TestCreateProjectResolution(t *testing.T) {
+	// Without nutanix-project, the VM goes to the default project of the user
+	env := newTestEnv(t)
+	d := env.newDriver(t, nil)
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	ref, _ := env.sim.vm("pool1-abcde").metadata["project_reference"].(map[string]interface{})
+	if ref["uuid"] != env.project {
+		t.Errorf("expected the default project of the user, got %v", ref)
+	}
+
+	env = newTestEnv(t)
+	other := env.sim.addProject("finance", false)
+	d = env.newDriver(t, testFlags{"nutanix-project": "finance"})
+	err = d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	ref, _ = env.sim.vm("pool1-abcde").metadata["project_reference"].(map[string]interface{})
+	if ref["uuid"] != other {
+		t.Errorf("expected project finance, got %v", ref)
+	}
+
+	// A user without resolvable default project creates the VM without project, as before the project validation
+	env = newTestEnv(t)
+	env.sim.users = nil
+	d = env.newDriver(t, nil)
+	err = d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if ref, ok := env.sim.vm("pool1-abcde").metadata["project_reference"]; ok {
+		t.Errorf("expected no project, got %v", ref)
+	}
+}
+
+func TestCreateOwner(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(env *testEnv)
+		expected string
+	}{
+		{"direct member", func(env *testEnv) {
+			env.sim.addUser("alice", env.project)
+		}, ""},
+		{"group member", func(env *testEnv) {
+			user := env.sim.addUser("alice")
+			findEntity(env.sim.users, user)["status"].(map[string]interface{})["resources"].(map[string]interface{})["directory_service_user"] =
+				map[string]interface{}{"directory_service_reference": map[string]interface{}{"kind": "directory_service", "uuid": "ad1"}}
+			group := env.sim.addUserGroup("cn=ops,dc=example,dc=com", "ad1")
+			findEntity(env.sim.projects, env.project)["spec"].(map[string]interface{})["resources"] = map[string]interface{}{
+				"external_user_group_reference_list": []interface{}{map[string]interface{}{"kind": "user_group", "uuid": group}},
+			}
+		}, ""},
+		{"not a member", func(env *testEnv) {
+			env.sim.addUser("alice")
+		}, "not a member of project default"},
+		{"unknown", func(env *testEnv) {}, "owner alice not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			tt.setup(env)
+			d := env.newDriver(t, testFlags{"nutanix-vm-owner": "alice"})
+
+			err := d.Create()
+			if tt.expected != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expected) {
+					t.Fatalf("expected error %q, got %v", tt.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			ref, _ := env.sim.vm("pool1-abcde").metadata["owner_reference"].(map[string]interface{})
+			if ref["name"] != "alice" {
+				t.Errorf("expected owner alice, got %v", ref)
+			}
+			if count := env.sim.requestCount(http.MethodPost, "/api/nutanix/v3/users/list"); count != 1 {
+				t.Errorf("expected a single filtered user query, got %d", count)
+			}
+		})
+	}
+}
+
+func TestCreateResourceErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    testFlags
+		expected string
+	}{
+		{"unknown cluster", testFlags{"nutanix-cluster": "PE2"}, "failed to retrieve cluster PE2"},
+		{"unknown subnet", testFlags{"nutanix-vm-network": []string{"vlan-200"}}, "network [vlan-200] not found"},
+		{"unknown image", testFlags{"nutanix-vm-image": "centos"}, "image centos not found"},
+		{"unknown project", testFlags{"nutanix-project": "finance"}, "project finance not found"},
+		{"no GPU", testFlags{"nutanix-vm-gpu": []string{"Tesla T4"}}, "enough free GPUs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			d := env.newDriver(t, tt.flags)
+
+			err := d.Create()
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Fatalf("expected error %q, got %v", tt.expected, err)
+			}
+			if env.sim.vmCount() != 0 {
+				t.Errorf("expected no VM to be created")
+			}
+		})
+	}
+}
+
+func TestCreateSubnetUUIDCluster(t *testing.T) {
+	env := newTestEnv(t)
+	pe2 := env.sim.addCluster("PE2", nil)
+	subnet := env.sim.addSubnet("vlan-200", "VLAN", pe2)
+
+	d := env.newDriver(t, testFlags{"nutanix-vm-network": []string{subnet}})
+	err := d.Create()
+	if err == nil || !strings.Contains(err.Error(), "not attached to cluster PE1") {
+		t.Fatalf("expected a subnet cluster error, got %v", err)
+	}
+
+	d = env.newDriver(t, testFlags{"nutanix-cluster": "PE1,PE2", "nutanix-vm-network": []string{subnet}})
+	err = d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	vm := env.sim.vm("pool1-abcde")
+	if !strings.Contains(mustJSON(t, vm.spec["cluster_reference"]), pe2) {
+		t.Errorf("expected the VM on cluster PE2, got %s", mustJSON(t, vm.spec["cluster_reference"]))
+	}
+}
+
+func TestCreateV4RequiresV3(t *testing.T) {
+	env := newTestEnv(t)
+	env.sim.injectFaults(http.MethodPost, "/api/nutanix/v3/clusters/list", http.StatusNotFound)
+	d := env.newDriver(t, testFlags{"nutanix-api-version": apiVersionV4})
+
+	err := d.Create()
+	if err == nil || !strings.Contains(err.Error(), "v3 API is required") {
+		t.Fatalf("expected a v3 API error, got %v", err)
+	}
+	if env.sim.vmCount() != 0 {
+		t.Errorf("expected no VM to be created")
+	}
+}
+
+func TestCreateCapacityCheck(t *testing.T) {
+	env := newTestEnv(t)
+	env.sim.setClusterStats(env.cluster, map[string]string{
+		"memory_capacity_bytes":       "4294967296",
+		"hypervisor_memory_usage_ppm": "750000",
+	})
+	d := env.newDriver(t, testFlags{"nutanix-capacity-check": capacityCheckFail})
+
+	err := d.Create()
+	if err == nil || !strings.Contains(err.Error(), "not enough capacity") {
+		t.Fatalf("expected a capacity error, got %v", err)
+	}
+	if env.sim.vmCount() != 0 {
+		t.Errorf("expected no VM to be created")
+	}
+}
+
+func TestCheckClusterVCPUs(t *testing.T) {
+	env := newTestEnv(t)
+	env.sim.addHost("host1", env.cluster)
+	// The VMs are counted across the pages of the groups API
+	env.sim.groupsPageSize = 1
+	for i := 0; i < 2; i++ {
+		d := env.newDriver(t, testFlags{"nutanix-vm-cpus": 2, "nutanix-vm-cores": 2})
+		err := d.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := env.newDriver(t, testFlags{})
+
+	creds, err := d.prismCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := creds.newV3Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster := &ClusterCandidate{UUID: env.cluster, Name: "PE1"}
+
+	// The powered on VMs hold 8 of the 16 cores
+	shortfalls, err := CheckClusterVCPUs(context.Background(), conn, creds, cluster, 8)
+	if err != nil || len(shortfalls) != 0 {
+		t.Errorf("expected no shortfall, got %v, %v", shortfalls, err)
+	}
+	shortfalls, err = CheckClusterVCPUs(context.Background(), conn, creds, cluster, 10)
+	if err != nil || len(shortfalls) != 1 || !strings.Contains(shortfalls[0], "short by 2 vCPUs") {
+		t.Errorf("expected a shortfall of 2 vCPUs, got %v, %v", shortfalls, err)
+	}
+
+	// The vCPUs can be overcommitted, the creation goes on even in fail mode
+	d = env.newDriver(t, testFlags{"nutanix-capacity-check": capacityCheckFail, "nutanix-vm-cpus": 10})
+	err = d.Create()
+	if err != nil {
+		t.Errorf("expected the creation to succeed with overcommitted vCPUs, got %v", err)
+	}
+}
+
+func TestHostAffinityCategory(t *testing.T) {
+	env := newTestEnv(t)
+	host1 := env.sim.addHost("host1", env.cluster)
+	host2 := env.sim.addHost("host2", env.cluster)
+	d := env.newDriver(t, testFlags{})
+	creds, err := d.prismCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := creds.newV3Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	hosts, err := GetAffinityHosts(ctx, conn, env.cluster, "", []string{"host2", host1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := HostAffinityValue("", hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reversed, _ := HostAffinityValue("", []*v3.HostResponse{hosts[1], hosts[0]})
+	if value != reversed || len(value) > 64 {
+		t.Errorf("expected a stable value of 64 characters max, got %q and %q", value, reversed)
+	}
+
+	for _, host := range hosts {
+		err = addHostCategory(ctx, conn, creds, host, hostAffinityHostCategoryKey, value, d.Timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	hosts, _ = GetHostsForPE(ctx, conn, env.cluster)
+	for _, host := range hosts {
+		if !hasCategory(host.Metadata, hostAffinityHostCategoryKey, value) || hasCategory(host.Metadata, hostAffinityCategoryKey, value) {
+			t.Errorf("expected host %s to carry only the host category, got %v", host.Status.Name, host.Metadata.CategoriesMapping)
+		}
+	}
+
+	for _, host := range hosts {
+		err = removeHostCategory(ctx, conn, creds, host, hostAffinityHostCategoryKey, value, d.Timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	hosts, _ = GetHostsForPE(ctx, conn, env.cluster)
+	for _, host := range hosts {
+		if len(host.Metadata.CategoriesMapping) != 0 {
+			t.Errorf("expected host %s to be untagged, got %v", host.Status.Name, host.Metadata.CategoriesMapping)
+		}
+	}
+	if env.sim.requestCount(http.MethodPut, "/api/nutanix/v3/hosts/"+host2) != 2 {
+		t.Errorf("expected host2 to be updated twice")
+	}
+}
+
+func TestAntiAffinityGroup(t *testing.T) {
+	for _, apiVersion := range []string{apiVersionV3, apiVersionV4} {
+		t.Run(apiVersion, func(t *testing.T) {
+			env := newTestEnv(t)
+			flags := testFlags{"nutanix-api-version": apiVersion, "nutanix-vm-anti-affinity-group": "workers"}
+
+			d1 := env.newDriver(t, flags)
+			err := d1.Create()
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			policy := env.sim.antiAffinityPolicy("workers")
+			categoryID := env.sim.categoryID(antiAffinityCategoryKey, "workers")
+			if policy == nil || categoryID == "" || utils.StringValue(policy.Categories[0].ExtId) != categoryID {
+				t.Fatalf("expected the policy workers to select the category of the group")
+			}
+			if !slices.Contains(env.sim.vmCategoryNames("pool1-abcde"), antiAffinityCategoryKey+"=workers") {
+				t.Errorf("expected the VM to carry the category of the group, got %v", env.sim.vmCategoryNames("pool1-abcde"))
+			}
+
+			d2 := env.newDriver(t, flags)
+			err = d2.Create()
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			if count := env.sim.requestCount(http.MethodPost, "/api/vmm/v4.2/ahv/policies/vm-anti-affinity-policies"); count != 1 {
+				t.Errorf("expected the policy to be created once, got %d creations", count)
+			}
+
+			// The policy is kept until its last VM is removed
+			err = d1.Remove()
+			if err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+			if env.sim.antiAffinityPolicy("workers") == nil {
+				t.Fatal("expected the policy to be kept for the remaining VM")
+			}
+			err = d2.Remove()
+			if err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+			if env.sim.antiAffinityPolicy("workers") != nil || env.sim.categoryID(antiAffinityCategoryKey, "workers") != "" {
+				t.Errorf("expected the policy and its category to be deleted with the last VM")
+			}
+		})
+	}
+}
+
+func TestAntiAffinityGroupUpdate(t *testing.T) {
+	env := newTestEnv(t)
+	policyID := env.sim.addAntiAffinityPolicy("workers")
+	d := env.newDriver(t, testFlags{"nutanix-vm-anti-affinity-group": "workers"})
+
+	// The existing policy is updated with the ETag of its last read to select the category of the group
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	policy := env.sim.antiAffinityPolicy("workers")
+	if utils.StringValue(policy.ExtId) != policyID || len(policy.Categories) != 1 ||
+		utils.StringValue(policy.Categories[0].ExtId) != env.sim.categoryID(antiAffinityCategoryKey, "workers") {
+		t.Errorf("expected the existing policy to select the category of the group")
+	}
+	if env.sim.requestCount(http.MethodPut, "/api/vmm/v4.2/ahv/policies/vm-anti-affinity-policies/"+policyID) != 1 {
+		t.Errorf("expected the existing policy to be updated")
+	}
+}
+
+func TestHostAffinity(t *testing.T) {
+	for _, apiVersion := range []string{apiVersionV3, apiVersionV4} {
+		t.Run(apiVersion+" host list", func(t *testing.T) {
+			env := newTestEnv(t)
+			host1 := env.sim.addHost("host1", env.cluster)
+			host2 := env.sim.addHost("host2", env.cluster)
+			host3 := env.sim.addHost("host3", env.cluster)
+			d := env.newDriver(t, testFlags{"nutanix-api-version": apiVersion, "nutanix-vm-hosts": []string{"host1", "host2"}})
+
+			err := d.Create()
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			value := d.HostAffinityValue
+			name := hostAffinityPolicyName(value)
+			vmCategoryID := env.sim.categoryID(hostAffinityCategoryKey, value)
+			hostCategoryID := env.sim.categoryID(hostAffinityHostCategoryKey, value)
+			policy := env.sim.hostAffinityPolicy(name)
+			if policy == nil || vmCategoryID == "" || hostCategoryID == "" ||
+				utils.StringValue(policy.VmCategories[0].ExtId) != vmCategoryID || utils.StringValue(policy.HostCategories[0].ExtId) != hostCategoryID {
+				t.Fatalf("expected the policy %s to bind the VM category to the host category", name)
+			}
+			if !slices.Contains(env.sim.vmCategoryNames("pool1-abcde"), hostAffinityCategoryKey+"="+value) {
+				t.Errorf("expected the VM to carry the category of the policy, got %v", env.sim.vmCategoryNames("pool1-abcde"))
+			}
+			for _, host := range []string{host1, host2} {
+				if mustJSON(t, env.sim.hostCategories(host)) != mustJSON(t, map[string]interface{}{hostAffinityHostCategoryKey: []string{value}}) {
+					t.Errorf("expected host %s to be tagged, got %v", host, env.sim.hostCategories(host))
+				}
+			}
+			if len(env.sim.hostCategories(host3)) != 0 {
+				t.Errorf("expected host3 not to be tagged")
+			}
+
+			err = d.Remove()
+			if err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+			if env.sim.hostAffinityPolicy(name) != nil || env.sim.categoryID(hostAffinityCategoryKey, value) != "" || env.sim.categoryID(hostAffinityHostCategoryKey, value) != "" {
+				t.Errorf("expected the policy and its categories to be deleted with the last VM")
+			}
+			for _, host := range []string{host1, host2} {
+				if len(env.sim.hostCategories(host)) != 0 {
+					t.Errorf("expected host %s to be untagged, got %v", host, env.sim.hostCategories(host))
+				}
+			}
+		})
+	}
+
+	t.Run("host category", func(t *testing.T) {
+		env := newTestEnv(t)
+		host1 := env.sim.addHost("host1", env.cluster)
+		env.sim.addHost("host2", env.cluster)
+		env.sim.tagHost(host1, "Zone", "A")
+		zone := env.sim.addCategory("Zone", "A")
+		d := env.newDriver(t, testFlags{"nutanix-vm-host-category": "Zone=A"})
+
+		err := d.Create()
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		name := hostAffinityPolicyName(d.HostAffinityValue)
+		policy := env.sim.hostAffinityPolicy(name)
+		if policy == nil || utils.StringValue(policy.HostCategories[0].ExtId) != zone {
+			t.Fatalf("expected the policy %s to select the hosts of the category Zone=A", name)
+		}
+		if env.sim.categoryID(hostAffinityHostCategoryKey, d.HostAffinityValue) != "" {
+			t.Errorf("expected no host category to be created")
+		}
+
+		err = d.Remove()
+		if err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+		if env.sim.hostAffinityPolicy(name) != nil || env.sim.categoryID(hostAffinityCategoryKey, d.HostAffinityValue) != "" {
+			t.Errorf("expected the policy and its VM category to be deleted with the last VM")
+		}
+		if env.sim.categoryID("Zone", "A") != zone || len(env.sim.hostCategories(host1)) != 1 {
+			t.Errorf("expected the host category and its hosts to be kept")
+		}
+	})
+}
+
+func TestSetConfigFromFlagsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    testFlags
+		expected string
+	}{
+		{"missing network", testFlags{"nutanix-vm-network": []string{}}, "nutanix-vm-network cannot be empty"},
+		{"invalid api version", testFlags{"nutanix-api-version": "v2"}, "nutanix-api-version v2 is not supported"},
+		{"cluster and category", testFlags{"nutanix-cluster-category": "Zone=A"}, "mutually exclusive"},
+		{"total vcpus and cpus", testFlags{"nutanix-vm-total-vcpus": 4, "nutanix-vm-cpus": 4}, "mutually exclusive"},
+		{"vtpm with legacy boot", testFlags{"nutanix-vm-vtpm": true}, "nutanix-vm-vtpm requires"},
+		{"invalid gpu", testFlags{"nutanix-vm-gpu": []string{"count=0"}}, "invalid GPU count"},
+		{"credentials source and password", testFlags{"nutanix-credentials-source": "netrc:"}, "mutually exclusive"},
+		{"api key and password", testFlags{"nutanix-api-key": simAPIKey}, "mutually exclusive"},
+		{"insecure and ca bundle", testFlags{"nutanix-insecure": true, "nutanix-ca-bundle": "/nonexistent"}, "mutually exclusive"},
+		{"invalid fingerprint", testFlags{"nutanix-tls-fingerprint": "ab:cd"}, "invalid SHA-256 fingerprint"},
+		{"empty ca bundle", testFlags{"nutanix-ca-bundle": "-----BEGIN CERTIFICATE-----"}, "no certificate found"},
+		{"missing api key file", testFlags{"nutanix-username": "", "nutanix-password": "", "nutanix-api-key-file": "/nonexistent"}, "failed to read the API key file"},
+		{"encrypted-like plaintext password", testFlags{"nutanix-password": encryptedSecretPrefix + simPassword}, "Password cannot start with " + encryptedSecretPrefix},
+	}
+
+	t.Setenv(secretsKeyEnv, "")
+	t.Setenv(secretsKeyFileEnv, "")
+	env := newTestEnv(t)
+	host, port := env.sim.endpoint()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testFlags{
+				"nutanix-username":   simUsername,
+				"nutanix-password":   simPassword,
+				"nutanix-endpoint":   host,
+				"nutanix-port":       port,
+				"nutanix-cluster":    "PE1",
+				"nutanix-vm-network": []string{"vlan-100"},
+				"nutanix-vm-image":   "ubuntu-22.04",
+				"nutanix-boot-type":  "legacy",
+			}
+			for key, value := range tt.flags {
+				opts[key] = value
+			}
+
+			err := NewDriver("pool1-abcde", t.TempDir()).SetConfigFromFlags(opts)
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Fatalf("expected error %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
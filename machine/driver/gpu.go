@@ -0,0 +1,236 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nutanix/docker-machine/utils"
+
+	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
+)
+
+const (
+	// gpuLockFile is the lock file serializing the GPU allocation between the driver processes
+	gpuLockFile = "nutanix-gpu.lock"
+	// gpuAllocationRetries is the number of VM creation retries when the selected GPU devices are taken
+	gpuAllocationRetries = 3
+)
+
+// GPURequest describes the GPU devices to attach to the VM.
+// A plain GPU name requests one device with this exact name.
+type GPURequest struct {
+	Name   string
+	Vendor string
+	Mode   string
+	Count  int
+}
+
+// ParseGPURequest parses a GPU request, either a plain GPU name or a comma separated list of
+// name (or profile), vendor, mode and count key=value pairs.
+// It returns a GPURequest pointer or an error if the request is malformed.
+func ParseGPURequest(s string) (*GPURequest, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("gpu name must be passed in order to retrieve the GPU")
+	}
+
+	if !strings.Contains(s, "=") {
+		return &GPURequest{Name: s, Count: 1}, nil
+	}
+
+	request := &GPURequest{Count: 1}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) < 2 {
+			return nil, fmt.Errorf("malformed GPU request %s", s)
+		}
+
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		switch key {
+		case "name", "profile":
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, fmt.Errorf("malformed GPU name pattern %s: %v", value, err)
+			}
+			request.Name = value
+		case "vendor":
+			request.Vendor = value
+		case "mode":
+			request.Mode = value
+		case "count":
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("invalid GPU count %s", value)
+			}
+			request.Count = count
+		default:
+			return nil, fmt.Errorf("unknown GPU request key %s", key)
+		}
+	}
+
+	return request, nil
+}
+
+// ParseGPURequests parses the GPU requests of the nutanix-vm-gpu flag
+func ParseGPURequests(gpus []string) ([]*GPURequest, error) {
+	requests := make([]*GPURequest, 0, len(gpus))
+	for _, gpu := range gpus {
+		request, err := ParseGPURequest(gpu)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+// Matches checks if the GPU device matches the request.
+// The name is matched as a pattern, the vendor is case insensitive and the mode matches as a prefix
+// so passthrough selects both PASSTHROUGH_GRAPHICS and PASSTHROUGH_COMPUTE devices.
+func (r *GPURequest) Matches(gpu *v3.GPU) bool {
+	if r.Name != "" {
+		if matched, _ := path.Match(r.Name, gpu.Name); !matched {
+			return false
+		}
+	}
+	if r.Vendor != "" && !strings.EqualFold(r.Vendor, gpu.Vendor) {
+		return false
+	}
+	if r.Mode != "" && !strings.HasPrefix(strings.ToUpper(gpu.Mode), strings.ToUpper(r.Mode)) {
+		return false
+	}
+	return true
+}
+
+func (r *GPURequest) String() string {
+	criteria := make([]string, 0)
+	if r.Name != "" {
+		criteria = append(criteria, fmt.Sprintf("name=%s", r.Name))
+	}
+	if r.Vendor != "" {
+		criteria = append(criteria, fmt.Sprintf("vendor=%s", r.Vendor))
+	}
+	if r.Mode != "" {
+		criteria = append(criteria, fmt.Sprintf("mode=%s", r.Mode))
+	}
+	return fmt.Sprintf("%dx [%s]", r.Count, strings.Join(criteria, " "))
+}
+
+// GetGPUList selects the GPU devices matching the requests in the Prism Element.
+// All the devices are selected on the same host so the VM can be scheduled.
+// When host UUIDs are provided, only the GPUs of these hosts are selected.
+// It returns a slice of VMGpu pointers or an error reporting the free matching devices of each host.
+func GetGPUList(ctx context.Context, conn *v3.Client, requests []*GPURequest, peUUID string, hostUUIDs []string) ([]*v3.VMGpu, error) {
+	hosts, err := GetHostsForPE(ctx, conn, peUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]*v3.HostResponse, 0, len(hosts))
+	for _, host := range hosts {
+		if len(hostUUIDs) == 0 || slices.Contains(hostUUIDs, utils.StringValue(host.Metadata.UUID)) {
+			candidates = append(candidates, host)
+		}
+	}
+
+	for _, host := range candidates {
+		gpus := selectHostGPUs(host, requests)
+		if gpus != nil {
+			for _, gpu := range gpus {
+				log.Infof("GPU %s device %d selected on host %s", utils.StringValue(gpu.Vendor), utils.Int64Value(gpu.DeviceID), host.Status.Name)
+			}
+			return gpus, nil
+		}
+	}
+
+	return nil, gpuShortageError(candidates, requests, peUUID)
+}
+
+// selectHostGPUs selects distinct free devices of the host for all the requests.
+// It returns nil if the host cannot satisfy all of them.
+func selectHostGPUs(host *v3.HostResponse, requests []*GPURequest) []*v3.VMGpu {
+	if host.Status.Resources == nil {
+		return nil
+	}
+
+	used := make(map[int]bool)
+	selected := make([]*v3.VMGpu, 0)
+	for _, request := range requests {
+		found := 0
+		for index, gpu := range host.Status.Resources.GPUList {
+			if found == request.Count {
+				break
+			}
+			if used[index] || !isFreeGPU(gpu) || !request.Matches(gpu) {
+				continue
+			}
+
+			used[index] = true
+			found++
+			selected = append(selected, &v3.VMGpu{
+				DeviceID: gpu.DeviceID,
+				Mode:     utils.StringPtr(gpu.Mode),
+				Vendor:   utils.StringPtr(gpu.Vendor),
+			})
+		}
+		if found < request.Count {
+			return nil
+		}
+	}
+	return selected
+}
+
+// gpuShortageError builds the error reporting how many devices matching each request are free on each host
+func gpuShortageError(hosts []*v3.HostResponse, requests []*GPURequest, peUUID string) error {
+	details := make([]string, 0, len(requests))
+	for _, request := range requests {
+		counts := make([]string, 0, len(hosts))
+		for _, host := range hosts {
+			free := 0
+			if host.Status.Resources != nil {
+				for _, gpu := range host.Status.Resources.GPUList {
+					if isFreeGPU(gpu) && request.Matches(gpu) {
+						free++
+					}
+				}
+			}
+			counts = append(counts, fmt.Sprintf("%s: %d", host.Status.Name, free))
+		}
+		details = append(details, fmt.Sprintf("%s free per host (%s)", request, strings.Join(counts, ", ")))
+	}
+
+	return fmt.Errorf("no host of Prism Element cluster with UUID %s has enough free GPUs: %s", peUUID, strings.Join(details, "; "))
+}
+
+// isFreeGPU checks if the GPU device can be assigned to a new VM
+func isFreeGPU(gpu *v3.GPU) bool {
+	if gpu == nil {
+		return false
+	}
+	if gpu.Mode == "VIRTUAL" {
+		return gpu.Assignable
+	}
+	return gpu.Status == "UNUSED"
+}
+
+// gpuLockPath returns the path of the lock file serializing the GPU allocation,
+// in the parent directory of the machine store.
+func (d *NutanixDriver) gpuLockPath() string {
+	return filepath.Join(filepath.Dir(d.ResolveStorePath(".")), gpuLockFile)
+}
+
+// gpuAllocationError matches the Prism Central errors of a GPU device already assigned or not available anymore
+var gpuAllocationError = regexp.MustCompile(`(?i)gpu\b.*\b(already (in use|assigned|allocated)|not available|unavailable)|(no host|not enough|insufficient)\b.*\bgpu`)
+
+// isGPUAllocationError checks if the VM creation failed because a GPU device was not available anymore.
+// The other GPU errors, like an invalid GPU spec or a missing permission, are not retried.
+func isGPUAllocationError(err error) bool {
+	return gpuAllocationError.MatchString(err.Error())
+}
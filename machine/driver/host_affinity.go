@@ -0,0 +1,403 @@
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nutanix/docker-machine/utils"
+
+	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
+	v4 "github.com/nutanix-cloud-native/prism-go-client/v4"
+	vmmApi "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/api"
+	vmmConfig "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/prism/v4/config"
+	vmmPolicies "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/vmm/v4/ahv/policies"
+)
+
+// hostAffinityCategoryKey is the category key used to bind the VMs to their VM-host affinity policy
+const hostAffinityCategoryKey = "RancherHostAffinity"
+
+// hostAffinityHostCategoryKey is the category key assigned to the hosts of an explicit host list,
+// distinct from the VM category so the hosts never match the VM side of the policy
+const hostAffinityHostCategoryKey = "RancherHostAffinityHost"
+
+// hostAffinityLockKind names the lock files of the VM-host affinity policies
+const hostAffinityLockKind = "host-affinity"
+
+// GetAffinityHosts retrieves the hosts of the Prism Element matching the host category (key=value)
+// or the explicit list of host names or UUIDs.
+// It returns a slice of HostResponse pointers or an error if no host in the cluster matches.
+func GetAffinityHosts(ctx context.Context, conn *v3.Client, peUUID, hostCategory string, hostNames []string) ([]*v3.HostResponse, error) {
+	hosts, err := GetHostsForPE(ctx, conn, peUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	matchingHosts := make([]*v3.HostResponse, 0)
+
+	if hostCategory != "" {
+		key, value, err := splitCategory(hostCategory)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, host := range hosts {
+			if hasCategory(host.Metadata, key, value) {
+				matchingHosts = append(matchingHosts, host)
+			}
+		}
+
+		if len(matchingHosts) == 0 {
+			return nil, fmt.Errorf("no host with category %s found in Prism Element cluster with UUID %s", hostCategory, peUUID)
+		}
+	} else {
+		for _, name := range hostNames {
+			found := false
+			for _, host := range hosts {
+				if host.Status.Name == name || utils.StringValue(host.Metadata.UUID) == name {
+					matchingHosts = append(matchingHosts, host)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("host %s not found in Prism Element cluster with UUID %s", name, peUUID)
+			}
+		}
+	}
+
+	for _, host := range matchingHosts {
+		log.Infof("Host %s found with UUID: %s", host.Status.Name, *host.Metadata.UUID)
+	}
+
+	return matchingHosts, nil
+}
+
+// HostAffinityValue returns the category value identifying the VM-host affinity policy
+// of the host category (key=value) or of the explicit host list.
+func HostAffinityValue(hostCategory string, hosts []*v3.HostResponse) (string, error) {
+	if hostCategory != "" {
+		key, value, err := splitCategory(hostCategory)
+		if err != nil {
+			return "", err
+		}
+		return hostAffinityValue(fmt.Sprintf("%s_%s", key, value)), nil
+	}
+
+	hostUUIDs := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		hostUUIDs = append(hostUUIDs, *host.Metadata.UUID)
+	}
+	slices.Sort(hostUUIDs)
+	return hostAffinityValue("hosts_" + strings.Join(hostUUIDs, ",")), nil
+}
+
+// EnsureHostAffinityPolicy creates the VM-host affinity policy of the value binding the VMs to the hosts if it is missing.
+// With an explicit host list, the hosts are tagged with a dedicated category.
+// The VMs of the policy must be tagged with the category hostAffinityCategoryKey:value.
+func EnsureHostAffinityPolicy(ctx context.Context, conn *v3.Client, conn4 *v4.Client, creds connConfig, hostCategory, value string, hosts []*v3.HostResponse, timeout int) error {
+	var hostCategoryExtID string
+
+	if hostCategory != "" {
+		key, categoryValue, err := splitCategory(hostCategory)
+		if err != nil {
+			return err
+		}
+
+		hostCategoryExtID, err = getCategory(conn4, key, categoryValue)
+		if err != nil {
+			return err
+		}
+		if hostCategoryExtID == "" {
+			return fmt.Errorf("host category %s not found", hostCategory)
+		}
+	} else {
+		var err error
+		hostCategoryExtID, err = ensureCategory(conn4, hostAffinityHostCategoryKey, value)
+		if err != nil {
+			return err
+		}
+
+		for _, host := range hosts {
+			err = addHostCategory(ctx, conn, creds, host, hostAffinityHostCategoryKey, value, timeout)
+			if err != nil {
+				return fmt.Errorf("failed to tag host %s: %v", host.Status.Name, err)
+			}
+		}
+	}
+
+	vmCategoryExtID, err := ensureCategory(conn4, hostAffinityCategoryKey, value)
+	if err != nil {
+		return err
+	}
+
+	name := hostAffinityPolicyName(value)
+	policy, err := getHostAffinityPolicy(conn4, name)
+	if err != nil {
+		return err
+	}
+	if policy != nil {
+		log.Infof("VM-host affinity policy %s found with UUID: %s", name, utils.StringValue(policy.ExtId))
+		return nil
+	}
+
+	log.Infof("Creating VM-host affinity policy %s", name)
+	body := vmmPolicies.NewVmHostAffinityPolicy()
+	body.Name = utils.StringPtr(name)
+	body.Description = utils.StringPtr("VM-host affinity policy created by Nutanix Rancher Node Driver")
+	body.VmCategories = []vmmPolicies.CategoryReference{{ExtId: utils.StringPtr(vmCategoryExtID)}}
+	body.HostCategories = []vmmPolicies.CategoryReference{{ExtId: utils.StringPtr(hostCategoryExtID)}}
+
+	resp, err := vmmApi.NewVmHostAffinityPoliciesApi(conn4.VmApiInstance.ApiClient).CreateVmHostAffinityPolicy(body)
+	if err != nil {
+		// The policy may have been created in the meantime by a driver process of another machine store
+		if existing, _ := getHostAffinityPolicy(conn4, name); existing != nil {
+			return nil
+		}
+		return fmt.Errorf("failed to create VM-host affinity policy %s: %v", name, err)
+	}
+
+	task, ok := resp.GetData().(vmmConfig.TaskReference)
+	if !ok {
+		return fmt.Errorf("unexpected response while creating VM-host affinity policy %s", name)
+	}
+
+	err = waitForV4Task(conn4, utils.StringValue(task.ExtId), timeout)
+	if err != nil {
+		return fmt.Errorf("failed to create VM-host affinity policy %s: %v", name, err)
+	}
+
+	log.Infof("VM-host affinity policy %s created", name)
+	return nil
+}
+
+// RemoveFromHostAffinityPolicy takes the deleted VM out of the VM-host affinity policy of the value.
+// When no other VM is left, the policy and its VM category are deleted, and with an explicit host list,
+// the category of the hosts is unassigned from the hosts of the cluster and deleted.
+func RemoveFromHostAffinityPolicy(ctx context.Context, conn *v3.Client, conn4 *v4.Client, creds connConfig, value, clusterUUID, vmUUID string, timeout int) error {
+	name := hostAffinityPolicyName(value)
+	policy, err := getHostAffinityPolicy(conn4, name)
+	if err != nil {
+		return err
+	}
+
+	if policy == nil {
+		log.Infof("VM-host affinity policy %s not found, nothing to remove", name)
+		return nil
+	}
+
+	api := vmmApi.NewVmHostAffinityPoliciesApi(conn4.VmApiInstance.ApiClient)
+	resp, err := api.ListVmHostAffinityPolicyVmComplianceStates(policy.ExtId, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list VMs of VM-host affinity policy %s: %v", name, err)
+	}
+
+	remaining := 0
+	if states, ok := resp.GetData().([]vmmPolicies.VmHostAffinityPolicyVmComplianceState); ok {
+		for _, state := range states {
+			if utils.StringValue(state.ExtId) != vmUUID {
+				remaining++
+			}
+		}
+	}
+
+	if remaining > 0 {
+		log.Infof("VM %s removed from VM-host affinity policy %s (%d VM(s) left)", vmUUID, name, remaining)
+		return nil
+	}
+
+	log.Infof("VM-host affinity policy %s is empty, deleting it", name)
+	deleteResp, err := api.DeleteVmHostAffinityPolicyById(policy.ExtId)
+	if err != nil {
+		return fmt.Errorf("failed to delete VM-host affinity policy %s: %v", name, err)
+	}
+
+	task, ok := deleteResp.GetData().(vmmConfig.TaskReference)
+	if !ok {
+		return fmt.Errorf("unexpected response while deleting VM-host affinity policy %s", name)
+	}
+
+	err = waitForV4Task(conn4, utils.StringValue(task.ExtId), timeout)
+	if err != nil {
+		return fmt.Errorf("failed to delete VM-host affinity policy %s: %v", name, err)
+	}
+
+	deleteCategory(conn4, hostAffinityCategoryKey, value)
+
+	hostCategoryExtID, err := getCategory(conn4, hostAffinityHostCategoryKey, value)
+	if err != nil || hostCategoryExtID == "" {
+		return err
+	}
+
+	hosts, err := GetHostsForPE(ctx, conn, clusterUUID)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		err = removeHostCategory(ctx, conn, creds, host, hostAffinityHostCategoryKey, value, timeout)
+		if err != nil {
+			return fmt.Errorf("failed to untag host %s: %v", host.Status.Name, err)
+		}
+	}
+
+	deleteCategory(conn4, hostAffinityHostCategoryKey, value)
+	return nil
+}
+
+// getHostAffinityPolicy retrieves the VM-host affinity policy with the exact name, or nil if it is not found
+func getHostAffinityPolicy(conn *v4.Client, name string) (*vmmPolicies.VmHostAffinityPolicy, error) {
+	filter := fmt.Sprintf("name eq '%s'", escapeODataString(name))
+	resp, err := vmmApi.NewVmHostAffinityPoliciesApi(conn.VmApiInstance.ApiClient).ListVmHostAffinityPolicies(nil, nil, &filter, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VM-host affinity policies: %v", err)
+	}
+
+	policies, _ := resp.GetData().([]vmmPolicies.VmHostAffinityPolicy)
+	for _, policy := range policies {
+		if utils.StringValue(policy.Name) == name {
+			return &policy, nil
+		}
+	}
+	return nil, nil
+}
+
+// hostAffinityPolicyName returns the name of the VM-host affinity policy of the value
+func hostAffinityPolicyName(value string) string {
+	return fmt.Sprintf("%s_%s", hostAffinityCategoryKey, value)
+}
+
+// addHostCategory assigns the category key:value to the host if it is not already assigned
+func addHostCategory(ctx context.Context, conn *v3.Client, creds connConfig, host *v3.HostResponse, key, value string, timeout int) error {
+	if hasCategory(host.Metadata, key, value) {
+		return nil
+	}
+
+	hostUUID := *host.Metadata.UUID
+	path := fmt.Sprintf("/hosts/%s", hostUUID)
+
+	entity := make(map[string]interface{})
+	err := getPrismEntity(ctx, creds, path, &entity)
+	if err != nil {
+		return err
+	}
+	delete(entity, "status")
+
+	metadata, _ := entity["metadata"].(map[string]interface{})
+	if metadata == nil {
+		return fmt.Errorf("host %s has no metadata", hostUUID)
+	}
+	mapping, _ := metadata["categories_mapping"].(map[string]interface{})
+	if mapping == nil {
+		mapping = make(map[string]interface{})
+	}
+	values, _ := mapping[key].([]interface{})
+	mapping[key] = append(values, value)
+	metadata["categories_mapping"] = mapping
+	metadata["use_categories_mapping"] = true
+
+	log.Infof("Assigning category %s:%s to host %s", key, value, host.Status.Name)
+
+	resp := struct {
+		Status struct {
+			ExecutionContext struct {
+				TaskUUID string `json:"task_uuid"`
+			} `json:"execution_context"`
+		} `json:"status"`
+	}{}
+	err = doPrismRequest(ctx, creds, http.MethodPut, path, entity, &resp)
+	if err != nil {
+		return err
+	}
+
+	return waitForTask(ctx, conn, resp.Status.ExecutionContext.TaskUUID, timeout)
+}
+
+// removeHostCategory unassigns the category key:value from the host if it is assigned
+func removeHostCategory(ctx context.Context, conn *v3.Client, creds connConfig, host *v3.HostResponse, key, value string, timeout int) error {
+	if !hasCategory(host.Metadata, key, value) {
+		return nil
+	}
+
+	hostUUID := *host.Metadata.UUID
+	path := fmt.Sprintf("/hosts/%s", hostUUID)
+
+	entity := make(map[string]interface{})
+	err := getPrismEntity(ctx, creds, path, &entity)
+	if err != nil {
+		return err
+	}
+	delete(entity, "status")
+
+	metadata, _ := entity["metadata"].(map[string]interface{})
+	if metadata == nil {
+		return fmt.Errorf("host %s has no metadata", hostUUID)
+	}
+	mapping, _ := metadata["categories_mapping"].(map[string]interface{})
+	values, _ := mapping[key].([]interface{})
+	kept := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == 0 {
+		delete(mapping, key)
+	} else {
+		mapping[key] = kept
+	}
+	if categories, ok := metadata["categories"].(map[string]interface{}); ok && categories[key] == value {
+		delete(categories, key)
+	}
+	metadata["use_categories_mapping"] = true
+
+	log.Infof("Unassigning category %s:%s from host %s", key, value, host.Status.Name)
+
+	resp := struct {
+		Status struct {
+			ExecutionContext struct {
+				TaskUUID string `json:"task_uuid"`
+			} `json:"execution_context"`
+		} `json:"status"`
+	}{}
+	err = doPrismRequest(ctx, creds, http.MethodPut, path, entity, &resp)
+	if err != nil {
+		return err
+	}
+
+	return waitForTask(ctx, conn, resp.Status.ExecutionContext.TaskUUID, timeout)
+}
+
+// hasCategory checks if the entity metadata holds the category key:value
+func hasCategory(metadata *v3.Metadata, key, value string) bool {
+	if metadata == nil {
+		return false
+	}
+	if metadata.Categories[key] == value {
+		return true
+	}
+	return slices.Contains(metadata.CategoriesMapping[key], value)
+}
+
+// splitCategory splits a key=value category
+func splitCategory(group string) (string, string, error) {
+	category := strings.SplitN(group, "=", 2)
+	if len(category) < 2 {
+		return "", "", fmt.Errorf("malformed group %s", group)
+	}
+	return strings.TrimSpace(category[0]), strings.TrimSpace(category[1]), nil
+}
+
+// hostAffinityValue returns a category value of 64 characters max
+func hostAffinityValue(value string) string {
+	if len(value) <= 64 && !strings.Contains(value, ",") {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	return "hosts_" + hex.EncodeToString(sum[:8])
+}
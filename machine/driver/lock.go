@@ -0,0 +1,72 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fileLock is an exclusive lock shared by the driver processes through a lock file.
+// The lock is an advisory lock of the operating system on the open file: it is released by the system when
+// its holder exits, even after a crash, so a lock is never broken by another process.
+// The lock file is kept when the lock is released, removing it would let two processes lock different files.
+type fileLock struct {
+	path string
+	file *os.File
+}
+
+// lockFile acquires the lock file, waiting up to wait for the current holder to release it.
+// It returns a fileLock pointer or an error if the lock cannot be acquired in time.
+func lockFile(path string, wait time.Duration) (*fileLock, error) {
+	deadline := time.Now().Add(wait)
+	logged := false
+
+	for {
+		lock, err := tryLockFile(path)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout waiting for lock %s", path)
+		}
+		if !logged {
+			log.Infof("Waiting for lock %s", path)
+			logged = true
+		}
+		<-time.After(time.Second)
+	}
+}
+
+// tryLockFile acquires the lock file if it is free, without waiting.
+// It returns a nil fileLock when the lock is held by another process.
+func tryLockFile(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	locked, err := lockFileHandle(f)
+	if err != nil || !locked {
+		f.Close()
+		return nil, err
+	}
+
+	// The PID of the holder is only informative
+	if f.Truncate(0) == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	return &fileLock{path: path, file: f}, nil
+}
+
+// unlock releases the lock file
+func (l *fileLock) unlock() {
+	err := unlockFileHandle(l.file)
+	if err != nil {
+		log.Warnf("Failed to release lock %s: %v", l.path, err)
+	}
+	l.file.Close()
+}
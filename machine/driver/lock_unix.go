@@ -0,0 +1,23 @@
+//go:build unix
+
+package driver
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFileHandle takes the exclusive flock of the file without waiting, it returns false when the file is locked
+func lockFileHandle(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unlockFileHandle releases the flock of the file
+func unlockFileHandle(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,124 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Log formats of the driver
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Correlation fields of the driver logs
+const (
+	logFieldMachine   = "machine"
+	logFieldOperation = "operation"
+	logFieldVM        = "vm_uuid"
+	logFieldTask      = "task_uuid"
+	logFieldPhase     = "phase"
+)
+
+// ConfigureLogging sets the format, text (default) or json, and the level, info by default, of the driver logs
+func ConfigureLogging(format, level string) error {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", logFormatText:
+		log.SetFormatter(&log.TextFormatter{})
+	case logFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	default:
+		return fmt.Errorf("log format %s is not supported (%s, %s)", format, logFormatText, logFormatJSON)
+	}
+
+	if strings.TrimSpace(level) == "" {
+		log.SetLevel(log.InfoLevel)
+		return nil
+	}
+	logLevel, err := log.ParseLevel(strings.TrimSpace(level))
+	if err != nil {
+		return err
+	}
+	log.SetLevel(logLevel)
+	return nil
+}
+
+// operationLog is the logrus hook adding the correlation fields of the current operation to the log entries
+type operationLog struct {
+	mu     sync.Mutex
+	fields log.Fields
+}
+
+// logOperation holds the correlation fields of the operation running in the driver process
+var logOperation = &operationLog{fields: log.Fields{}}
+
+func init() {
+	log.AddHook(logOperation)
+}
+
+// Levels implements logrus.Hook
+func (o *operationLog) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook, the fields of the entry take precedence
+func (o *operationLog) Fire(entry *log.Entry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for key, value := range o.fields {
+		if _, ok := entry.Data[key]; !ok {
+			entry.Data[key] = value
+		}
+	}
+	return nil
+}
+
+// set sets a correlation field, or removes it when the value is empty
+func (o *operationLog) set(key, value string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if value == "" {
+		delete(o.fields, key)
+		return
+	}
+	o.fields[key] = value
+}
+
+// beginOperation sets the correlation fields of an operation of the machine.
+// It returns the function restoring the fields of the calling operation, for the operations calling each other.
+func (d *NutanixDriver) beginOperation(operation string) func() {
+	logOperation.mu.Lock()
+	previous := logOperation.fields
+	logOperation.fields = log.Fields{}
+	logOperation.mu.Unlock()
+
+	logOperation.set(logFieldMachine, d.GetMachineName())
+	logOperation.set(logFieldOperation, operation)
+	logOperation.set(logFieldVM, d.VMId)
+
+	return func() {
+		logOperation.mu.Lock()
+		logOperation.fields = previous
+		logOperation.mu.Unlock()
+	}
+}
+
+// logPhase sets the phase of the current operation, the task of the previous phase is over
+func logPhase(phase string) {
+	logOperation.set(logFieldPhase, phase)
+	logOperation.set(logFieldTask, "")
+}
+
+// logVM sets the VM of the current operation
+func logVM(uuid string) {
+	logOperation.set(logFieldVM, uuid)
+}
+
+// logTask sets the Prism Central task awaited by the current operation
+func logTask(uuid string) {
+	logOperation.set(logFieldTask, uuid)
+}
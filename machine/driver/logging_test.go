@@ -0,0 +1,103 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// jsonLogs parses the JSON log lines of the buffer
+func jsonLogs(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestConfigureLogging(t *testing.T) {
+	buf := captureLogs(t)
+	t.Cleanup(func() { _ = ConfigureLogging("", "") })
+
+	err := ConfigureLogging("json", "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Info("hidden")
+	log.WithField("cluster", "PE1").Warn("shown")
+	entries := jsonLogs(t, buf)
+	if len(entries) != 1 || entries[0]["msg"] != "shown" || entries[0]["level"] != "warning" || entries[0]["cluster"] != "PE1" {
+		t.Errorf("unexpected logs %v", entries)
+	}
+
+	if ConfigureLogging("xml", "") == nil {
+		t.Error("expected an unsupported format error")
+	}
+	if ConfigureLogging("text", "verbose") == nil {
+		t.Error("expected an invalid level error")
+	}
+}
+
+func TestOperationLogFields(t *testing.T) {
+	buf := captureLogs(t)
+	t.Cleanup(func() { _ = ConfigureLogging("", "") })
+	err := ConfigureLogging("json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := newTestEnv(t)
+	d := env.newDriver(t, nil)
+	buf.Reset()
+	err = d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	found := false
+	for _, entry := range jsonLogs(t, buf) {
+		if entry[logFieldOperation] != "create" || entry[logFieldMachine] != d.GetMachineName() {
+			t.Fatalf("expected the create correlation fields, got %v", entry)
+		}
+		if strings.HasPrefix(entry["msg"].(string), "waiting for vm") {
+			found = true
+			if entry[logFieldPhase] != "create-vm" || entry[logFieldVM] != d.VMId || entry[logFieldTask] == nil {
+				t.Errorf("expected the VM and the task of the creation, got %v", entry)
+			}
+		}
+		if entry[logFieldPhase] == "wait-ip" && entry[logFieldTask] != nil {
+			t.Errorf("expected the task to end with its phase, got %v", entry)
+		}
+	}
+	if !found {
+		t.Fatal("expected the VM creation task to be logged")
+	}
+
+	err = d.Remove()
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	log.Info("after the operations")
+	entries := jsonLogs(t, buf)
+	for _, entry := range entries[:len(entries)-1] {
+		if entry[logFieldOperation] != "remove" || entry[logFieldVM] != d.VMId {
+			t.Errorf("expected the remove correlation fields, got %v", entry)
+		}
+	}
+	if last := entries[len(entries)-1]; last[logFieldOperation] != nil || last[logFieldMachine] != nil {
+		t.Errorf("expected the correlation fields to be cleared after the operation, got %v", last)
+	}
+}
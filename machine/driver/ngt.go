@@ -0,0 +1,96 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nutanix/docker-machine/utils"
+
+	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
+)
+
+// NGT capabilities which can be enabled on the VM
+var ngtCapabilities = []string{"VSS_SNAPSHOT", "SELF_SERVICE_RESTORE"}
+
+// ngtInstallCommands installs NGT from the mounted ISO on first boot
+var ngtInstallCommands = []string{
+	"mkdir -p /mnt/ngt",
+	"mount -o ro /dev/disk/by-label/NUTANIX_TOOLS /mnt/ngt",
+	"python3 /mnt/ngt/installer/linux/install_ngt.py",
+	"umount /mnt/ngt",
+}
+
+// buildGuestTools builds the guest tools spec enabling NGT with the provided capabilities and mounting its ISO
+func buildGuestTools(capabilities []string) *v3.GuestToolsSpec {
+	ngt := &v3.NutanixGuestToolsSpec{
+		State:         utils.StringPtr("ENABLED"),
+		IsoMountState: utils.StringPtr("MOUNTED"),
+	}
+	for _, capability := range capabilities {
+		ngt.EnabledCapabilityList = append(ngt.EnabledCapabilityList, utils.StringPtr(capability))
+	}
+
+	return &v3.GuestToolsSpec{NutanixGuestTools: ngt}
+}
+
+// buildNGTCdrom builds the empty CD-ROM the NGT ISO is mounted on.
+// Q35 VMs (Secure Boot) do not support IDE devices.
+func buildNGTCdrom(bootType string) *v3.VMDisk {
+	adapter := "IDE"
+	if bootType == "secure_boot" {
+		adapter = "SATA"
+	}
+
+	return &v3.VMDisk{
+		DeviceProperties: &v3.VMDiskDeviceProperties{
+			DeviceType: utils.StringPtr("CDROM"),
+			DiskAddress: &v3.DiskAddress{
+				AdapterType: utils.StringPtr(adapter),
+			},
+		},
+	}
+}
+
+// addNGTInstallCommands adds the NGT installation commands to the runcmd of the cloud-init userdata
+func addNGTInstallCommands(userdata []byte) ([]byte, error) {
+	t := yaml.Node{}
+	err := yaml.Unmarshal(userdata, &t)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Content) == 0 || t.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("cloud-init userdata is not a map")
+	}
+
+	rootNode := t.Content[0]
+	var runcmdNode *yaml.Node
+	for i := 0; i+1 < len(rootNode.Content); i += 2 {
+		if rootNode.Content[i].Value == "runcmd" {
+			runcmdNode = rootNode.Content[i+1]
+			break
+		}
+	}
+
+	if runcmdNode == nil {
+		runcmdNode = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		rootNode.Content = append(rootNode.Content, buildScalarNodes("runcmd")...)
+		rootNode.Content = append(rootNode.Content, runcmdNode)
+	} else if runcmdNode.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("cloud-init runcmd is not a list")
+	}
+
+	for _, command := range ngtInstallCommands {
+		runcmdNode.Content = append(runcmdNode.Content, buildScalarNodes(command)...)
+	}
+
+	out, err := yaml.Marshal(&t)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(string(out), "#cloud-config") {
+		out = append([]byte("#cloud-config\n"), out...)
+	}
+	return out, nil
+}
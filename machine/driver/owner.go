@@ -0,0 +1,139 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nutanix/docker-machine/utils"
+
+	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
+)
+
+// GetOwnerReference retrieves the Prism Central user matching the provided owner name and builds the
+// owner reference to set on the VM metadata. When a project is provided, the user must be a member of it.
+// It returns a Reference pointer or an error if the user is not found or has no access to the project.
+func GetOwnerReference(ctx context.Context, conn *v3.Client, owner string, project *v3.Project) (*v3.Reference, error) {
+	if owner == "" {
+		return nil, fmt.Errorf("owner name must be passed in order to retrieve the user")
+	}
+
+	log.Infof("Searching owner %s", owner)
+	o := &url.URL{Path: owner}
+	users, err := conn.V3.ListAllUser(ctx, fmt.Sprintf("username==%s", o.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	foundUsers := make([]*v3.UserIntentResponse, 0)
+	for _, user := range users.Entities {
+		if user == nil || user.Metadata == nil || user.Metadata.UUID == nil || user.Status == nil {
+			continue
+		}
+		for _, name := range getUserNames(user) {
+			if strings.EqualFold(name, owner) {
+				foundUsers = append(foundUsers, user)
+				break
+			}
+		}
+	}
+
+	if len(foundUsers) == 0 {
+		return nil, fmt.Errorf("owner %s not found", owner)
+	} else if len(foundUsers) > 1 {
+		return nil, fmt.Errorf("multiple users found with name %s", owner)
+	}
+
+	user := foundUsers[0]
+	log.Infof("Owner %s found with UUID: %s", owner, *user.Metadata.UUID)
+
+	if project != nil && project.Metadata != nil && project.Metadata.UUID != nil {
+		member, err := isProjectMember(ctx, conn, user, project)
+		if err != nil {
+			return nil, err
+		}
+		if !member {
+			return nil, fmt.Errorf("owner %s is not a member of project %s", owner, project.Status.Name)
+		}
+		log.Infof("Owner %s is a member of project %s", owner, project.Status.Name)
+	}
+
+	return &v3.Reference{
+		Kind: utils.StringPtr("user"),
+		UUID: user.Metadata.UUID,
+		Name: utils.StringPtr(utils.StringValue(user.Status.Name)),
+	}, nil
+}
+
+// getUserNames returns all the names a Prism Central user can be referred by
+func getUserNames(user *v3.UserIntentResponse) []string {
+	names := []string{utils.StringValue(user.Status.Name)}
+	if res := user.Status.Resources; res != nil {
+		names = append(names, utils.StringValue(res.DisplayName))
+		if res.DirectoryServiceUser != nil {
+			names = append(names, utils.StringValue(res.DirectoryServiceUser.UserPrincipalName))
+		}
+		if res.IdentityProviderUser != nil {
+			names = append(names, utils.StringValue(res.IdentityProviderUser.Username))
+		}
+	}
+	return names
+}
+
+// isProjectMember checks if the user is a member of the project, directly or through a user group of the project.
+// The members of a directory group are only known by the directory service, so a user of the directory service
+// of one of the groups of the project is considered a member; Prism Central checks the membership when it applies the ownership.
+func isProjectMember(ctx context.Context, conn *v3.Client, user *v3.UserIntentResponse, project *v3.Project) (bool, error) {
+	projectUUID := *project.Metadata.UUID
+	userUUID := *user.Metadata.UUID
+
+	if user.Status.Resources != nil {
+		for _, ref := range user.Status.Resources.ProjectsReferenceList {
+			if ref != nil && utils.StringValue(ref.UUID) == projectUUID {
+				return true, nil
+			}
+		}
+	}
+
+	if project.Spec == nil || project.Spec.Resources == nil {
+		return false, nil
+	}
+
+	for _, ref := range project.Spec.Resources.UserReferenceList {
+		if ref != nil && ref.UUID == userUUID {
+			return true, nil
+		}
+	}
+
+	directoryUUID := ""
+	if user.Status.Resources != nil && user.Status.Resources.DirectoryServiceUser != nil && user.Status.Resources.DirectoryServiceUser.DirectoryServiceReference != nil {
+		directoryUUID = utils.StringValue(user.Status.Resources.DirectoryServiceUser.DirectoryServiceReference.UUID)
+	}
+	if directoryUUID == "" {
+		return false, nil
+	}
+
+	for _, ref := range project.Spec.Resources.ExternalUserGroupReferenceList {
+		if ref == nil {
+			continue
+		}
+		group, err := conn.V3.GetUserGroup(ctx, ref.UUID)
+		if err != nil {
+			return false, fmt.Errorf("failed to retrieve user group %s of project %s: %v", ref.UUID, project.Status.Name, err)
+		}
+		if group.Status == nil || group.Status.Resources == nil || group.Status.Resources.DirectoryServiceUserGroup == nil ||
+			group.Status.Resources.DirectoryServiceUserGroup.DirectoryServiceReference == nil {
+			continue
+		}
+		if utils.StringValue(group.Status.Resources.DirectoryServiceUserGroup.DirectoryServiceReference.UUID) == directoryUUID {
+			log.Infof("User %s is a member of project %s through the user group %s", utils.StringValue(user.Status.Name), project.Status.Name,
+				utils.StringValue(group.Status.Resources.DirectoryServiceUserGroup.DistinguishedName))
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
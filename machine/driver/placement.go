@@ -0,0 +1,468 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nutanix/docker-machine/utils"
+
+	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
+)
+
+// Placement policies used to select the cluster among several candidates
+const (
+	placementFirstFit       = "first-fit"
+	placementMostFreeMemory = "most-free-memory"
+	placementFewestVMs      = "fewest-vms"
+	placementRoundRobin     = "round-robin"
+)
+
+var placementPolicies = []string{placementFirstFit, placementMostFreeMemory, placementFewestVMs, placementRoundRobin}
+
+// ClusterCandidate is a Prism Element cluster the VM can be placed on
+type ClusterCandidate struct {
+	UUID            string
+	Name            string
+	FreeMemoryBytes int64
+	PoolVMs         int
+}
+
+// clusterResources holds the resources resolved on the selected cluster
+type clusterResources struct {
+	NicList          []*v3.VMNic
+	StorageContainer string
+	GpuList          []*v3.VMGpu
+	GPURequests      []*GPURequest
+	Hosts            []*v3.HostResponse
+	AffinityHosts    []string
+}
+
+// GetClusterCandidates retrieves the Prism Element clusters matching the provided names, or the category (key=value)
+// when no name is provided.
+// It returns a slice of ClusterCandidate pointers or an error if a cluster is not found or not unique.
+func GetClusterCandidates(ctx context.Context, conn *v3.Client, names []string, category string) ([]*ClusterCandidate, error) {
+	candidates := make([]*ClusterCandidate, 0)
+
+	if len(names) == 0 {
+		key, value, err := splitCategory(category)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infof("Searching clusters with category %s", category)
+		clusters, err := conn.V3.ListAllCluster(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cluster := range clusters.Entities {
+			if cluster.Metadata == nil || cluster.Status == nil || isPrismCentral(cluster) {
+				continue
+			}
+			if hasCategory(cluster.Metadata, key, value) {
+				log.Infof("Cluster %s found with UUID: %s", cluster.Status.Name, *cluster.Metadata.UUID)
+				candidates = append(candidates, &ClusterCandidate{UUID: *cluster.Metadata.UUID, Name: cluster.Status.Name})
+			}
+		}
+
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("no cluster found with category %s", category)
+		}
+		return candidates, nil
+	}
+
+	for _, name := range names {
+		log.Infof("Searching cluster %s", name)
+
+		c := &url.URL{Path: name}
+		encodedCluster := c.String()
+		clusterFilter := fmt.Sprintf("name==%s", encodedCluster)
+
+		clusters, err := conn.V3.ListAllCluster(ctx, clusterFilter)
+		if err != nil {
+			return nil, err
+		}
+
+		foundClusters := make([]*v3.ClusterIntentResponse, 0)
+		for _, s := range clusters.Entities {
+			if s.Spec != nil && s.Spec.Name == name {
+				foundClusters = append(foundClusters, s)
+			}
+		}
+
+		if len(foundClusters) == 0 {
+			return nil, fmt.Errorf("failed to retrieve cluster %s", name)
+		} else if len(foundClusters) > 1 {
+			return nil, fmt.Errorf("more than one Cluster found with name %s", name)
+		}
+
+		log.Infof("Cluster %s found with UUID: %s", foundClusters[0].Status.Name, *foundClusters[0].Metadata.UUID)
+
+		if !slices.ContainsFunc(candidates, func(c *ClusterCandidate) bool { return c.UUID == *foundClusters[0].Metadata.UUID }) {
+			candidates = append(candidates, &ClusterCandidate{UUID: *foundClusters[0].Metadata.UUID, Name: name})
+		}
+	}
+
+	return candidates, nil
+}
+
+// RankClusterCandidates orders the candidates according to the placement policy.
+// The pool of the machine is used by the fewest-vms and round-robin policies.
+// It returns an error if the cluster statistics cannot be retrieved.
+func RankClusterCandidates(ctx context.Context, conn *v3.Client, creds connConfig, candidates []*ClusterCandidate, policy, machineName string) error {
+	switch policy {
+	case placementMostFreeMemory:
+		err := getClusterFreeMemory(ctx, creds, candidates)
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].FreeMemoryBytes > candidates[j].FreeMemoryBytes
+		})
+	case placementFewestVMs:
+		err := countPoolVMs(ctx, conn, candidates, poolName(machineName))
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].PoolVMs < candidates[j].PoolVMs
+		})
+	case placementRoundRobin:
+		// Rotate over the candidates using the number of VMs already deployed by the pool
+		err := countPoolVMs(ctx, conn, candidates, poolName(machineName))
+		if err != nil {
+			return err
+		}
+		total := 0
+		for _, candidate := range candidates {
+			total += candidate.PoolVMs
+		}
+		offset := total % len(candidates)
+		rotated := append(slices.Clone(candidates[offset:]), candidates[:offset]...)
+		copy(candidates, rotated)
+	}
+
+	order := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		order = append(order, candidate.Name)
+	}
+	log.Infof("Cluster placement order (%s): %s", policy, strings.Join(order, ", "))
+
+	return nil
+}
+
+// GetStorageContainer retrieves the UUID of the storage container matching the provided name or UUID in the cluster.
+// It returns an error if the storage container is not found in the cluster.
+func GetStorageContainer(ctx context.Context, creds connConfig, container, peUUID string) (string, error) {
+	containers, err := getGroupsAttributes(ctx, creds, "storage_container", "", "container_name", "cluster")
+	if err != nil {
+		return "", err
+	}
+
+	for containerUUID, attributes := range containers {
+		if attributes["cluster"] != peUUID {
+			continue
+		}
+		if containerUUID == container || attributes["container_name"] == container {
+			log.Infof("Storage container %s found with UUID: %s", attributes["container_name"], containerUUID)
+			return containerUUID, nil
+		}
+	}
+
+	return "", fmt.Errorf("storage container %s not found in Prism Element cluster with UUID %s", container, peUUID)
+}
+
+// getClusterFreeMemory fills the free memory of the candidates from the Prism Central cluster statistics
+func getClusterFreeMemory(ctx context.Context, creds connConfig, candidates []*ClusterCandidate) error {
+	stats, err := getGroupsAttributes(ctx, creds, "cluster", "", "memory_capacity_bytes", "hypervisor_memory_usage_ppm")
+	if err != nil {
+		return err
+	}
+
+	for _, candidate := range candidates {
+		capacity, _ := strconv.ParseInt(stats[candidate.UUID]["memory_capacity_bytes"], 10, 64)
+		usage, _ := strconv.ParseInt(stats[candidate.UUID]["hypervisor_memory_usage_ppm"], 10, 64)
+		candidate.FreeMemoryBytes = capacity - capacity/1000000*usage
+		log.Infof("Cluster %s has %d MiB of free memory", candidate.Name, candidate.FreeMemoryBytes/1024/1024)
+	}
+	return nil
+}
+
+// countPoolVMs fills the number of VMs of the pool running on each candidate
+func countPoolVMs(ctx context.Context, conn *v3.Client, candidates []*ClusterCandidate, pool string) error {
+	vms, err := conn.V3.ListAllVM(ctx, fmt.Sprintf("vm_name==%s-.*", pool))
+	if err != nil {
+		return err
+	}
+
+	for _, vm := range vms.Entities {
+		if vm.Status == nil || vm.Status.ClusterReference == nil || !strings.HasPrefix(utils.StringValue(vm.Status.Name), pool+"-") {
+			continue
+		}
+		for _, candidate := range candidates {
+			if utils.StringValue(vm.Status.ClusterReference.UUID) == candidate.UUID {
+				candidate.PoolVMs++
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		log.Infof("Cluster %s runs %d VM(s) of pool %s", candidate.Name, candidate.PoolVMs, pool)
+	}
+	return nil
+}
+
+// groupsPageSize is the number of entities requested per page of the Prism Central groups API
+const groupsPageSize = 500
+
+// groupsRequest is a request of the Prism Central groups API with the pagination fields missing from the v3 client
+type groupsRequest struct {
+	EntityType            string                         `json:"entity_type"`
+	FilterCriteria        string                         `json:"filter_criteria,omitempty"`
+	GroupMemberAttributes []*v3.GroupsRequestedAttribute `json:"group_member_attributes"`
+	GroupMemberOffset     int                            `json:"group_member_offset"`
+	GroupMemberCount      int                            `json:"group_member_count"`
+}
+
+// groupsResponse is a response of the Prism Central groups API with the pagination fields missing from the v3 client
+type groupsResponse struct {
+	FilteredEntityCount int                     `json:"filtered_entity_count"`
+	GroupResults        []*v3.GroupsGroupResult `json:"group_results"`
+}
+
+// getGroupsAttributes retrieves the attributes of the entities of the provided type with the Prism Central groups API.
+// The pages are requested until the number of filtered entities is reached.
+// It returns the first value of each attribute indexed by entity UUID.
+func getGroupsAttributes(ctx context.Context, creds connConfig, entityType, filter string, attributes ...string) (map[string]map[string]string, error) {
+	request := &groupsRequest{
+		EntityType:       entityType,
+		FilterCriteria:   filter,
+		GroupMemberCount: groupsPageSize,
+	}
+	for _, attribute := range attributes {
+		request.GroupMemberAttributes = append(request.GroupMemberAttributes, &v3.GroupsRequestedAttribute{Attribute: utils.StringPtr(attribute)})
+	}
+
+	result := make(map[string]map[string]string)
+	for {
+		resp := &groupsResponse{}
+		err := doPrismRequest(ctx, creds, http.MethodPost, "/groups", request, resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s statistics: %v", entityType, err)
+		}
+
+		count := 0
+		for _, group := range resp.GroupResults {
+			if group == nil {
+				continue
+			}
+			for _, entity := range group.EntityResults {
+				if entity == nil {
+					continue
+				}
+				count++
+				values := make(map[string]string)
+				for _, data := range entity.Data {
+					if data != nil && len(data.Values) > 0 && len(data.Values[0].Values) > 0 {
+						values[data.Name] = data.Values[0].Values[0]
+					}
+				}
+				result[entity.EntityID] = values
+			}
+		}
+
+		request.GroupMemberOffset += count
+		if count == 0 || request.GroupMemberOffset >= resp.FilteredEntityCount {
+			return result, nil
+		}
+	}
+}
+
+// isPrismCentral checks if the cluster entity is the Prism Central itself
+func isPrismCentral(cluster *v3.ClusterIntentResponse) bool {
+	if cluster.Status == nil || cluster.Status.Resources == nil || cluster.Status.Resources.Config == nil {
+		return false
+	}
+	for _, service := range cluster.Status.Resources.Config.ServiceList {
+		if utils.StringValue(service) == "PRISM_CENTRAL" {
+			return true
+		}
+	}
+	return false
+}
+
+// poolName returns the pool of the machine, its name without the trailing random suffix
+func poolName(machineName string) string {
+	if i := strings.LastIndex(machineName, "-"); i > 0 {
+		return machineName[:i]
+	}
+	return machineName
+}
+
+// resolveClusterResources resolves the subnets, the storage container, the affinity hosts and the GPUs of the VM
+// on the cluster. When several clusters are candidates, the storage container UUID is checked against the cluster.
+// It returns an error if one of the resources is not available on the cluster.
+func (d *NutanixDriver) resolveClusterResources(ctx context.Context, conn *v3.Client, creds connConfig, backend vmBackend, cluster *ClusterCandidate, projectAccess *ProjectAccess, multiCluster bool) (*clusterResources, error) {
+	clusterRes := &clusterResources{}
+
+	// Search target subnet
+	subnetNames := make([]string, 0)
+
+	// Add UUID subnets directly
+	for _, subnet := range d.Subnet {
+
+		if isUUID(subnet) {
+			err := checkSubnetCluster(ctx, conn, subnet, cluster)
+			if err != nil {
+				return nil, err
+			}
+
+			n := &v3.VMNic{
+				SubnetReference: utils.BuildReference(*utils.StringPtr(subnet), "subnet"),
+			}
+
+			clusterRes.NicList = append(clusterRes.NicList, n)
+			log.Infof("UUID subnet added %s", subnet)
+		} else {
+			subnetNames = append(subnetNames, subnet)
+		}
+
+	}
+
+	// Retrieve all subnets
+	subnets, err := backend.ListSubnets(ctx, subnetNames)
+	if err != nil {
+		log.Errorf("Error getting subnets: [%v]", err)
+		return nil, err
+	}
+
+	// Search for non UUID Subnets
+	for _, query := range subnetNames {
+		log.Infof("Searching subnet %s", query)
+
+		for _, subnet := range subnets {
+
+			if subnet.Name == query {
+				if subnet.Type == "OVERLAY" {
+					n := &v3.VMNic{
+						SubnetReference: utils.BuildReference(subnet.UUID, "subnet"),
+					}
+
+					clusterRes.NicList = append(clusterRes.NicList, n)
+					log.Infof("Overlay subnet %s found with UUID: %s", subnet.Name, subnet.UUID)
+					break
+				} else if subnet.Type == "VLAN" {
+
+					if subnet.ClusterUUID == cluster.UUID {
+						n := &v3.VMNic{
+							SubnetReference: utils.BuildReference(subnet.UUID, "subnet"),
+						}
+
+						clusterRes.NicList = append(clusterRes.NicList, n)
+						log.Infof("VLAN subnet %s found with UUID: %s", subnet.Name, subnet.UUID)
+						break
+					}
+				}
+			}
+
+		}
+	}
+
+	if len(clusterRes.NicList) < 1 {
+		log.Errorf("Network %s not found in cluster %s", d.Subnet, cluster.Name)
+		return nil, fmt.Errorf("network %s not found in cluster %s", d.Subnet, cluster.Name)
+	}
+
+	for _, nic := range clusterRes.NicList {
+		err = projectAccess.ValidateSubnet(*nic.SubnetReference.UUID)
+		if err != nil {
+			log.Errorf("Error validating subnet: [%v]", err)
+			return nil, err
+		}
+	}
+
+	// Search storage container of the additional disk
+	if len(d.StorageContainer) != 0 && d.DiskSize > 0 {
+		if isUUID(d.StorageContainer) && !multiCluster {
+			clusterRes.StorageContainer = d.StorageContainer
+		} else {
+			clusterRes.StorageContainer, err = GetStorageContainer(ctx, creds, d.StorageContainer, cluster.UUID)
+			if err != nil {
+				log.Errorf("Error getting storage container: [%v]", err)
+				return nil, err
+			}
+		}
+	}
+
+	// Search hosts for VM-host affinity
+	if d.HostCategory != "" || len(d.Hosts) != 0 {
+		clusterRes.Hosts, err = GetAffinityHosts(ctx, conn, cluster.UUID, d.HostCategory, d.Hosts)
+		if err != nil {
+			log.Errorf("Error searching affinity hosts: [%v]", err)
+			return nil, err
+		}
+
+		for _, host := range clusterRes.Hosts {
+			clusterRes.AffinityHosts = append(clusterRes.AffinityHosts, *host.Metadata.UUID)
+		}
+	}
+
+	// Search GPU devices
+	if len(d.GPUs) > 0 {
+		clusterRes.GPURequests, err = ParseGPURequests(d.GPUs)
+		if err != nil {
+			return nil, err
+		}
+
+		clusterRes.GpuList, err = GetGPUList(ctx, conn, clusterRes.GPURequests, cluster.UUID, clusterRes.AffinityHosts)
+		if err != nil {
+			log.Errorf("failed to get the GPU list to create the VM %s. %v", d.GetMachineName(), err)
+			return nil, err
+		}
+	}
+
+	return clusterRes, nil
+}
+
+// clusterNames returns the names of the candidate clusters provided in nutanix-cluster
+func (d *NutanixDriver) clusterNames() []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(d.Cluster, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// clusterSelector describes the candidate clusters for the logs
+func (d *NutanixDriver) clusterSelector() string {
+	if d.ClusterCategory != "" {
+		return fmt.Sprintf("clusters with category %s", d.ClusterCategory)
+	}
+	return fmt.Sprintf("clusters %s", d.Cluster)
+}
+
+// checkSubnetCluster checks that the subnet with the UUID can be attached to a VM of the cluster:
+// an overlay subnet spans the clusters, a VLAN subnet belongs to a single cluster.
+func checkSubnetCluster(ctx context.Context, conn *v3.Client, subnetUUID string, cluster *ClusterCandidate) error {
+	subnet, err := conn.V3.GetSubnet(ctx, subnetUUID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve subnet %s: %v", subnetUUID, err)
+	}
+	if subnet.Spec == nil || subnet.Spec.Resources == nil || utils.StringValue(subnet.Spec.Resources.SubnetType) == "OVERLAY" {
+		return nil
+	}
+	if subnet.Spec.ClusterReference != nil && utils.StringValue(subnet.Spec.ClusterReference.UUID) != cluster.UUID {
+		return fmt.Errorf("subnet %s is not attached to cluster %s", subnetUUID, cluster.Name)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/nutanix/docker-machine/utils"
+
+	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
+)
+
+// projectReference is a reference returned by the projects_internal and environments APIs
+type projectReference struct {
+	Kind string `json:"kind,omitempty"`
+	UUID string `json:"uuid,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// projectInternal is the subset of the projects_internal API response used to validate resources
+type projectInternal struct {
+	Spec struct {
+		ProjectDetail struct {
+			Resources struct {
+				ClusterReferenceList     []*projectReference `json:"cluster_reference_list,omitempty"`
+				SubnetReferenceList      []*projectReference `json:"subnet_reference_list,omitempty"`
+				ExternalNetworkList      []*projectReference `json:"external_network_list,omitempty"`
+				EnvironmentReferenceList []*projectReference `json:"environment_reference_list,omitempty"`
+			} `json:"resources"`
+		} `json:"project_detail"`
+	} `json:"spec"`
+}
+
+// projectEnvironment is the subset of the environments API response used to list the allowed images
+type projectEnvironment struct {
+	Spec struct {
+		Resources struct {
+			SubstrateDefinitionList []struct {
+				CreateSpec struct {
+					Resources struct {
+						DiskList []struct {
+							DataSourceReference *projectReference `json:"data_source_reference,omitempty"`
+						} `json:"disk_list,omitempty"`
+					} `json:"resources"`
+				} `json:"create_spec"`
+			} `json:"substrate_definition_list,omitempty"`
+		} `json:"resources"`
+	} `json:"spec"`
+}
+
+// ProjectAccess lists the resources a project gives access to.
+// An empty list means the project does not restrict this kind of resource.
+type ProjectAccess struct {
+	Name     string
+	Clusters map[string]bool
+	Subnets  map[string]bool
+	Images   map[string]bool
+}
+
+// GetProject retrieves the project matching the provided name.
+// It returns a Project pointer or an error if the project is not found or not unique.
+func GetProject(ctx context.Context, conn *v3.Client, name string) (*v3.Project, error) {
+	projectFilter := fmt.Sprintf("name==%s", name)
+	projects, err := conn.V3.ListAllProject(ctx, projectFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(projects.Entities) == 0 {
+		log.Infof("Project %s not found", name)
+		return nil, fmt.Errorf("project %s not found", name)
+	} else if len(projects.Entities) > 1 {
+		log.Infof("Multiple projects found with name %s", name)
+		return nil, fmt.Errorf("multiple projects found with name %s", name)
+	}
+
+	return projects.Entities[0], nil
+}
+
+// GetUserDefaultProject retrieves the default project of the user calling Prism Central: its only project,
+// or its project named default when it is a member of several projects.
+// It returns a Project pointer or an error if the user or its default project cannot be resolved.
+func GetUserDefaultProject(ctx context.Context, conn *v3.Client) (*v3.Project, error) {
+	user, err := conn.V3.GetCurrentLoggedInUser(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the current user: %v", err)
+	}
+	if user == nil || user.Status == nil || user.Status.Resources == nil {
+		return nil, fmt.Errorf("current user has no project")
+	}
+
+	var selected *v3.Reference
+	refs := make([]*v3.Reference, 0)
+	for _, ref := range user.Status.Resources.ProjectsReferenceList {
+		if ref != nil && ref.UUID != nil {
+			refs = append(refs, ref)
+		}
+	}
+	switch {
+	case len(refs) == 0:
+		return nil, fmt.Errorf("current user %s is not a member of any project", utils.StringValue(user.Status.Name))
+	case len(refs) == 1:
+		selected = refs[0]
+	default:
+		for _, ref := range refs {
+			if utils.StringValue(ref.Name) == "default" {
+				selected = ref
+			}
+		}
+		if selected == nil {
+			return nil, fmt.Errorf("current user %s is a member of %d projects and none is named default", utils.StringValue(user.Status.Name), len(refs))
+		}
+	}
+
+	project, err := conn.V3.GetProject(ctx, *selected.UUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read project %s: %v", *selected.UUID, err)
+	}
+	return project, nil
+}
+
+// GetProjectAccess retrieves the clusters, subnets and images allowed in the project.
+// Images are read from the environments attached to the project.
+// It returns a ProjectAccess pointer or an error if any issues occur during the retrieval.
+func GetProjectAccess(ctx context.Context, creds connConfig, project *v3.Project) (*ProjectAccess, error) {
+	access := &ProjectAccess{
+		Name:     project.Status.Name,
+		Clusters: make(map[string]bool),
+		Subnets:  make(map[string]bool),
+		Images:   make(map[string]bool),
+	}
+
+	details := &projectInternal{}
+	err := getPrismEntity(ctx, creds, fmt.Sprintf("/projects_internal/%s", *project.Metadata.UUID), details)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resources of project %s: %v", access.Name, err)
+	}
+
+	resources := details.Spec.ProjectDetail.Resources
+	addReferences(access.Clusters, resources.ClusterReferenceList)
+	addReferences(access.Subnets, resources.SubnetReferenceList)
+	addReferences(access.Subnets, resources.ExternalNetworkList)
+
+	for _, envRef := range resources.EnvironmentReferenceList {
+		if envRef == nil || envRef.UUID == "" {
+			continue
+		}
+
+		env := &projectEnvironment{}
+		err := getPrismEntity(ctx, creds, fmt.Sprintf("/environments/%s", envRef.UUID), env)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read environment %s of project %s: %v", envRef.UUID, access.Name, err)
+		}
+
+		for _, substrate := range env.Spec.Resources.SubstrateDefinitionList {
+			for _, disk := range substrate.CreateSpec.Resources.DiskList {
+				if disk.DataSourceReference != nil && disk.DataSourceReference.Kind == "image" {
+					access.Images[disk.DataSourceReference.UUID] = true
+				}
+			}
+		}
+	}
+
+	log.Infof("Project %s allows %d cluster(s), %d subnet(s) and %d image(s)", access.Name, len(access.Clusters), len(access.Subnets), len(access.Images))
+
+	return access, nil
+}
+
+// ValidateCluster checks the cluster is allowed in the project
+func (p *ProjectAccess) ValidateCluster(uuid, name string) error {
+	if len(p.Clusters) != 0 && !p.Clusters[uuid] {
+		return fmt.Errorf("cluster %s (%s) is not allowed in project %s", name, uuid, p.Name)
+	}
+	return nil
+}
+
+// ValidateSubnet checks the subnet is allowed in the project
+func (p *ProjectAccess) ValidateSubnet(uuid string) error {
+	if len(p.Subnets) != 0 && !p.Subnets[uuid] {
+		return fmt.Errorf("subnet %s is not allowed in project %s", uuid, p.Name)
+	}
+	return nil
+}
+
+// ValidateImage checks the image is allowed by the environments of the project
+func (p *ProjectAccess) ValidateImage(uuid, name string) error {
+	if len(p.Images) != 0 && !p.Images[uuid] {
+		return fmt.Errorf("image %s (%s) is not allowed by the environments of project %s", name, uuid, p.Name)
+	}
+	return nil
+}
+
+func addReferences(set map[string]bool, refs []*projectReference) {
+	for _, ref := range refs {
+		if ref != nil && ref.UUID != "" {
+			set[ref.UUID] = true
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+var proxySchemes = []string{"http", "https", "socks5"}
+
+// resolveProxy returns the proxy used to reach Prism Central, or an empty string for a direct connection.
+// The proxy URL and the no-proxy list default to the HTTPS_PROXY and NO_PROXY environment variables.
+// The username and password, when set, replace the credentials of the proxy URL, they require a proxy URL.
+func resolveProxy(endpoint, port, proxyURL, noProxy, username, password string) (string, error) {
+	config := httpproxy.FromEnvironment()
+	if proxyURL != "" {
+		config.HTTPSProxy = proxyURL
+	}
+	if noProxy != "" {
+		config.NoProxy = noProxy
+	}
+	if config.HTTPSProxy == "" {
+		if username != "" {
+			return "", errors.New("nutanix-proxy-username requires a proxy, set nutanix-proxy-url or HTTPS_PROXY")
+		}
+		return "", nil
+	}
+
+	target := &url.URL{Scheme: "https", Host: net.JoinHostPort(endpoint, port)}
+	proxy, err := config.ProxyFunc()(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid proxy %s: %v", config.HTTPSProxy, err)
+	}
+	if proxy == nil {
+		return "", nil
+	}
+	if !slices.Contains(proxySchemes, proxy.Scheme) {
+		return "", fmt.Errorf("unsupported proxy scheme %s", proxy.Scheme)
+	}
+	if username != "" {
+		proxy.User = url.UserPassword(username, password)
+	}
+	return proxy.String(), nil
+}
@@ -0,0 +1,274 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// redactedValue replaces the secrets in the logs
+const redactedValue = "********"
+
+// minRedactedSecretLength is the length under which a credential is too common to be masked everywhere in the logs
+const minRedactedSecretLength = 4
+
+// defaultRedactPatterns are the patterns masked in every log entry and HTTP trace.
+// When a pattern has capturing groups, only the groups are masked.
+var defaultRedactPatterns = []string{
+	// key: value and key=value secrets, from cloud-init, JSON bodies or command lines
+	`(?i)(?:passw(?:or)?d|secret|token|api[_-]?key|private[_-]?key)["']?\s*[:=]\s*["']?([^\s"',}\]]+)`,
+	// HTTP authorization headers
+	`(?i)authorization:\s*(?:basic|bearer)?\s*(\S+)`,
+	`(?i)x-ntnx-api-key:\s*(\S+)`,
+	// session cookies
+	`(?im)^(?:set-)?cookie:\s*(.+?)\r?$`,
+	// base64 cloud-init user data of the v3 and v4 VM specs
+	`"(?:user_data|cloudInitScript)"\s*:\s*(?:\{[^}]*?"value"\s*:\s*)?"([^"]*)"`,
+	// user:password@ in URLs
+	`://[^/\s:@]+:([^/\s@]+)@`,
+	// SSH public keys and PEM private keys
+	`(?:ssh-(?:rsa|dss|ed25519)|ecdsa-sha2-nistp\d+) (AAAA[0-9A-Za-z+/=]+)`,
+	`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`,
+}
+
+// sensitiveCloudInitKeys are the parts of the cloud-init keys whose values are masked
+var sensitiveCloudInitKeys = []string{"passw", "secret", "token", "key", "credential", "chpasswd"}
+
+// logRedactor is the logrus hook masking the secrets of the log entries before they are written
+type logRedactor struct {
+	mu         sync.RWMutex
+	patterns   []*regexp.Regexp
+	secrets    []string
+	unredacted bool
+}
+
+// logRedaction is the redactor of the driver logs, hooked to the standard logger
+var logRedaction = newLogRedactor()
+
+func init() {
+	log.AddHook(logRedaction)
+}
+
+func newLogRedactor() *logRedactor {
+	r := &logRedactor{}
+	for _, pattern := range defaultRedactPatterns {
+		r.patterns = append(r.patterns, regexp.MustCompile(pattern))
+	}
+	return r
+}
+
+// Levels implements logrus.Hook
+func (r *logRedactor) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (r *logRedactor) Fire(entry *log.Entry) error {
+	entry.Message = r.redact(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = r.redact(v)
+		case error:
+			entry.Data[key] = r.redact(v.Error())
+		}
+	}
+	return nil
+}
+
+// redact masks the registered secrets and the patterns of the text
+func (r *logRedactor) redact(text string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.unredacted {
+		return text
+	}
+
+	for _, secret := range r.secrets {
+		text = strings.ReplaceAll(text, secret, redactedValue)
+	}
+	for _, pattern := range r.patterns {
+		text = redactPattern(pattern, text)
+	}
+	return text
+}
+
+// redactPattern masks the matches of the pattern, or their groups when the pattern has groups
+func redactPattern(pattern *regexp.Regexp, text string) string {
+	matches := pattern.FindAllStringSubmatchIndex(text, -1)
+	if matches == nil {
+		return text
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, match := range matches {
+		spans := [][]int{match[:2]}
+		if len(match) > 2 {
+			spans = nil
+			for i := 2; i+1 < len(match); i += 2 {
+				if match[i] >= 0 {
+					spans = append(spans, match[i:i+2])
+				}
+			}
+		}
+		for _, span := range spans {
+			if span[0] < last {
+				continue
+			}
+			b.WriteString(text[last:span[0]])
+			b.WriteString(redactedValue)
+			last = span[1]
+		}
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// addSecrets registers credentials masked wherever they appear in the logs
+func (r *logRedactor) addSecrets(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, secret := range secrets {
+		secret = strings.TrimSpace(secret)
+		if len(secret) < minRedactedSecretLength {
+			continue
+		}
+		known := false
+		for _, s := range r.secrets {
+			known = known || s == secret
+		}
+		if !known {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+}
+
+// configure adds the patterns to the default patterns, and disables the redaction when unredacted is set
+func (r *logRedactor) configure(patterns []string, unredacted bool) error {
+	compiled, err := compileRedactPatterns(patterns)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.patterns = r.patterns[:len(defaultRedactPatterns)]
+	r.patterns = append(r.patterns, compiled...)
+	r.unredacted = unredacted
+	return nil
+}
+
+func compileRedactPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("nutanix-log-redact-patterns %q is invalid: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// setupLogRedaction configures the log redaction of the driver and registers its credentials
+func (d *NutanixDriver) setupLogRedaction(creds connConfig) error {
+	err := logRedaction.configure(d.LogRedactPatterns, d.UnredactedLogs)
+	if err != nil {
+		return err
+	}
+
+	secrets := []string{d.Password, d.SSHPass, d.APIKey, creds.Password, creds.APIKey}
+	if u, err := url.Parse(creds.ProxyURL); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		secrets = append(secrets, password)
+	}
+	logRedaction.addSecrets(secrets...)
+	return nil
+}
+
+// redactCloudInit masks the values of the sensitive keys of a cloud-init user data, like the passwords,
+// the tokens, the SSH keys and the content of the written files.
+// The user data is returned as is when the redaction is disabled.
+func redactCloudInit(userdata string) string {
+	logRedaction.mu.RLock()
+	unredacted := logRedaction.unredacted
+	logRedaction.mu.RUnlock()
+	if unredacted {
+		return userdata
+	}
+
+	var document yaml.Node
+	err := yaml.Unmarshal([]byte(userdata), &document)
+	if err != nil || len(document.Content) == 0 {
+		// The log hook still masks the patterns of an unparsable user data
+		return userdata
+	}
+	redactCloudInitNode(&document, "")
+
+	redacted, err := yaml.Marshal(&document)
+	if err != nil {
+		return userdata
+	}
+	return "#cloud-config\n" + strings.TrimPrefix(string(redacted), "#cloud-config\n")
+}
+
+// redactCloudInitNode masks the scalar values of the sensitive keys under the node, parent is the key of the node
+func redactCloudInitNode(node *yaml.Node, parent string) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if isSensitiveCloudInitKey(parent) {
+			node.Value = redactedValue
+			node.Style = 0
+			node.Tag = "!!str"
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if isSensitiveCloudInitKey(parent) || parent == "write_files" && key == "content" {
+				// Everything under a sensitive key is sensitive, like the written files
+				key = "secret"
+			}
+			redactCloudInitNode(node.Content[i+1], key)
+		}
+	default:
+		for _, child := range node.Content {
+			redactCloudInitNode(child, parent)
+		}
+	}
+}
+
+func isSensitiveCloudInitKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveCloudInitKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// sshKeyFingerprint returns the SHA-256 fingerprint of an authorized key, as printed by ssh-keygen -l
+func sshKeyFingerprint(authorizedKey string) string {
+	fields := strings.Fields(authorizedKey)
+	if len(fields) < 2 {
+		return redactedValue
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return redactedValue
+	}
+	sum := sha256.Sum256(blob)
+	return fields[0] + " SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,166 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Default retry policy of the Prism Central API calls
+const (
+	defaultAPIRetries      = 5
+	defaultAPIRetryMaxWait = 30
+)
+
+// apiRetriesDisabled is the persisted number of retries of the machines created with nutanix-api-retries set to 0.
+// A persisted 0 is the value of the machines created before the retry policy, which get the default policy.
+const apiRetriesDisabled = -1
+
+// apiRetryBaseWait is the wait before the first retry, doubled on each retry
+var apiRetryBaseWait = time.Second
+
+// retryPolicy is the retry policy of the Prism Central API calls failing with a transient error
+type retryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt, 0 disables the retries
+	MaxRetries int
+	// MaxWait caps the wait between two attempts
+	MaxWait time.Duration
+}
+
+// backoff returns the wait before the retry following the attempt (0 based).
+// The exponential backoff is jittered to spread the retries of the concurrent operations,
+// the Retry-After delay of a throttled response takes precedence.
+func (p retryPolicy) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return min(time.Duration(seconds)*time.Second, p.MaxWait)
+		}
+	}
+
+	wait := p.MaxWait
+	if attempt < 30 {
+		wait = min(apiRetryBaseWait<<attempt, p.MaxWait)
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + rand.N(wait/2+1) // #nosec G404 -- jitter only
+}
+
+// retryTransport retries the idempotent Prism Central requests failing with a transient error.
+// The other requests, a v3 VM creation for instance, are sent once: a failure does not tell whether Prism Central applied them.
+type retryTransport struct {
+	next   http.RoundTripper
+	policy retryPolicy
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := isIdempotentPrismRequest(req) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if !retryable || attempt >= t.policy.MaxRetries || !isTransientFailure(req.Context(), resp, err) {
+			return resp, err
+		}
+
+		wait := t.policy.backoff(attempt, resp)
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		log.Warnf("Transient failure of %s %s (%s), retry %d/%d in %s", req.Method, req.URL.Path, reason, attempt+1, t.policy.MaxRetries, wait.Round(time.Millisecond))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// isIdempotentPrismRequest tells whether the request can be sent again without side effect:
+// the reads, including the v3 list and groups queries sent as POST, and the v4 requests,
+// which carry an NTNX-Request-Id that Prism Central deduplicates.
+func isIdempotentPrismRequest(req *http.Request) bool {
+	if req.Header.Get("NTNX-Request-Id") != "" {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		return strings.HasSuffix(req.URL.Path, "/list") || strings.HasSuffix(req.URL.Path, "/groups")
+	}
+	return false
+}
+
+// isTransientFailure tells whether the failure of a request is worth a retry:
+// throttling, an unavailable gateway or service, a reset or refused connection and the network timeouts.
+func isTransientFailure(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err == nil {
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// apiRetryPolicy returns the retry policy of the machine, the persisted zero values getting the defaults
+func (d *NutanixDriver) apiRetryPolicy() retryPolicy {
+	retries, maxWait := d.APIRetries, d.APIRetryMaxWait
+	switch retries {
+	case apiRetriesDisabled:
+		retries = 0
+	case 0:
+		retries = defaultAPIRetries
+	}
+	if maxWait <= 0 {
+		maxWait = defaultAPIRetryMaxWait
+	}
+	return retryPolicy{MaxRetries: retries, MaxWait: time.Duration(maxWait) * time.Second}
+}
+
+// validateRetryPolicy checks the retry flags
+func validateRetryPolicy(retries, maxWait int) error {
+	if retries < 0 {
+		return fmt.Errorf("nutanix-api-retries must be positive")
+	}
+	if retries > 0 && maxWait < 1 {
+		return fmt.Errorf("nutanix-api-retry-max-wait must be at least 1 second")
+	}
+	return nil
+}
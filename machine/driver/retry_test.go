@@ -0,0 +1,172 @@
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	policy := retryPolicy{MaxRetries: 5, MaxWait: 10 * time.Second}
+
+	for attempt := 0; attempt < 8; attempt++ {
+		ceiling := min(time.Second<<attempt, policy.MaxWait)
+		for i := 0; i < 20; i++ {
+			wait := policy.backoff(attempt, nil)
+			if wait < ceiling/2 || wait > ceiling {
+				t.Fatalf("attempt %d: wait %s out of [%s, %s]", attempt, wait, ceiling/2, ceiling)
+			}
+		}
+	}
+
+	throttled := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	throttled.Header.Set("Retry-After", strconv.Itoa(3))
+	if wait := policy.backoff(0, throttled); wait != 3*time.Second {
+		t.Errorf("expected the Retry-After delay, got %s", wait)
+	}
+	throttled.Header.Set("Retry-After", strconv.Itoa(120))
+	if wait := policy.backoff(0, throttled); wait != policy.MaxWait {
+		t.Errorf("expected the Retry-After delay capped to %s, got %s", policy.MaxWait, wait)
+	}
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	apiRetryBaseWait = 10 * time.Millisecond
+	t.Cleanup(func() { apiRetryBaseWait = time.Second })
+
+	env := newTestEnv(t)
+	d := env.newDriver(t, testFlags{"nutanix-api-retries": 3, "nutanix-api-retry-max-wait": 1})
+
+	// Reads and task polls are retried
+	env.sim.injectFaults(http.MethodPost, "/api/nutanix/v3/clusters/list", http.StatusServiceUnavailable, 0, http.StatusTooManyRequests)
+	env.sim.injectFaults(http.MethodGet, "/api/nutanix/v3/tasks/", http.StatusBadGateway, http.StatusGatewayTimeout)
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	assertState(t, d, state.Running)
+	if count := env.sim.requestCount(http.MethodPost, "/api/nutanix/v3/clusters/list"); count < 4 {
+		t.Errorf("expected the cluster list to be retried, got %d requests", count)
+	}
+
+	// The retries are bounded
+	env.sim.injectFaults(http.MethodGet, "/api/nutanix/v3/vms/", http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	_, err = d.GetState()
+	if err == nil {
+		t.Fatal("expected GetState to fail once the retries are exhausted")
+	}
+	assertState(t, d, state.Running)
+}
+
+func TestRetryNeverCreatesTwice(t *testing.T) {
+	apiRetryBaseWait = 10 * time.Millisecond
+	t.Cleanup(func() { apiRetryBaseWait = time.Second })
+
+	for _, status := range []int{http.StatusServiceUnavailable, 0} {
+		env := newTestEnv(t)
+		d := env.newDriver(t, testFlags{"nutanix-api-retries": 3, "nutanix-api-retry-max-wait": 1})
+
+		env.sim.injectFaults(http.MethodPost, "/api/nutanix/v3/vms", status)
+		err := d.Create()
+		if err == nil {
+			t.Fatalf("status %d: expected the creation to fail", status)
+		}
+		if count := env.sim.requestCount(http.MethodPost, "/api/nutanix/v3/vms"); count != 1 {
+			t.Errorf("status %d: expected a single creation request, got %d", status, count)
+		}
+	}
+}
+
+func TestRetryDisabled(t *testing.T) {
+	env := newTestEnv(t)
+	d := env.newDriver(t, testFlags{"nutanix-api-retries": 0})
+
+	env.sim.injectFaults(http.MethodPost, "/api/nutanix/v3/clusters/list", http.StatusServiceUnavailable)
+	err := d.Create()
+	if err == nil {
+		t.Fatal("expected the creation to fail without retries")
+	}
+	if count := env.sim.requestCount(http.MethodPost, "/api/nutanix/v3/clusters/list"); count != 1 {
+		t.Errorf("expected a single cluster list request, got %d", count)
+	}
+}
+
+func TestAPIRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		maxWait  int
+		expected retryPolicy
+	}{
+		{"configured", 3, 10, retryPolicy{MaxRetries: 3, MaxWait: 10 * time.Second}},
+		{"disabled", apiRetriesDisabled, 0, retryPolicy{MaxRetries: 0, MaxWait: defaultAPIRetryMaxWait * time.Second}},
+		{"persisted before the retries", 0, 0, retryPolicy{MaxRetries: defaultAPIRetries, MaxWait: defaultAPIRetryMaxWait * time.Second}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDriver("pool1-abcde", t.TempDir())
+			d.APIRetries, d.APIRetryMaxWait = tt.retries, tt.maxWait
+			if policy := d.apiRetryPolicy(); policy != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, policy)
+			}
+		})
+	}
+
+	// A machine created with the retries disabled keeps them disabled once reloaded
+	env := newTestEnv(t)
+	d := env.newDriver(t, testFlags{"nutanix-api-retries": 0})
+	config, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewDriver("", "")
+	err = json.Unmarshal(config, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy := loaded.apiRetryPolicy(); policy.MaxRetries != 0 {
+		t.Errorf("expected the retries to stay disabled, got %+v", policy)
+	}
+}
+
+func TestRetryV4Client(t *testing.T) {
+	apiRetryBaseWait = 10 * time.Millisecond
+	t.Cleanup(func() { apiRetryBaseWait = time.Second })
+
+	env := newTestEnv(t)
+	d := env.newDriver(t, testFlags{"nutanix-api-retries": 2, "nutanix-api-retry-max-wait": 1})
+	creds, err := d.prismCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := creds.newV4Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.sim.injectFaults(http.MethodGet, "/api/vmm/", http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	limit := 1
+	_, _ = conn.VmApiInstance.ListVms(nil, &limit, nil, nil, nil)
+	if count := env.sim.requestCount(http.MethodGet, "/api/vmm/v4.2/ahv/config/vms"); count != 3 {
+		t.Errorf("expected the v4 read to be retried twice, got %d requests", count)
+	}
+
+	// The v4 creation is retried too, with its NTNX-Request-Id
+	env.sim.injectFaults(http.MethodPost, "/api/vmm/v4.2/ahv/config/vms", http.StatusServiceUnavailable)
+	d = env.newDriver(t, testFlags{"nutanix-api-version": apiVersionV4, "nutanix-api-retries": 2, "nutanix-api-retry-max-wait": 1})
+	err = d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if count := env.sim.requestCount(http.MethodPost, "/api/vmm/v4.2/ahv/config/vms"); count != 2 {
+		t.Errorf("expected the v4 creation to be retried once, got %d requests", count)
+	}
+	if len(env.sim.vms) != 1 {
+		t.Errorf("expected a single VM, got %d", len(env.sim.vms))
+	}
+}
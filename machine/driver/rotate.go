@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// RotateCredentialsCommand is the command of the driver binary rewriting the credentials of the machines of a store
+const RotateCredentialsCommand = "rotate-credentials"
+
+// RotateCredentials rewrites the Prism Central credentials stored in the Nutanix machines of a docker-machine store.
+// The machines using a credentials source or an API key file are skipped, their credentials are not stored.
+// The secrets are encrypted when a secrets key is configured.
+func RotateCredentials(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet(RotateCredentialsCommand, flag.ContinueOnError)
+	flags.SetOutput(out)
+	storagePath := flags.String("storage-path", defaultStoragePath(), "docker-machine store (default: $MACHINE_STORAGE_PATH or ~/.docker/machine)")
+	endpoint := flags.String("endpoint", "", "only rotate the machines of this Prism Central endpoint")
+	username := flags.String("username", os.Getenv("NUTANIX_USERNAME"), "new username (default: $NUTANIX_USERNAME)")
+	password := flags.String("password", "", "new password (default: $NUTANIX_PASSWORD)")
+	apiKey := flags.String("api-key", "", "new service account API key, replacing the username and password (default: $NUTANIX_API_KEY)")
+	dryRun := flags.Bool("dry-run", false, "list the machines to rotate without rewriting them")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if explicit["api-key"] && (explicit["username"] || explicit["password"]) {
+		return errors.New("the API key and the username and password are mutually exclusive")
+	}
+
+	// The secrets are preferably taken from the environment, to keep them out of the process list.
+	// An explicit flag selects its kind of credentials, the environment of the other kind is ignored.
+	// From the environment only, the API key replaces the username and password.
+	switch {
+	case explicit["username"] || explicit["password"]:
+		if *password == "" {
+			*password = os.Getenv("NUTANIX_PASSWORD")
+		}
+	case explicit["api-key"]:
+		*username = ""
+	default:
+		*apiKey = os.Getenv("NUTANIX_API_KEY")
+		if *apiKey != "" {
+			*username = ""
+		} else {
+			*password = os.Getenv("NUTANIX_PASSWORD")
+		}
+	}
+	if *apiKey == "" && (*username == "" || *password == "") {
+		return errors.New("a username and a password, or an API key, are required")
+	}
+
+	machinesDir := filepath.Join(*storagePath, "machines")
+	entries, err := os.ReadDir(machinesDir)
+	if err != nil {
+		return fmt.Errorf("failed to list the machines of %s: %v", *storagePath, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var failed []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		status, err := rotateMachineCredentials(filepath.Join(machinesDir, name, "config.json"), *endpoint, *username, *password, *apiKey, *dryRun)
+		if err != nil {
+			fmt.Fprintf(out, "%s: %v\n", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		if status != "" {
+			fmt.Fprintf(out, "%s: %s\n", name, status)
+		}
+	}
+
+	if len(failed) != 0 {
+		return fmt.Errorf("failed to rotate the credentials of %d machine(s)", len(failed))
+	}
+	return nil
+}
+
+// rotateMachineCredentials rewrites the credentials of a machine config and returns the outcome,
+// or an empty string for the machines of other drivers
+func rotateMachineCredentials(path, endpoint, username, password, apiKey string, dryRun bool) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	host := map[string]json.RawMessage{}
+	err = json.Unmarshal(content, &host)
+	if err != nil {
+		return "", fmt.Errorf("invalid machine config: %v", err)
+	}
+	var driverName string
+	_ = json.Unmarshal(host["DriverName"], &driverName)
+	if driverName != "nutanix" {
+		return "", nil
+	}
+
+	d := NewDriver("", "")
+	err = json.Unmarshal(host["Driver"], d)
+	if err != nil {
+		return "", err
+	}
+	if endpoint != "" && d.Endpoint != endpoint {
+		return fmt.Sprintf("skipped, endpoint %s", d.Endpoint), nil
+	}
+	if d.CredentialsSource != "" || d.APIKeyFile != "" {
+		return "skipped, credentials read from an external source", nil
+	}
+	if dryRun {
+		return fmt.Sprintf("to rotate, endpoint %s", d.Endpoint), nil
+	}
+
+	d.Username, d.Password, d.APIKey = username, password, apiKey
+	if apiKey != "" {
+		d.Username, d.Password = "", ""
+	}
+	host["Driver"], err = json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	content, err = json.MarshalIndent(host, "", "    ")
+	if err != nil {
+		return "", err
+	}
+
+	// Replace the config atomically, a partial write would lose the machine
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return "rotated", nil
+}
+
+// defaultStoragePath returns the default docker-machine store
+func defaultStoragePath() string {
+	if path := os.Getenv("MACHINE_STORAGE_PATH"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "machine")
+}
@@ -0,0 +1,127 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestMachine writes a machine config in the docker-machine store layout
+func writeTestMachine(t *testing.T, storePath, name, driverName string, driver interface{}) string {
+	t.Helper()
+
+	dir := filepath.Join(storePath, "machines", name)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"ConfigVersion": 3,
+		"Driver":        driver,
+		"DriverName":    driverName,
+		"HostOptions":   map[string]interface{}{"Driver": ""},
+		"Name":          name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestFile(t, filepath.Join(dir, "config.json"), string(config), 0600)
+}
+
+func loadTestMachine(t *testing.T, path string) (*NutanixDriver, map[string]json.RawMessage) {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := map[string]json.RawMessage{}
+	err = json.Unmarshal(content, &host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDriver("", "")
+	err = json.Unmarshal(host["Driver"], d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, host
+}
+
+func TestRotateCredentials(t *testing.T) {
+	t.Setenv(secretsKeyEnv, "0123456789abcdef")
+	t.Setenv(secretsKeyFileEnv, "")
+	t.Setenv("NUTANIX_PASSWORD", "new-password")
+	t.Setenv("NUTANIX_API_KEY", "")
+
+	store := t.TempDir()
+	machine := func(name, endpoint string) *NutanixDriver {
+		d := NewDriver(name, store)
+		d.Endpoint, d.Username, d.Password, d.VMId = endpoint, "admin", "old-password", "vm-"+name
+		return d
+	}
+	pool1 := writeTestMachine(t, store, "pool1-a", "nutanix", machine("pool1-a", "pc1.example.com"))
+	pool2 := writeTestMachine(t, store, "pool2-a", "nutanix", machine("pool2-a", "pc2.example.com"))
+	external := machine("pool1-b", "pc1.example.com")
+	external.Username, external.Password, external.CredentialsSource = "", "", "netrc:"
+	externalPath := writeTestMachine(t, store, "pool1-b", "nutanix", external)
+	other := writeTestMachine(t, store, "other", "virtualbox", map[string]string{"Password": "old-password"})
+
+	var out bytes.Buffer
+	err := RotateCredentials([]string{"--storage-path", store, "--endpoint", "pc1.example.com", "--username", "svc-rancher"}, &out)
+	if err != nil {
+		t.Fatalf("RotateCredentials: %v\n%s", err, out.String())
+	}
+
+	d, host := loadTestMachine(t, pool1)
+	if d.Username != "svc-rancher" || d.Password != "new-password" || d.VMId != "vm-pool1-a" {
+		t.Errorf("unexpected rotated machine %s/%s %s", d.Username, d.Password, d.VMId)
+	}
+	if string(host["DriverName"]) != `"nutanix"` || string(host["Name"]) != `"pool1-a"` || host["HostOptions"] == nil {
+		t.Errorf("the host config must be kept: %v", host)
+	}
+	if !strings.Contains(string(host["Driver"]), encryptedSecretPrefix) {
+		t.Errorf("expected the rotated password to be encrypted")
+	}
+
+	d, _ = loadTestMachine(t, pool2)
+	if d.Password != "old-password" {
+		t.Errorf("the machine of another endpoint must not be rotated")
+	}
+	d, _ = loadTestMachine(t, externalPath)
+	if d.Username != "" || d.Password != "" {
+		t.Errorf("the machine with a credentials source must not be rotated")
+	}
+	content, _ := os.ReadFile(other)
+	if !strings.Contains(string(content), "old-password") {
+		t.Errorf("the machine of another driver must not be rotated")
+	}
+	for _, expected := range []string{"pool1-a: rotated", "pool1-b: skipped", "pool2-a: skipped"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in the output:\n%s", expected, out.String())
+		}
+	}
+
+	err = RotateCredentials([]string{"--storage-path", store, "--username", ""}, &out)
+	if err == nil {
+		t.Error("expected an error without username")
+	}
+
+	// An explicit API key ignores the password of the environment
+	err = RotateCredentials([]string{"--storage-path", store, "--endpoint", "pc2.example.com", "--api-key", "new-key"}, &out)
+	if err != nil {
+		t.Fatalf("RotateCredentials: %v\n%s", err, out.String())
+	}
+	d, _ = loadTestMachine(t, pool2)
+	if d.APIKey != "new-key" || d.Username != "" || d.Password != "" {
+		t.Errorf("expected the API key to replace the password, got %q/%q %q", d.Username, d.Password, d.APIKey)
+	}
+
+	err = RotateCredentials([]string{"--storage-path", store, "--api-key", "new-key", "--password", "new-password"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Errorf("expected the explicit API key and password to be mutually exclusive, got %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package driver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variables of the key encrypting the secrets persisted with the machine.
+// The key is read from the environment because libmachine loads the machine config without the driver flags.
+const (
+	secretsKeyEnv     = "NUTANIX_SECRETS_KEY"
+	secretsKeyFileEnv = "NUTANIX_SECRETS_KEY_FILE"
+)
+
+// encryptedSecretPrefix marks the secrets encrypted with AES-256-GCM in the machine config
+const encryptedSecretPrefix = "enc:v1:"
+
+// secretsKey returns the AES-256 key derived from the secrets key, or nil when no key is configured
+func secretsKey() ([]byte, error) {
+	material := os.Getenv(secretsKeyEnv)
+	if path := os.Getenv(secretsKeyFileEnv); material == "" && path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the secrets key file: %v", err)
+		}
+		material = strings.TrimSpace(string(content))
+		if material == "" {
+			return nil, fmt.Errorf("secrets key file %s is empty", path)
+		}
+	}
+	if material == "" {
+		return nil, nil
+	}
+
+	key := sha256.Sum256([]byte(material))
+	return key[:], nil
+}
+
+func encryptSecret(key []byte, plaintext string) (string, error) {
+	gcm, err := newSecretsCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(key []byte, value string) (string, error) {
+	gcm, err := newSecretsCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedSecretPrefix))
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", errors.New("malformed encrypted secret")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("unable to decrypt the secret, the secrets key does not match")
+	}
+	return string(plaintext), nil
+}
+
+func newSecretsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nutanixDriverJSON has the fields of NutanixDriver without its JSON methods
+type nutanixDriverJSON NutanixDriver
+
+// secretFields returns the fields of the driver encrypted in the machine config.
+// The proxy URL holds the proxy credentials.
+func (d *NutanixDriver) secretFields() map[string]*string {
+	return map[string]*string{
+		"Password":  &d.Password,
+		"SSHPass":   &d.SSHPass,
+		"CloudInit": &d.CloudInit,
+		"APIKey":    &d.APIKey,
+		"ClientKey": &d.ClientKey,
+		"ProxyURL":  &d.ProxyURL,
+	}
+}
+
+// MarshalJSON encrypts the secrets of the machine config when a secrets key is configured
+func (d *NutanixDriver) MarshalJSON() ([]byte, error) {
+	key, err := secretsKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return json.Marshal((*nutanixDriverJSON)(d))
+	}
+
+	encrypted := *d
+	for name, field := range encrypted.secretFields() {
+		if *field == "" {
+			continue
+		}
+		*field, err = encryptSecret(key, *field)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt %s: %v", name, err)
+		}
+	}
+	return json.Marshal((*nutanixDriverJSON)(&encrypted))
+}
+
+// checkPlaintextSecrets returns an error when a secret saved in plain text, without secrets key, starts with the
+// prefix of the encrypted secrets: it would be taken for an encrypted secret when the machine config is loaded.
+func (d *NutanixDriver) checkPlaintextSecrets() error {
+	key, err := secretsKey()
+	if err != nil || key != nil {
+		return err
+	}
+	for name, field := range d.secretFields() {
+		if strings.HasPrefix(*field, encryptedSecretPrefix) {
+			return fmt.Errorf("%s cannot start with %s without secrets key, set %s or %s", name, encryptedSecretPrefix, secretsKeyEnv, secretsKeyFileEnv)
+		}
+	}
+	return nil
+}
+
+// UnmarshalJSON decrypts the secrets of the machine config.
+// The plaintext secrets of the configs saved without secrets key are loaded as is, and encrypted on the next save.
+func (d *NutanixDriver) UnmarshalJSON(data []byte) error {
+	err := json.Unmarshal(data, (*nutanixDriverJSON)(d))
+	if err != nil {
+		return err
+	}
+
+	var key []byte
+	for name, field := range d.secretFields() {
+		if !strings.HasPrefix(*field, encryptedSecretPrefix) {
+			continue
+		}
+		if key == nil {
+			key, err = secretsKey()
+			if err != nil {
+				return err
+			}
+			if key == nil {
+				return fmt.Errorf("the machine config holds encrypted secrets, set %s or %s", secretsKeyEnv, secretsKeyFileEnv)
+			}
+		}
+		*field, err = decryptSecret(key, *field)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,672 @@
+package driver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+
+	prismConfig "github.com/nutanix/ntnx-api-golang-clients/prism-go-client/v4/models/prism/v4/config"
+	vmmAhvConfig "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/vmm/v4/ahv/config"
+	vmmPolicies "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/vmm/v4/ahv/policies"
+)
+
+const (
+	simUsername = "admin"
+	simPassword = "nutanix/4u"
+	simAPIKey   = "c2VydmljZS1hY2NvdW50LWtleQ"
+	// simHostCores is the number of physical CPU cores of the hosts
+	simHostCores = 16
+)
+
+// prismSimulator is an in-process Prism Central serving the subset of the v3 and v4 APIs used by the driver.
+// The v4 API shares the entities of the v3 API, see handleV4.
+// The tasks complete as soon as they are created.
+type prismSimulator struct {
+	server *httptest.Server
+
+	mu           sync.Mutex
+	clusters     []map[string]interface{}
+	subnets      []map[string]interface{}
+	images       []map[string]interface{}
+	projects     []map[string]interface{}
+	hosts        []map[string]interface{}
+	users        []map[string]interface{}
+	userGroups   []map[string]interface{}
+	clusterStats map[string]map[string]string
+	vms          map[string]*simVM
+	tasks        map[string]map[string]interface{}
+	requests     []string
+
+	// The v4 API state: the categories, the placement policies, the tasks,
+	// and the version of the entities updated with an ETag
+	categories           []*prismConfig.Category
+	antiAffinityPolicies map[string]*vmmPolicies.VmAntiAffinityPolicy
+	hostAffinityPolicies map[string]*vmmPolicies.VmHostAffinityPolicy
+	tasksV4              map[string]*prismConfig.Task
+	versions             map[string]int
+
+	// createErrors holds the error details of the next VM creation tasks, one per creation
+	createErrors []string
+	// ipDelay is the number of reads of a VM before it reports its IP address, -1 to never report it
+	ipDelay int
+	// faults holds the failures of the next requests matching a method and a path prefix:
+	// an HTTP status, or 0 to reset the connection
+	faults map[string][]int
+	// groupsPageSize caps the number of entities returned per page of the groups API, 0 for no cap
+	groupsPageSize int
+}
+
+// simVM is a VM of the simulator
+type simVM struct {
+	uuid       string
+	metadata   map[string]interface{}
+	spec       map[string]interface{}
+	powerState string
+	reads      int
+	ip         string
+	// v4 is the VM as created with the v4 API, nil when it was created with the v3 API
+	v4 *vmmAhvConfig.Vm
+}
+
+// newPrismSimulator starts a simulator, stopped at the end of the test.
+// With client CAs, the simulator requires a client certificate signed by one of them.
+func newPrismSimulator(t *testing.T, clientCAs ...*x509.Certificate) *prismSimulator {
+	t.Helper()
+
+	s := &prismSimulator{
+		clusterStats: make(map[string]map[string]string),
+		vms:          make(map[string]*simVM),
+		tasks:        make(map[string]map[string]interface{}),
+		faults:       make(map[string][]int),
+
+		antiAffinityPolicies: make(map[string]*vmmPolicies.VmAntiAffinityPolicy),
+		hostAffinityPolicies: make(map[string]*vmmPolicies.VmHostAffinityPolicy),
+		tasksV4:              make(map[string]*prismConfig.Task),
+		versions:             make(map[string]int),
+	}
+	s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	if len(clientCAs) != 0 {
+		pool := x509.NewCertPool()
+		for _, ca := range clientCAs {
+			pool.AddCert(ca)
+		}
+		s.server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	}
+	s.server.StartTLS()
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// endpoint returns the host and the port of the simulator
+func (s *prismSimulator) endpoint() (string, string) {
+	u, _ := url.Parse(s.server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	return host, port
+}
+
+func (s *prismSimulator) addCluster(name string, categories map[string]string) string {
+	id := uuid.NewString()
+	s.clusters = append(s.clusters, map[string]interface{}{
+		"metadata": map[string]interface{}{"kind": "cluster", "uuid": id, "categories": categories},
+		"spec":     map[string]interface{}{"name": name},
+		"status": map[string]interface{}{
+			"name":      name,
+			"resources": map[string]interface{}{"config": map[string]interface{}{"service_list": []string{"AOS"}}},
+		},
+	})
+	return id
+}
+
+func (s *prismSimulator) addSubnet(name, subnetType, clusterUUID string) string {
+	id := uuid.NewString()
+	spec := map[string]interface{}{
+		"name":      name,
+		"resources": map[string]interface{}{"subnet_type": subnetType},
+	}
+	if clusterUUID != "" {
+		spec["cluster_reference"] = map[string]interface{}{"kind": "cluster", "uuid": clusterUUID}
+	}
+	s.subnets = append(s.subnets, map[string]interface{}{
+		"metadata": map[string]interface{}{"kind": "subnet", "uuid": id},
+		"spec":     spec,
+		"status":   map[string]interface{}{"name": name},
+	})
+	return id
+}
+
+func (s *prismSimulator) addImage(name, imageType string, sizeBytes int64) string {
+	id := uuid.NewString()
+	s.images = append(s.images, map[string]interface{}{
+		"metadata": map[string]interface{}{"kind": "image", "uuid": id},
+		"status": map[string]interface{}{
+			"name":      name,
+			"resources": map[string]interface{}{"image_type": imageType, "size_bytes": sizeBytes},
+		},
+	})
+	return id
+}
+
+func (s *prismSimulator) addProject(name string, isDefault bool) string {
+	id := uuid.NewString()
+	s.projects = append(s.projects, map[string]interface{}{
+		"metadata": map[string]interface{}{"kind": "project", "uuid": id},
+		"spec":     map[string]interface{}{"name": name},
+		"status": map[string]interface{}{
+			"name":      name,
+			"resources": map[string]interface{}{"is_default": isDefault},
+		},
+	})
+	return id
+}
+
+// addUser adds a user, member of the projects
+func (s *prismSimulator) addUser(name string, projectUUIDs ...string) string {
+	id := uuid.NewString()
+	refs := make([]map[string]interface{}, 0, len(projectUUIDs))
+	for _, projectUUID := range projectUUIDs {
+		ref := map[string]interface{}{"kind": "project", "uuid": projectUUID}
+		if project := findEntity(s.projects, projectUUID); project != nil {
+			ref["name"] = project["status"].(map[string]interface{})["name"]
+		}
+		refs = append(refs, ref)
+	}
+	s.users = append(s.users, map[string]interface{}{
+		"metadata": map[string]interface{}{"kind": "user", "uuid": id},
+		"status": map[string]interface{}{
+			"name":      name,
+			"resources": map[string]interface{}{"projects_reference_list": refs},
+		},
+	})
+	return id
+}
+
+// findEntity returns the entity with the UUID, or nil
+func findEntity(entities []map[string]interface{}, id string) map[string]interface{} {
+	for _, entity := range entities {
+		if entity["metadata"].(map[string]interface{})["uuid"] == id {
+			return entity
+		}
+	}
+	return nil
+}
+
+// addUserGroup adds a directory user group, its members being the users of the same directory service
+func (s *prismSimulator) addUserGroup(distinguishedName, directoryUUID string) string {
+	id := uuid.NewString()
+	s.userGroups = append(s.userGroups, map[string]interface{}{
+		"metadata": map[string]interface{}{"kind": "user_group", "uuid": id},
+		"status": map[string]interface{}{
+			"resources": map[string]interface{}{"directory_service_user_group": map[string]interface{}{
+				"distinguished_name":          distinguishedName,
+				"directory_service_reference": map[string]interface{}{"kind": "directory_service", "uuid": directoryUUID},
+			}},
+		},
+	})
+	return id
+}
+
+// addHost adds a host with its GPU devices, described as JSON objects of the v3 API
+func (s *prismSimulator) addHost(name, clusterUUID string, gpus ...map[string]interface{}) string {
+	id := uuid.NewString()
+	s.hosts = append(s.hosts, map[string]interface{}{
+		"metadata": map[string]interface{}{"kind": "host", "uuid": id},
+		"status": map[string]interface{}{
+			"name":              name,
+			"cluster_reference": map[string]interface{}{"kind": "cluster", "uuid": clusterUUID},
+			"resources":         map[string]interface{}{"gpu_list": gpus, "num_cpu_cores": simHostCores},
+		},
+	})
+	return id
+}
+
+// tagHost assigns the category key:value to the host
+func (s *prismSimulator) tagHost(id, key, value string) {
+	metadata := findEntity(s.hosts, id)["metadata"].(map[string]interface{})
+	metadata["categories_mapping"] = map[string]interface{}{key: []interface{}{value}}
+	metadata["use_categories_mapping"] = true
+}
+
+// hostCategories returns the categories_mapping of the host
+func (s *prismSimulator) hostCategories(id string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mapping, _ := findEntity(s.hosts, id)["metadata"].(map[string]interface{})["categories_mapping"].(map[string]interface{})
+	return mapping
+}
+
+func (s *prismSimulator) setClusterStats(clusterUUID string, stats map[string]string) {
+	s.clusterStats[clusterUUID] = stats
+}
+
+// vmCount returns the number of VMs of the simulator
+func (s *prismSimulator) vmCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.vms)
+}
+
+// vm returns the VM with the name, or nil if it does not exist
+func (s *prismSimulator) vm(name string) *simVM {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, vm := range s.vms {
+		if vm.spec["name"] == name {
+			return vm
+		}
+	}
+	return nil
+}
+
+// requestCount returns the number of requests received with the method and the path
+func (s *prismSimulator) requestCount(method, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, request := range s.requests {
+		if request == method+" "+path {
+			count++
+		}
+	}
+	return count
+}
+
+// injectFaults fails the next requests with the method and the path prefix, one failure per request
+func (s *prismSimulator) injectFaults(method, pathPrefix string, statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[method+" "+pathPrefix] = append(s.faults[method+" "+pathPrefix], statuses...)
+}
+
+func (s *prismSimulator) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request := r.Method + " " + r.URL.Path
+	s.requests = append(s.requests, request)
+
+	for prefix, statuses := range s.faults {
+		if len(statuses) == 0 || !strings.HasPrefix(request, prefix) {
+			continue
+		}
+		s.faults[prefix] = statuses[1:]
+		if statuses[0] == 0 {
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		writeJSON(w, statuses[0], map[string]interface{}{"message": http.StatusText(statuses[0])})
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if r.Header.Get("X-ntnx-api-key") != simAPIKey && (!ok || username != simUsername || password != simPassword) {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"state": "ERROR", "code": 401})
+		return
+	}
+
+	path, ok := strings.CutPrefix(r.URL.Path, "/api/nutanix/v3")
+	if !ok {
+		s.handleV4(w, r)
+		return
+	}
+
+	body := make(map[string]interface{})
+	if r.Body != nil {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}
+	filter, _ := body["filter"].(string)
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPost && len(segments) == 2 && segments[1] == "list":
+		s.list(w, segments[0], filter)
+	case r.Method == http.MethodPost && path == "/vms":
+		s.createVM(w, body)
+	case len(segments) == 2 && segments[0] == "vms":
+		s.handleVM(w, r.Method, segments[1], body)
+	case r.Method == http.MethodGet && len(segments) == 2 && segments[0] == "tasks":
+		task, ok := s.tasks[segments[1]]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, entityNotFound("task", segments[1]))
+			return
+		}
+		writeJSON(w, http.StatusOK, task)
+	case r.Method == http.MethodPost && path == "/groups":
+		s.groups(w, body)
+	case r.Method == http.MethodGet && path == "/users/me":
+		for _, user := range s.users {
+			if user["status"].(map[string]interface{})["name"] == username {
+				writeJSON(w, http.StatusOK, user)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, entityNotFound("user", "me"))
+	case r.Method == http.MethodGet && len(segments) == 2 && segments[0] == "projects":
+		project := findEntity(s.projects, segments[1])
+		if project == nil {
+			writeJSON(w, http.StatusNotFound, entityNotFound("project", segments[1]))
+			return
+		}
+		writeJSON(w, http.StatusOK, project)
+	case r.Method == http.MethodGet && len(segments) == 2 && segments[0] == "subnets":
+		subnet := findEntity(s.subnets, segments[1])
+		if subnet == nil {
+			writeJSON(w, http.StatusNotFound, entityNotFound("subnet", segments[1]))
+			return
+		}
+		writeJSON(w, http.StatusOK, subnet)
+	case len(segments) == 2 && segments[0] == "hosts":
+		s.handleHost(w, r.Method, segments[1], body)
+	case r.Method == http.MethodGet && len(segments) == 2 && segments[0] == "user_groups":
+		group := findEntity(s.userGroups, segments[1])
+		if group == nil {
+			writeJSON(w, http.StatusNotFound, entityNotFound("user_group", segments[1]))
+			return
+		}
+		writeJSON(w, http.StatusOK, group)
+	case r.Method == http.MethodGet && len(segments) == 2 && segments[0] == "projects_internal":
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "not found"})
+	}
+}
+
+func (s *prismSimulator) list(w http.ResponseWriter, kind, filter string) {
+	var entities []map[string]interface{}
+	switch kind {
+	case "clusters":
+		entities = s.clusters
+	case "subnets":
+		entities = s.subnets
+	case "images":
+		entities = s.images
+	case "projects":
+		entities = s.projects
+	case "hosts":
+		entities = s.hosts
+	case "users":
+		entities = s.users
+	case "vms":
+		entities = make([]map[string]interface{}, 0, len(s.vms))
+		for _, vm := range s.vms {
+			entities = append(entities, s.vmEntity(vm))
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "not found"})
+		return
+	}
+
+	result := make([]map[string]interface{}, 0, len(entities))
+	for _, entity := range entities {
+		if matchesFilter(entity, filter) {
+			result = append(result, entity)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"api_version": "3.1",
+		"entities":    result,
+		"metadata":    map[string]interface{}{"kind": strings.TrimSuffix(kind, "s"), "total_matches": len(result), "length": len(result), "offset": 0},
+	})
+}
+
+func (s *prismSimulator) createVM(w http.ResponseWriter, body map[string]interface{}) {
+	metadata, _ := body["metadata"].(map[string]interface{})
+	spec, _ := body["spec"].(map[string]interface{})
+	if metadata == nil || spec == nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"message": "spec and metadata are required"})
+		return
+	}
+
+	vm := &simVM{
+		uuid:       uuid.NewString(),
+		metadata:   metadata,
+		spec:       spec,
+		powerState: "OFF",
+		ip:         fmt.Sprintf("10.0.0.%d", len(s.vms)+10),
+	}
+	metadata["uuid"] = vm.uuid
+	if resources, ok := spec["resources"].(map[string]interface{}); ok && resources["power_state"] == "ON" {
+		vm.powerState = "ON"
+	}
+	s.vms[vm.uuid] = vm
+
+	errorDetail := ""
+	if len(s.createErrors) != 0 {
+		errorDetail, s.createErrors = s.createErrors[0], s.createErrors[1:]
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"metadata": metadata,
+		"spec":     spec,
+		"status":   map[string]interface{}{"state": "PENDING", "execution_context": map[string]interface{}{"task_uuid": s.addTask(errorDetail)}},
+	})
+}
+
+func (s *prismSimulator) handleVM(w http.ResponseWriter, method, id string, body map[string]interface{}) {
+	vm, ok := s.vms[id]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, entityNotFound("vm", id))
+		return
+	}
+
+	switch method {
+	case http.MethodGet:
+		vm.reads++
+		writeJSON(w, http.StatusOK, s.vmEntity(vm))
+	case http.MethodPut:
+		spec, _ := body["spec"].(map[string]interface{})
+		if spec == nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"message": "spec is required"})
+			return
+		}
+		vm.spec = spec
+		s.versions[id]++
+		if resources, ok := spec["resources"].(map[string]interface{}); ok {
+			if powerState, ok := resources["power_state"].(string); ok {
+				vm.powerState = powerState
+			}
+		}
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status": map[string]interface{}{"state": "PENDING", "execution_context": map[string]interface{}{"task_uuid": s.addTask("")}},
+		})
+	case http.MethodDelete:
+		delete(s.vms, id)
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status": map[string]interface{}{"state": "DELETE_PENDING", "execution_context": map[string]interface{}{"task_uuid": s.addTask("")}},
+		})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"message": "method not allowed"})
+	}
+}
+
+// handleHost reads a host or updates its metadata, the categories of the host
+func (s *prismSimulator) handleHost(w http.ResponseWriter, method, id string, body map[string]interface{}) {
+	host := findEntity(s.hosts, id)
+	if host == nil {
+		writeJSON(w, http.StatusNotFound, entityNotFound("host", id))
+		return
+	}
+
+	switch method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, host)
+	case http.MethodPut:
+		metadata, _ := body["metadata"].(map[string]interface{})
+		if metadata == nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"message": "metadata is required"})
+			return
+		}
+		host["metadata"] = metadata
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status": map[string]interface{}{"state": "PENDING", "execution_context": map[string]interface{}{"task_uuid": s.addTask("")}},
+		})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"message": "method not allowed"})
+	}
+}
+
+// vmEntity builds the v3 representation of the VM, reporting its IP address once the delay is over
+func (s *prismSimulator) vmEntity(vm *simVM) map[string]interface{} {
+	nics := make([]map[string]interface{}, 0)
+	if resources, ok := vm.spec["resources"].(map[string]interface{}); ok {
+		nicList, _ := resources["nic_list"].([]interface{})
+		for index, nic := range nicList {
+			n := map[string]interface{}{"ip_endpoint_list": []interface{}{}}
+			if nic, ok := nic.(map[string]interface{}); ok {
+				n["subnet_reference"] = nic["subnet_reference"]
+			}
+			if index == 0 && vm.powerState == "ON" && s.ipDelay >= 0 && vm.reads > s.ipDelay {
+				n["ip_endpoint_list"] = []interface{}{map[string]interface{}{"ip": vm.ip, "type": "LEARNED"}}
+			}
+			nics = append(nics, n)
+		}
+	}
+
+	return map[string]interface{}{
+		"api_version": "3.1",
+		"metadata":    vm.metadata,
+		"spec":        vm.spec,
+		"status": map[string]interface{}{
+			"name":      vm.spec["name"],
+			"state":     "COMPLETE",
+			"resources": map[string]interface{}{"power_state": vm.powerState, "nic_list": nics},
+		},
+	}
+}
+
+func (s *prismSimulator) groups(w http.ResponseWriter, body map[string]interface{}) {
+	entities := make([]map[string]interface{}, 0)
+	if body["entity_type"] == "cluster" {
+		for id, stats := range s.clusterStats {
+			data := make([]map[string]interface{}, 0, len(stats))
+			for name, value := range stats {
+				data = append(data, map[string]interface{}{
+					"name":   name,
+					"values": []interface{}{map[string]interface{}{"values": []string{value}}},
+				})
+			}
+			entities = append(entities, map[string]interface{}{"entity_id": id, "data": data})
+		}
+	}
+
+	if body["entity_type"] == "mh_vm" {
+		for id, vm := range s.vms {
+			resources, _ := vm.spec["resources"].(map[string]interface{})
+			sockets, _ := resources["num_sockets"].(float64)
+			cores, _ := resources["num_vcpus_per_socket"].(float64)
+			cluster, _ := vm.spec["cluster_reference"].(map[string]interface{})
+			data := []map[string]interface{}{
+				{"name": "cluster", "values": []interface{}{map[string]interface{}{"values": []interface{}{cluster["uuid"]}}}},
+				{"name": "power_state", "values": []interface{}{map[string]interface{}{"values": []string{strings.ToLower(vm.powerState)}}}},
+				{"name": "num_vcpus", "values": []interface{}{map[string]interface{}{"values": []string{fmt.Sprint(int(sockets * cores))}}}},
+			}
+			entities = append(entities, map[string]interface{}{"entity_id": id, "data": data})
+		}
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i]["entity_id"].(string) < entities[j]["entity_id"].(string)
+	})
+	total := len(entities)
+	offset, _ := body["group_member_offset"].(float64)
+	count, _ := body["group_member_count"].(float64)
+	if s.groupsPageSize > 0 && (count == 0 || int(count) > s.groupsPageSize) {
+		count = float64(s.groupsPageSize)
+	}
+	entities = entities[min(int(offset), total):]
+	if count > 0 && int(count) < len(entities) {
+		entities = entities[:int(count)]
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"filtered_group_count":  1,
+		"filtered_entity_count": total,
+		"group_results":         []interface{}{map[string]interface{}{"entity_results": entities}},
+	})
+}
+
+// addTask registers a completed task, failed when the error detail is set
+func (s *prismSimulator) addTask(errorDetail string) string {
+	id := uuid.NewString()
+	task := map[string]interface{}{"uuid": id, "status": "SUCCEEDED", "progress_message": "", "percentage_complete": 100}
+	if errorDetail != "" {
+		task["status"] = "FAILED"
+		task["error_detail"] = errorDetail
+	}
+	s.tasks[id] = task
+	return id
+}
+
+// matchesFilter evaluates the subset of the FIQL filters used by the driver:
+// a comma separated list of name==value or vm_name==regex clauses.
+func matchesFilter(entity map[string]interface{}, filter string) bool {
+	if filter == "" {
+		return true
+	}
+
+	name := entityName(entity)
+	for _, clause := range strings.Split(filter, ",") {
+		attribute, value, ok := strings.Cut(clause, "==")
+		if !ok {
+			continue
+		}
+		value, _ = url.PathUnescape(value)
+
+		switch attribute {
+		case "name":
+			if name == value {
+				return true
+			}
+		case "username":
+			if strings.EqualFold(name, value) {
+				return true
+			}
+		case "vm_name":
+			if matched, _ := regexp.MatchString("^"+value+"$", name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func entityName(entity map[string]interface{}) string {
+	for _, key := range []string{"spec", "status"} {
+		if part, ok := entity[key].(map[string]interface{}); ok {
+			if name, ok := part["name"].(string); ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func entityNotFound(kind, id string) map[string]interface{} {
+	return map[string]interface{}{
+		"api_version":  "3.1",
+		"code":         404,
+		"state":        "ERROR",
+		"message_list": []interface{}{map[string]interface{}{"message": fmt.Sprintf("ENTITY_NOT_FOUND: %s %s does not exist", kind, id), "reason": "ENTITY_NOT_FOUND"}},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,687 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/nutanix/docker-machine/utils"
+
+	networkingConfig "github.com/nutanix/ntnx-api-golang-clients/networking-go-client/v4/models/networking/v4/config"
+	prismConfig "github.com/nutanix/ntnx-api-golang-clients/prism-go-client/v4/models/prism/v4/config"
+	prismError "github.com/nutanix/ntnx-api-golang-clients/prism-go-client/v4/models/prism/v4/error"
+	vmmCommon "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/common/v1/config"
+	vmmConfig "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/prism/v4/config"
+	vmmAhvConfig "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/vmm/v4/ahv/config"
+	vmmPolicies "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/vmm/v4/ahv/policies"
+	vmmContent "github.com/nutanix/ntnx-api-golang-clients/vmm-go-client/v4/models/vmm/v4/content"
+)
+
+// simV4Version is the version of the v4 API served by the simulator, the version of the SDK
+const simV4Version = "v4.2"
+
+// handleV4 serves the subset of the v4 API used by the driver on top of the state of the v3 API:
+// the VMs, images and placement policies of the vmm namespace, the subnets of the networking namespace,
+// and the categories and tasks of the prism namespace.
+// The VMs and the placement policies are updated with the ETag of their last read in If-Match, as Prism Central requires.
+func (s *prismSimulator) handleV4(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 3 || segments[0] != "api" {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "not found"})
+		return
+	}
+
+	// The SDK negotiates the version of each namespace before its first call
+	namespace, version, path := segments[1], segments[2], strings.Join(segments[3:], "/")
+	if r.Method == http.MethodOptions && version == "unversioned" && path == "info" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": simV4Version})
+		return
+	}
+	if version != simV4Version {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "not found"})
+		return
+	}
+
+	filter := r.URL.Query().Get("$filter")
+	resource, id, _ := strings.Cut(path, "/")
+	switch namespace + "/" + resource {
+	case "vmm/ahv":
+		s.handleV4AHV(w, r, id, filter)
+	case "vmm/content":
+		if r.Method == http.MethodGet && id == "images" {
+			s.listImagesV4(w, filter)
+			return
+		}
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "not found"})
+	case "networking/config":
+		if r.Method == http.MethodGet && id == "subnets" {
+			s.listSubnetsV4(w, filter)
+			return
+		}
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "not found"})
+	case "prism/config":
+		s.handleV4Prism(w, r, id, filter)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "not found"})
+	}
+}
+
+// handleV4AHV serves the VMs and the placement policies, the path relative to /api/vmm/v4.2/ahv
+func (s *prismSimulator) handleV4AHV(w http.ResponseWriter, r *http.Request, path, filter string) {
+	segments := strings.Split(path, "/")
+	switch {
+	case path == "config/vms" && r.Method == http.MethodGet:
+		vms := make([]vmmAhvConfig.Vm, 0, len(s.vms))
+		for _, vm := range s.sortedVMs() {
+			if matchesODataFilter(filter, func(string) string { return entityName(map[string]interface{}{"spec": vm.spec}) }) {
+				vms = append(vms, s.vmV4(vm))
+			}
+		}
+		resp := vmmAhvConfig.NewListVmsApiResponse()
+		_ = resp.SetData(vms)
+		writeV4(w, http.StatusOK, resp, "")
+	case path == "config/vms" && r.Method == http.MethodPost:
+		s.createVMV4(w, r)
+	case len(segments) >= 3 && segments[0] == "config" && segments[1] == "vms":
+		s.handleVMV4(w, r, segments[2], strings.Join(segments[3:], "/"))
+	case len(segments) >= 2 && segments[0] == "policies" && segments[1] == "vm-anti-affinity-policies":
+		s.handleAntiAffinityPolicyV4(w, r, segments[2:], filter)
+	case len(segments) >= 2 && segments[0] == "policies" && segments[1] == "vm-host-affinity-policies":
+		s.handleHostAffinityPolicyV4(w, r, segments[2:], filter)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "not found"})
+	}
+}
+
+// createVMV4 creates a VM powered off, as the v4 API does, and visible from the v3 API
+func (s *prismSimulator) createVMV4(w http.ResponseWriter, r *http.Request) {
+	vm := vmmAhvConfig.NewVm()
+	err := json.NewDecoder(r.Body).Decode(vm)
+	if err != nil || vm.Name == nil || vm.Cluster == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "name and cluster are required"})
+		return
+	}
+
+	simVM := &simVM{
+		uuid:       uuid.NewString(),
+		metadata:   map[string]interface{}{"kind": "vm"},
+		v4:         vm,
+		powerState: "OFF",
+		ip:         fmt.Sprintf("10.0.0.%d", len(s.vms)+10),
+	}
+	simVM.metadata["uuid"] = simVM.uuid
+	simVM.spec = map[string]interface{}{
+		"name":              *vm.Name,
+		"cluster_reference": map[string]interface{}{"kind": "cluster", "uuid": utils.StringValue(vm.Cluster.ExtId)},
+		"resources": map[string]interface{}{
+			"num_sockets":          float64(utils.IntValue(vm.NumSockets)),
+			"num_vcpus_per_socket": float64(utils.IntValue(vm.NumCoresPerSocket)),
+		},
+	}
+	s.vms[simVM.uuid] = simVM
+
+	errorDetail := ""
+	if len(s.createErrors) != 0 {
+		errorDetail, s.createErrors = s.createErrors[0], s.createErrors[1:]
+	}
+
+	resp := vmmAhvConfig.NewCreateVmApiResponse()
+	_ = resp.SetData(s.addTaskV4(errorDetail, simVM.uuid))
+	writeV4(w, http.StatusAccepted, resp, "")
+}
+
+// handleVMV4 reads, powers and deletes a VM, the action relative to the path of the VM
+func (s *prismSimulator) handleVMV4(w http.ResponseWriter, r *http.Request, id, action string) {
+	vm, ok := s.vms[id]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": fmt.Sprintf("VM %s not found", id)})
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		vm.reads++
+		resp := vmmAhvConfig.NewGetVmApiResponse()
+		_ = resp.SetData(s.vmV4(vm))
+		writeV4(w, http.StatusOK, resp, s.etag(id))
+	case action == "" && r.Method == http.MethodDelete:
+		if !s.checkIfMatch(w, r, id) {
+			return
+		}
+		delete(s.vms, id)
+		resp := vmmAhvConfig.NewDeleteVmApiResponse()
+		_ = resp.SetData(s.addTaskV4("", id))
+		writeV4(w, http.StatusAccepted, resp, "")
+	case (action == "$actions/power-on" || action == "$actions/power-off") && r.Method == http.MethodPost:
+		if !s.checkIfMatch(w, r, id) {
+			return
+		}
+		vm.powerState = "OFF"
+		if action == "$actions/power-on" {
+			vm.powerState = "ON"
+		}
+		s.versions[id]++
+
+		if action == "$actions/power-on" {
+			resp := vmmAhvConfig.NewPowerOnVmApiResponse()
+			_ = resp.SetData(s.addTaskV4("", id))
+			writeV4(w, http.StatusAccepted, resp, "")
+			return
+		}
+		resp := vmmAhvConfig.NewPowerOffVmApiResponse()
+		_ = resp.SetData(s.addTaskV4("", id))
+		writeV4(w, http.StatusAccepted, resp, "")
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"message": "method not allowed"})
+	}
+}
+
+// vmV4 builds the v4 representation of the VM, reporting the IP address of its first NIC once the delay is over
+func (s *prismSimulator) vmV4(vm *simVM) vmmAhvConfig.Vm {
+	out := vmmAhvConfig.NewVm()
+	if vm.v4 != nil {
+		*out = *vm.v4
+		out.Nics = append([]vmmAhvConfig.Nic(nil), vm.v4.Nics...)
+	}
+	out.ExtId = utils.StringPtr(vm.uuid)
+	out.Name = utils.StringPtr(entityName(map[string]interface{}{"spec": vm.spec}))
+	out.PowerState = new(vmmAhvConfig.PowerState)
+	_ = parseV4Enum(out.PowerState, vm.powerState)
+
+	if len(out.Nics) != 0 && vm.powerState == "ON" && s.ipDelay >= 0 && vm.reads > s.ipDelay {
+		networkInfo := vmmAhvConfig.NewVirtualEthernetNicNetworkInfo()
+		if out.Nics[0].NicNetworkInfo != nil {
+			if info, ok := out.Nics[0].NicNetworkInfo.GetValue().(vmmAhvConfig.VirtualEthernetNicNetworkInfo); ok {
+				networkInfo = &info
+			}
+		}
+		address := vmmCommon.NewIPv4Address()
+		address.Value = utils.StringPtr(vm.ip)
+		networkInfo.Ipv4Info = vmmAhvConfig.NewIpv4Info()
+		networkInfo.Ipv4Info.LearnedIpAddresses = []vmmCommon.IPv4Address{*address}
+		_ = out.Nics[0].SetNicNetworkInfo(*networkInfo)
+	}
+	return *out
+}
+
+// sortedVMs returns the VMs ordered by UUID
+func (s *prismSimulator) sortedVMs() []*simVM {
+	vms := make([]*simVM, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	sort.Slice(vms, func(i, j int) bool { return vms[i].uuid < vms[j].uuid })
+	return vms
+}
+
+// vmCategories returns the key=value categories of the VM, from its v3 metadata or from its v4 category references
+func (s *prismSimulator) vmCategories(vm *simVM) []string {
+	categories := make([]string, 0)
+	if vm.v4 != nil {
+		for _, reference := range vm.v4.Categories {
+			if category := s.findCategory(utils.StringValue(reference.ExtId)); category != nil {
+				categories = append(categories, categoryName(category))
+			}
+		}
+		return categories
+	}
+
+	if mapping, ok := vm.metadata["categories_mapping"].(map[string]interface{}); ok {
+		for key, values := range mapping {
+			values, _ := values.([]interface{})
+			for _, value := range values {
+				categories = append(categories, fmt.Sprintf("%s=%v", key, value))
+			}
+		}
+	}
+	if single, ok := vm.metadata["categories"].(map[string]interface{}); ok {
+		for key, value := range single {
+			categories = append(categories, fmt.Sprintf("%s=%v", key, value))
+		}
+	}
+	return categories
+}
+
+// policyVMs returns the UUIDs of the VMs carrying one of the categories of a placement policy
+func (s *prismSimulator) policyVMs(references []vmmPolicies.CategoryReference) []string {
+	selected := make(map[string]bool)
+	for _, reference := range references {
+		if category := s.findCategory(utils.StringValue(reference.ExtId)); category != nil {
+			selected[categoryName(category)] = true
+		}
+	}
+
+	vms := make([]string, 0)
+	for _, vm := range s.sortedVMs() {
+		for _, category := range s.vmCategories(vm) {
+			if selected[category] {
+				vms = append(vms, vm.uuid)
+				break
+			}
+		}
+	}
+	return vms
+}
+
+// handleAntiAffinityPolicyV4 serves the VM-VM anti-affinity policies, the segments relative to their collection
+func (s *prismSimulator) handleAntiAffinityPolicyV4(w http.ResponseWriter, r *http.Request, segments []string, filter string) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		policies := make([]vmmPolicies.VmAntiAffinityPolicy, 0)
+		for _, id := range sortedKeys(s.antiAffinityPolicies) {
+			policy := s.antiAffinityPolicies[id]
+			if matchesODataFilter(filter, func(string) string { return utils.StringValue(policy.Name) }) {
+				policies = append(policies, *policy)
+			}
+		}
+		resp := vmmPolicies.NewListVmAntiAffinityPoliciesApiResponse()
+		_ = resp.SetData(policies)
+		writeV4(w, http.StatusOK, resp, "")
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		policy := vmmPolicies.NewVmAntiAffinityPolicy()
+		err := json.NewDecoder(r.Body).Decode(policy)
+		if err != nil || policy.Name == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "name is required"})
+			return
+		}
+		id := uuid.NewString()
+		policy.ExtId = utils.StringPtr(id)
+		s.antiAffinityPolicies[id] = policy
+
+		resp := vmmPolicies.NewCreateVmAntiAffinityPolicyApiResponse()
+		_ = resp.SetData(s.addTaskV4("", id))
+		writeV4(w, http.StatusAccepted, resp, "")
+	default:
+		id := segments[0]
+		policy, ok := s.antiAffinityPolicies[id]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": fmt.Sprintf("policy %s not found", id)})
+			return
+		}
+
+		switch {
+		case len(segments) == 2 && segments[1] == "vm-compliance-states" && r.Method == http.MethodGet:
+			states := make([]vmmPolicies.VmAntiAffinityPolicyVmComplianceState, 0)
+			for _, vmUUID := range s.policyVMs(policy.Categories) {
+				state := vmmPolicies.NewVmAntiAffinityPolicyVmComplianceState()
+				state.ExtId = utils.StringPtr(vmUUID)
+				states = append(states, *state)
+			}
+			resp := vmmPolicies.NewListVmAntiAffinityPolicyVmComplianceStatesApiResponse()
+			_ = resp.SetData(states)
+			writeV4(w, http.StatusOK, resp, "")
+		case len(segments) == 1 && r.Method == http.MethodGet:
+			resp := vmmPolicies.NewGetVmAntiAffinityPolicyApiResponse()
+			_ = resp.SetData(*policy)
+			writeV4(w, http.StatusOK, resp, s.etag(id))
+		case len(segments) == 1 && r.Method == http.MethodPut:
+			if !s.checkIfMatch(w, r, id) {
+				return
+			}
+			update := vmmPolicies.NewVmAntiAffinityPolicy()
+			err := json.NewDecoder(r.Body).Decode(update)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": err.Error()})
+				return
+			}
+			update.ExtId = utils.StringPtr(id)
+			s.antiAffinityPolicies[id] = update
+			s.versions[id]++
+
+			resp := vmmPolicies.NewUpdateVmAntiAffinityPolicyApiResponse()
+			_ = resp.SetData(s.addTaskV4("", id))
+			writeV4(w, http.StatusAccepted, resp, "")
+		case len(segments) == 1 && r.Method == http.MethodDelete:
+			delete(s.antiAffinityPolicies, id)
+			resp := vmmPolicies.NewDeleteVmAntiAffinityPolicyApiResponse()
+			_ = resp.SetData(s.addTaskV4("", id))
+			writeV4(w, http.StatusAccepted, resp, "")
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"message": "method not allowed"})
+		}
+	}
+}
+
+// handleHostAffinityPolicyV4 serves the VM-host affinity policies, the segments relative to their collection
+func (s *prismSimulator) handleHostAffinityPolicyV4(w http.ResponseWriter, r *http.Request, segments []string, filter string) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		policies := make([]vmmPolicies.VmHostAffinityPolicy, 0)
+		for _, id := range sortedKeys(s.hostAffinityPolicies) {
+			policy := s.hostAffinityPolicies[id]
+			if matchesODataFilter(filter, func(string) string { return utils.StringValue(policy.Name) }) {
+				policies = append(policies, *policy)
+			}
+		}
+		resp := vmmPolicies.NewListVmHostAffinityPoliciesApiResponse()
+		_ = resp.SetData(policies)
+		writeV4(w, http.StatusOK, resp, "")
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		policy := vmmPolicies.NewVmHostAffinityPolicy()
+		err := json.NewDecoder(r.Body).Decode(policy)
+		if err != nil || policy.Name == nil || len(policy.VmCategories) == 0 || len(policy.HostCategories) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "name, VM categories and host categories are required"})
+			return
+		}
+		id := uuid.NewString()
+		policy.ExtId = utils.StringPtr(id)
+		s.hostAffinityPolicies[id] = policy
+
+		resp := vmmPolicies.NewCreateVmHostAffinityPolicyApiResponse()
+		_ = resp.SetData(s.addTaskV4("", id))
+		writeV4(w, http.StatusAccepted, resp, "")
+	default:
+		id := segments[0]
+		policy, ok := s.hostAffinityPolicies[id]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": fmt.Sprintf("policy %s not found", id)})
+			return
+		}
+
+		switch {
+		case len(segments) == 2 && segments[1] == "vm-compliance-states" && r.Method == http.MethodGet:
+			states := make([]vmmPolicies.VmHostAffinityPolicyVmComplianceState, 0)
+			for _, vmUUID := range s.policyVMs(policy.VmCategories) {
+				state := vmmPolicies.NewVmHostAffinityPolicyVmComplianceState()
+				state.ExtId = utils.StringPtr(vmUUID)
+				states = append(states, *state)
+			}
+			resp := vmmPolicies.NewListVmHostAffinityPolicyVmComplianceStatesApiResponse()
+			_ = resp.SetData(states)
+			writeV4(w, http.StatusOK, resp, "")
+		case len(segments) == 1 && r.Method == http.MethodDelete:
+			delete(s.hostAffinityPolicies, id)
+			resp := vmmPolicies.NewDeleteVmHostAffinityPolicyApiResponse()
+			_ = resp.SetData(s.addTaskV4("", id))
+			writeV4(w, http.StatusAccepted, resp, "")
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"message": "method not allowed"})
+		}
+	}
+}
+
+// listImagesV4 lists the images of the v3 API with the v4 API
+func (s *prismSimulator) listImagesV4(w http.ResponseWriter, filter string) {
+	images := make([]vmmContent.Image, 0)
+	for _, entity := range s.images {
+		name := entityName(entity)
+		if !matchesODataFilter(filter, func(string) string { return name }) {
+			continue
+		}
+
+		metadata, _ := entity["metadata"].(map[string]interface{})
+		status, _ := entity["status"].(map[string]interface{})
+		resources, _ := status["resources"].(map[string]interface{})
+		imageType, _ := resources["image_type"].(string)
+		sizeBytes, _ := resources["size_bytes"].(int64)
+
+		image := vmmContent.NewImage()
+		image.ExtId = utils.StringPtr(metadata["uuid"].(string))
+		image.Name = utils.StringPtr(name)
+		image.SizeBytes = utils.Int64Ptr(sizeBytes)
+		image.Type = new(vmmContent.ImageType)
+		_ = parseV4Enum(image.Type, imageType)
+		images = append(images, *image)
+	}
+
+	resp := vmmContent.NewListImagesApiResponse()
+	_ = resp.SetData(images)
+	writeV4(w, http.StatusOK, resp, "")
+}
+
+// listSubnetsV4 lists the subnets of the v3 API with the v4 API
+func (s *prismSimulator) listSubnetsV4(w http.ResponseWriter, filter string) {
+	subnets := make([]networkingConfig.Subnet, 0)
+	for _, entity := range s.subnets {
+		name := entityName(entity)
+		if !matchesODataFilter(filter, func(string) string { return name }) {
+			continue
+		}
+
+		metadata, _ := entity["metadata"].(map[string]interface{})
+		spec, _ := entity["spec"].(map[string]interface{})
+		resources, _ := spec["resources"].(map[string]interface{})
+		subnetType, _ := resources["subnet_type"].(string)
+
+		subnet := networkingConfig.NewSubnet()
+		subnet.ExtId = utils.StringPtr(metadata["uuid"].(string))
+		subnet.Name = utils.StringPtr(name)
+		subnet.SubnetType = new(networkingConfig.SubnetType)
+		_ = parseV4Enum(subnet.SubnetType, subnetType)
+		if cluster, ok := spec["cluster_reference"].(map[string]interface{}); ok {
+			subnet.ClusterReference = utils.StringPtr(cluster["uuid"].(string))
+		}
+		subnets = append(subnets, *subnet)
+	}
+
+	resp := networkingConfig.NewListSubnetsApiResponse()
+	_ = resp.SetData(subnets)
+	writeV4(w, http.StatusOK, resp, "")
+}
+
+// handleV4Prism serves the categories and the tasks, the path relative to /api/prism/v4.2/config
+func (s *prismSimulator) handleV4Prism(w http.ResponseWriter, r *http.Request, path, filter string) {
+	resource, id, _ := strings.Cut(path, "/")
+	switch {
+	case resource == "categories" && id == "" && r.Method == http.MethodGet:
+		categories := make([]prismConfig.Category, 0)
+		for _, category := range s.categories {
+			attribute := func(name string) string {
+				if name == "key" {
+					return utils.StringValue(category.Key)
+				}
+				return utils.StringValue(category.Value)
+			}
+			if matchesODataFilter(filter, attribute) {
+				categories = append(categories, *category)
+			}
+		}
+		resp := prismConfig.NewListCategoriesApiResponse()
+		_ = resp.SetData(categories)
+		writeV4(w, http.StatusOK, resp, "")
+	case resource == "categories" && id == "" && r.Method == http.MethodPost:
+		category := prismConfig.NewCategory()
+		err := json.NewDecoder(r.Body).Decode(category)
+		if err != nil || category.Key == nil || category.Value == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"message": "key and value are required"})
+			return
+		}
+		category = s.findCategory(s.addCategory(*category.Key, *category.Value))
+
+		resp := prismConfig.NewCreateCategoryApiResponse()
+		_ = resp.SetData(*category)
+		writeV4(w, http.StatusCreated, resp, "")
+	case resource == "categories" && r.Method == http.MethodDelete:
+		for index, category := range s.categories {
+			if utils.StringValue(category.ExtId) == id {
+				s.categories = append(s.categories[:index], s.categories[index+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": fmt.Sprintf("category %s not found", id)})
+	case resource == "tasks" && r.Method == http.MethodGet:
+		task, ok := s.tasksV4[id]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": fmt.Sprintf("task %s not found", id)})
+			return
+		}
+		resp := prismConfig.NewGetTaskApiResponse()
+		_ = resp.SetData(*task)
+		writeV4(w, http.StatusOK, resp, "")
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "not found"})
+	}
+}
+
+// addCategory registers the category key:value, if it is missing, and returns its UUID
+func (s *prismSimulator) addCategory(key, value string) string {
+	for _, category := range s.categories {
+		if utils.StringValue(category.Key) == key && utils.StringValue(category.Value) == value {
+			return *category.ExtId
+		}
+	}
+
+	category := prismConfig.NewCategory()
+	category.ExtId = utils.StringPtr(uuid.NewString())
+	category.Key = utils.StringPtr(key)
+	category.Value = utils.StringPtr(value)
+	s.categories = append(s.categories, category)
+	return *category.ExtId
+}
+
+// categoryID returns the UUID of the category key:value, or an empty string if it does not exist
+func (s *prismSimulator) categoryID(key, value string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, category := range s.categories {
+		if utils.StringValue(category.Key) == key && utils.StringValue(category.Value) == value {
+			return *category.ExtId
+		}
+	}
+	return ""
+}
+
+// addAntiAffinityPolicy registers a VM-VM anti-affinity policy without category
+func (s *prismSimulator) addAntiAffinityPolicy(name string) string {
+	id := uuid.NewString()
+	policy := vmmPolicies.NewVmAntiAffinityPolicy()
+	policy.ExtId = utils.StringPtr(id)
+	policy.Name = utils.StringPtr(name)
+	s.antiAffinityPolicies[id] = policy
+	return id
+}
+
+// antiAffinityPolicy returns the VM-VM anti-affinity policy with the name, or nil if it does not exist
+func (s *prismSimulator) antiAffinityPolicy(name string) *vmmPolicies.VmAntiAffinityPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, policy := range s.antiAffinityPolicies {
+		if utils.StringValue(policy.Name) == name {
+			return policy
+		}
+	}
+	return nil
+}
+
+// hostAffinityPolicy returns the VM-host affinity policy with the name, or nil if it does not exist
+func (s *prismSimulator) hostAffinityPolicy(name string) *vmmPolicies.VmHostAffinityPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, policy := range s.hostAffinityPolicies {
+		if utils.StringValue(policy.Name) == name {
+			return policy
+		}
+	}
+	return nil
+}
+
+// vmCategoryNames returns the key=value categories of the VM with the name
+func (s *prismSimulator) vmCategoryNames(name string) []string {
+	vm := s.vm(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.vmCategories(vm)
+}
+
+func (s *prismSimulator) findCategory(extID string) *prismConfig.Category {
+	for _, category := range s.categories {
+		if utils.StringValue(category.ExtId) == extID {
+			return category
+		}
+	}
+	return nil
+}
+
+func categoryName(category *prismConfig.Category) string {
+	return utils.StringValue(category.Key) + "=" + utils.StringValue(category.Value)
+}
+
+// addTaskV4 registers a completed v4 task affecting the entity, failed when the error detail is set
+func (s *prismSimulator) addTaskV4(errorDetail, entityUUID string) vmmConfig.TaskReference {
+	id := uuid.NewString()
+	task := prismConfig.NewTask()
+	task.ExtId = utils.StringPtr(id)
+	task.Status = prismConfig.TASKSTATUS_SUCCEEDED.Ref()
+	if errorDetail != "" {
+		task.Status = prismConfig.TASKSTATUS_FAILED.Ref()
+		message := prismError.NewAppMessage()
+		message.Message = utils.StringPtr(errorDetail)
+		task.ErrorMessages = []prismError.AppMessage{*message}
+	}
+	entity := prismConfig.NewEntityReference()
+	entity.ExtId = utils.StringPtr(entityUUID)
+	if _, ok := s.vms[entityUUID]; ok {
+		entity.Rel = utils.StringPtr(v4VMEntityType)
+	}
+	task.EntitiesAffected = []prismConfig.EntityReference{*entity}
+	s.tasksV4[id] = task
+
+	reference := vmmConfig.NewTaskReference()
+	reference.ExtId = utils.StringPtr(id)
+	return *reference
+}
+
+// etag returns the ETag of the current version of the entity
+func (s *prismSimulator) etag(id string) string {
+	return fmt.Sprintf("%s-%d", id, s.versions[id])
+}
+
+// checkIfMatch rejects an update without the ETag of the current version of the entity
+func (s *prismSimulator) checkIfMatch(w http.ResponseWriter, r *http.Request, id string) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		writeJSON(w, http.StatusPreconditionRequired, map[string]interface{}{"message": "If-Match is required"})
+		return false
+	}
+	if ifMatch != s.etag(id) {
+		writeJSON(w, http.StatusPreconditionFailed, map[string]interface{}{"message": "ETag mismatch"})
+		return false
+	}
+	return true
+}
+
+// matchesODataFilter evaluates the subset of the OData filters used by the driver:
+// attribute eq 'value' clauses joined by and, then by or.
+func matchesODataFilter(filter string, attribute func(string) string) bool {
+	if filter == "" {
+		return true
+	}
+
+	for _, alternative := range strings.Split(filter, " or ") {
+		matched := true
+		for _, clause := range strings.Split(alternative, " and ") {
+			name, value, ok := strings.Cut(strings.TrimSpace(clause), " eq ")
+			value = strings.TrimSuffix(strings.TrimPrefix(value, "'"), "'")
+			if !ok || attribute(name) != strings.ReplaceAll(value, "''", "'") {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeV4 writes a v4 response, with the ETag of the entity when it is set
+func writeV4(w http.ResponseWriter, status int, v interface{}, etag string) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	writeJSON(w, status, v)
+}
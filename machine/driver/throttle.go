@@ -0,0 +1,180 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// creationSlotPoll is the interval between two attempts to take a creation slot
+const creationSlotPoll = time.Second
+
+var throttleFileChars = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// throttleDir returns the directory of the files shared by the driver processes throttling the calls to Prism Central,
+// the parent directory of the machine store like the GPU allocation lock.
+func (d *NutanixDriver) throttleDir() string {
+	return filepath.Dir(d.ResolveStorePath("."))
+}
+
+// throttlePath returns the path of a throttling file of the Prism Central endpoint
+func throttlePath(dir, endpoint, suffix string) string {
+	return filepath.Join(dir, fmt.Sprintf(".nutanix-%s-%s", throttleFileChars.ReplaceAllString(endpoint, "_"), suffix))
+}
+
+// creationSlot is one of the creation slots of a Prism Central endpoint, held for the duration of a VM creation
+type creationSlot struct {
+	lock *fileLock
+}
+
+// acquireCreationSlot takes one of the limit creation slots of the endpoint, waiting up to wait for a free slot.
+// The slots are lock files shared by the driver processes, the slot of a crashed process is freed by the system.
+func acquireCreationSlot(ctx context.Context, dir, endpoint string, limit int, wait time.Duration) (*creationSlot, error) {
+	start := time.Now()
+	deadline := start.Add(wait)
+	logged := time.Time{}
+
+	for {
+		for i := 0; i < limit; i++ {
+			lock, err := tryLockFile(throttlePath(dir, endpoint, fmt.Sprintf("creation-%d.lock", i)))
+			if err != nil {
+				return nil, err
+			}
+			if lock == nil {
+				continue
+			}
+			if !logged.IsZero() {
+				log.Infof("Got a creation slot on %s after %s", endpoint, time.Since(start).Round(time.Second))
+			}
+			return &creationSlot{lock: lock}, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout waiting for a creation slot on %s after %s, %d concurrent creations are running", endpoint, wait, limit)
+		}
+		if time.Since(logged) >= time.Minute {
+			log.Infof("Waiting for a creation slot on %s, %d concurrent creations are running", endpoint, limit)
+			logged = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(creationSlotPoll):
+		}
+	}
+}
+
+// release frees the creation slot
+func (s *creationSlot) release() {
+	s.lock.unlock()
+}
+
+// rateLimiter is a token bucket limiting the requests per second sent to a Prism Central endpoint.
+// Its state is a file shared by the driver processes, updated under a lock file.
+type rateLimiter struct {
+	path string
+	rate float64
+}
+
+// rateLimiterState is the content of the token bucket file
+type rateLimiterState struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// newRateLimiter returns the rate limiter of the endpoint, nil when the rate is not limited
+func newRateLimiter(dir, endpoint string, rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{path: throttlePath(dir, endpoint, "rate.json"), rate: float64(rate)}
+}
+
+// wait takes a token from the bucket, waiting for the bucket to refill when it is empty.
+// The bucket holds up to one second of requests.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	for {
+		delay, err := l.take()
+		if err != nil {
+			return err
+		}
+		if delay == 0 {
+			return nil
+		}
+
+		log.Debugf("Prism Central request rate limit reached, waiting %s", delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// take consumes a token and returns 0, or returns the delay before a token is available
+func (l *rateLimiter) take() (time.Duration, error) {
+	var lock *fileLock
+	for lock == nil {
+		var err error
+		lock, err = tryLockFile(l.path + ".lock")
+		if err != nil {
+			return 0, err
+		}
+		if lock == nil {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	defer lock.unlock()
+
+	// A missing or unreadable state is a full bucket
+	now := time.Now()
+	state := rateLimiterState{Tokens: l.rate, Updated: now}
+	if content, err := os.ReadFile(l.path); err == nil {
+		_ = json.Unmarshal(content, &state)
+	}
+	if elapsed := now.Sub(state.Updated).Seconds(); elapsed > 0 {
+		state.Tokens = min(l.rate, state.Tokens+elapsed*l.rate)
+	}
+	state.Updated = now
+
+	var delay time.Duration
+	if state.Tokens >= 1 {
+		state.Tokens--
+	} else {
+		delay = max(time.Duration((1-state.Tokens)/l.rate*float64(time.Second)), time.Millisecond)
+	}
+
+	content, err := json.Marshal(state)
+	if err != nil {
+		return 0, err
+	}
+	err = os.WriteFile(l.path, content, 0600)
+	if err != nil {
+		return 0, err
+	}
+	return delay, nil
+}
+
+// rateLimitTransport waits for the rate limiter before each request
+type rateLimitTransport struct {
+	next    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := t.limiter.wait(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
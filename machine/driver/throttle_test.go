@@ -0,0 +1,234 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+func TestCreationSlots(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := acquireCreationSlot(context.Background(), dir, "pc.example.com", 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := acquireCreationSlot(context.Background(), dir, "pc.example.com", 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The slots are per endpoint
+	other, err := acquireCreationSlot(context.Background(), dir, "pc2.example.com", 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = acquireCreationSlot(ctx, dir, "pc.example.com", 2, time.Minute)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected to wait for a free slot, got %v", err)
+	}
+
+	// The wait is bounded
+	_, err = acquireCreationSlot(context.Background(), dir, "pc.example.com", 2, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timeout waiting for a creation slot on pc.example.com") {
+		t.Fatalf("expected a timeout waiting for a free slot, got %v", err)
+	}
+
+	acquired := make(chan *creationSlot)
+	go func() {
+		slot, _ := acquireCreationSlot(context.Background(), dir, "pc.example.com", 2, time.Minute)
+		acquired <- slot
+	}()
+	first.release()
+	select {
+	case slot := <-acquired:
+		slot.release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the released slot to be taken")
+	}
+	second.release()
+
+	// The lock file left by a crashed process is not locked anymore
+	path := throttlePath(dir, "pc.example.com", "creation-0.lock")
+	writeTestFile(t, path, "1", 0600)
+	slot, err := acquireCreationSlot(context.Background(), dir, "pc.example.com", 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot.release()
+}
+
+func TestLockFileExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	// Concurrent holders, as concurrent driver processes, never overlap
+	var holders, overlaps int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				lock, err := tryLockFile(path)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if lock == nil {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if atomic.AddInt32(&holders, 1) > 1 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+				lock.unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if overlaps != 0 {
+		t.Errorf("expected an exclusive lock, got %d overlaps", overlaps)
+	}
+
+	_, err := lockFile(path, 0)
+	if err != nil {
+		t.Errorf("expected the released lock to be free, got %v", err)
+	}
+	_, err = lockFile(path, 0)
+	if err == nil {
+		t.Error("expected the held lock to time out")
+	}
+}
+
+func TestPlacementPolicyLock(t *testing.T) {
+	store := t.TempDir()
+	err := os.MkdirAll(filepath.Join(store, "machines"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1 := NewDriver("pool1-abcde", store)
+	d1.Endpoint = "pc.example.com:9440"
+	d1.Timeout = 0
+	d2 := NewDriver("pool1-fghij", store)
+	d2.Endpoint = d1.Endpoint
+	d2.Timeout = 0
+
+	// The machines of the group share the lock, the other groups are independent
+	if d1.placementLockPath(antiAffinityLockKind, "pool/1") != d2.placementLockPath(antiAffinityLockKind, "pool/1") {
+		t.Fatalf("expected a lock shared by the machines of the group, got %s and %s",
+			d1.placementLockPath(antiAffinityLockKind, "pool/1"), d2.placementLockPath(antiAffinityLockKind, "pool/1"))
+	}
+
+	lock, err := d1.lockPlacementPolicy(antiAffinityLockKind, "pool/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d2.lockPlacementPolicy(antiAffinityLockKind, "pool/1")
+	if err == nil {
+		t.Error("expected the group to be locked")
+	}
+	other, err := d2.lockPlacementPolicy(antiAffinityLockKind, "pool2")
+	if err != nil {
+		t.Errorf("expected another group to be free, got %v", err)
+	} else {
+		other.unlock()
+	}
+
+	lock.unlock()
+	lock, err = d2.lockPlacementPolicy(antiAffinityLockKind, "pool/1")
+	if err != nil {
+		t.Errorf("expected the released group to be free, got %v", err)
+	} else {
+		lock.unlock()
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	dir := t.TempDir()
+
+	// Two limiters sharing the store, as two driver processes, share the rate
+	const rate, requests = 20, 40
+	limiters := []*rateLimiter{newRateLimiter(dir, "pc.example.com", rate), newRateLimiter(dir, "pc.example.com", rate)}
+	if newRateLimiter(dir, "pc.example.com", 0) != nil {
+		t.Fatal("expected no rate limiter without rate")
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(limiter *rateLimiter) {
+			defer wg.Done()
+			err := limiter.wait(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+		}(limiters[i%2])
+	}
+	wg.Wait()
+
+	// The bucket starts full with one second of requests
+	elapsed := time.Since(start)
+	if minimum := time.Duration(requests-rate) * time.Second / rate; elapsed < minimum*9/10 {
+		t.Errorf("expected %d requests to take at least %s, took %s", requests, minimum, elapsed)
+	}
+}
+
+func TestCreateThrottled(t *testing.T) {
+	env := newTestEnv(t)
+	d := env.newDriver(t, testFlags{"nutanix-max-concurrent-creations": 1, "nutanix-api-rate-limit": 50})
+
+	// A creation running in another process holds the only slot
+	host, _ := env.sim.endpoint()
+	held, err := acquireCreationSlot(context.Background(), d.throttleDir(), host, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(500*time.Millisecond, held.release)
+
+	start := time.Now()
+	err = d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if time.Since(start) < 500*time.Millisecond {
+		t.Error("expected the creation to wait for the slot")
+	}
+	assertState(t, d, state.Running)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	slot, err := acquireCreationSlot(ctx, d.throttleDir(), host, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("expected the creation slot to be released, got %v", err)
+	}
+	slot.release()
+	if _, err := os.Stat(throttlePath(d.throttleDir(), host, "rate.json")); err != nil {
+		t.Errorf("expected the rate limiter state in the store: %v", err)
+	}
+
+	// The creation waits for a slot up to the driver timeout
+	d = env.newDriver(t, testFlags{"nutanix-max-concurrent-creations": 1, "nutanix-timeout": 1})
+	held, err = acquireCreationSlot(context.Background(), d.throttleDir(), host, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.release()
+	err = d.Create()
+	if err == nil || !strings.Contains(err.Error(), "timeout waiting for a creation slot") {
+		t.Fatalf("expected a timeout waiting for the creation slot, got %v", err)
+	}
+}
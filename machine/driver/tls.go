@@ -0,0 +1,202 @@
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// readPEM returns the PEM content provided inline or as a file path
+func readPEM(value, description string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	pem, err := os.ReadFile(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the %s: %v", description, err)
+	}
+	return pem, nil
+}
+
+// loadCABundle returns the system certificate pool completed with the certificates of the bundle,
+// provided as a PEM file path or as inline PEM
+func loadCABundle(bundle string) (*x509.CertPool, error) {
+	pem, err := readPEM(bundle, "CA bundle")
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in the CA bundle")
+	}
+	return pool, nil
+}
+
+// loadClientCertificate loads the client certificate and its private key, provided as PEM file paths or as inline PEM,
+// and checks that they match and that the certificate is valid now
+func loadClientCertificate(certificate, key string) (tls.Certificate, error) {
+	certPEM, err := readPEM(certificate, "client certificate")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readPEM(key, "client key")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid client certificate and key pair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid client certificate: %v", err)
+	}
+
+	now := time.Now()
+	if now.After(leaf.NotAfter) {
+		return tls.Certificate{}, fmt.Errorf("client certificate %s expired on %s", leaf.Subject, leaf.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(leaf.NotBefore) {
+		return tls.Certificate{}, fmt.Errorf("client certificate %s is not valid before %s", leaf.Subject, leaf.NotBefore.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+	return cert, nil
+}
+
+// normalizeFingerprint returns the SHA-256 fingerprint in lower case hexadecimal without separators
+func normalizeFingerprint(fingerprint string) (string, error) {
+	fp := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(fingerprint)))
+	fp = strings.TrimPrefix(fp, "sha256")
+	decoded, err := hex.DecodeString(fp)
+	if err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 fingerprint %s", fingerprint)
+	}
+	return fp, nil
+}
+
+// certificateFingerprint returns the SHA-256 fingerprint of the certificate
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// tlsConfig returns the TLS configuration of the Prism Central connections, or nil for the default verification.
+// With the trust on first use, the fingerprint of the certificate served on the first connection of the creation is pinned,
+// the later operations require the pinned fingerprint.
+func (d *NutanixDriver) tlsConfig(creds connConfig, creation bool) (*tls.Config, error) {
+	var certificates []tls.Certificate
+	if d.ClientCert != "" {
+		cert, err := loadClientCertificate(d.ClientCert, d.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, cert)
+	}
+
+	if d.TrustOnFirstUse && d.TLSFingerprint == "" {
+		if !creation {
+			return nil, errors.New("no Prism Central certificate fingerprint was pinned at the creation of the machine with nutanix-tls-trust-on-first-use, " +
+				"set the TLSFingerprint of its configuration")
+		}
+		fingerprint, err := fetchCertificateFingerprint(creds, certificates)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve the Prism Central certificate: %v", err)
+		}
+		log.Warnf("Trusting the Prism Central certificate with SHA-256 fingerprint %s on first use", fingerprint)
+		d.TLSFingerprint = fingerprint
+	}
+
+	if d.CABundle == "" && d.TLSFingerprint == "" && len(certificates) == 0 {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		Certificates:       certificates,
+		InsecureSkipVerify: d.Insecure, // #nosec G402 -- explicitly requested by nutanix-insecure
+	}
+	if d.CABundle != "" {
+		pool, err := loadCABundle(d.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if d.TLSFingerprint == "" {
+		return config, nil
+	}
+
+	// The pinned certificate can be self-signed, the chain is only verified against the CA bundle if there is one
+	pin, err := normalizeFingerprint(d.TLSFingerprint)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := d.Endpoint
+	config.InsecureSkipVerify = true // #nosec G402 -- the certificate is verified by VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no certificate served by Prism Central")
+		}
+		fingerprint := certificateFingerprint(cs.PeerCertificates[0])
+		if fingerprint != pin {
+			return fmt.Errorf("the Prism Central certificate fingerprint %s does not match the pinned fingerprint %s", fingerprint, pin)
+		}
+		if config.RootCAs == nil {
+			return nil
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       endpoint,
+			Roots:         config.RootCAs,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+	return config, nil
+}
+
+// fetchCertificateFingerprint connects to Prism Central without verification and returns the fingerprint of its certificate
+func fetchCertificateFingerprint(creds connConfig, certificates []tls.Certificate) (string, error) {
+	config := &tls.Config{InsecureSkipVerify: true, Certificates: certificates} // #nosec G402 -- the certificate is only recorded
+	transport, err := connConfig{Credentials: creds.Credentials, TLSConfig: config}.transport()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, fmt.Sprintf("https://%s/", creds.URL), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return "", errors.New("no certificate served by Prism Central")
+	}
+	return certificateFingerprint(resp.TLS.PeerCertificates[0]), nil
+}
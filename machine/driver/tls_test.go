@@ -0,0 +1,263 @@
+package driver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+func TestTLSVerification(t *testing.T) {
+	env := newTestEnv(t)
+	cert := env.sim.server.Certificate()
+	bundle := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	fingerprint := certificateFingerprint(cert)
+	otherFingerprint := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name     string
+		flags    testFlags
+		expected string
+	}{
+		{"system trust", testFlags{}, "certificate"},
+		{"inline CA bundle", testFlags{"nutanix-ca-bundle": bundle}, ""},
+		{"CA bundle file", testFlags{"nutanix-ca-bundle": writeTestFile(t, filepath.Join(t.TempDir(), "ca.pem"), bundle, 0600)}, ""},
+		{"pinned fingerprint", testFlags{"nutanix-tls-fingerprint": strings.ToUpper(fingerprint)}, ""},
+		{"pinned fingerprint and CA bundle", testFlags{"nutanix-tls-fingerprint": fingerprint, "nutanix-ca-bundle": bundle}, ""},
+		{"wrong fingerprint", testFlags{"nutanix-tls-fingerprint": otherFingerprint}, "does not match the pinned fingerprint"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := testFlags{"nutanix-insecure": false}
+			for key, value := range tt.flags {
+				flags[key] = value
+			}
+			d := env.newDriver(t, flags)
+			d.VMId = "00000000-0000-0000-0000-000000000000"
+
+			// GetState goes through the v3 client, the API key check through the raw HTTP client
+			_, errState := d.GetState()
+			d.APIKey = simAPIKey
+			errCheck := d.PreCreateCheck()
+			d.APIKey = ""
+
+			for _, err := range []error{errState, errCheck} {
+				if tt.expected == "" {
+					if err != nil && strings.Contains(err.Error(), "certificate") {
+						t.Fatalf("unexpected TLS error: %v", err)
+					}
+				} else if err == nil || !strings.Contains(err.Error(), tt.expected) {
+					t.Fatalf("expected error %q, got %v", tt.expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestTLSV4Client(t *testing.T) {
+	env := newTestEnv(t)
+	cert := env.sim.server.Certificate()
+	bundle := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+
+	tests := []struct {
+		name     string
+		flags    testFlags
+		expected string
+	}{
+		{"system trust", testFlags{}, "certificate"},
+		{"CA bundle", testFlags{"nutanix-ca-bundle": bundle}, ""},
+		{"pinned fingerprint", testFlags{"nutanix-tls-fingerprint": certificateFingerprint(cert)}, ""},
+		{"wrong fingerprint", testFlags{"nutanix-tls-fingerprint": strings.Repeat("ab", 32)}, "does not match the pinned fingerprint"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := testFlags{"nutanix-insecure": false}
+			for key, value := range tt.flags {
+				flags[key] = value
+			}
+			d := env.newDriver(t, flags)
+			creds, err := d.prismCredentials()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := creds.newV4Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The v4 calls are verified like the v3 ones
+			limit := 1
+			_, err = conn.VmApiInstance.ListVms(nil, &limit, nil, nil, nil)
+			if tt.expected == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Fatalf("expected error %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	env := newTestEnv(t)
+	d := env.newDriver(t, testFlags{"nutanix-insecure": false, "nutanix-tls-trust-on-first-use": true})
+
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if d.TLSFingerprint != certificateFingerprint(env.sim.server.Certificate()) {
+		t.Fatalf("expected the simulator certificate to be pinned, got %q", d.TLSFingerprint)
+	}
+	assertState(t, d, state.Running)
+
+	// A different certificate is rejected after the first use
+	d.TLSFingerprint = strings.Repeat("ab", 32)
+	_, err = d.GetState()
+	if err == nil || !strings.Contains(err.Error(), "does not match the pinned fingerprint") {
+		t.Fatalf("expected a fingerprint mismatch, got %v", err)
+	}
+
+	// The later operations never pin the certificate themselves
+	d.TLSFingerprint = ""
+	_, err = d.GetState()
+	if err == nil || !strings.Contains(err.Error(), "no Prism Central certificate fingerprint was pinned") {
+		t.Fatalf("expected the missing pin to be refused, got %v", err)
+	}
+	if d.TLSFingerprint != "" {
+		t.Errorf("expected no fingerprint pinned outside of the creation, got %q", d.TLSFingerprint)
+	}
+}
+
+// newTestCertificate returns a self-signed client certificate and its key in PEM
+func newTestCertificate(t *testing.T, notBefore, notAfter time.Time) (*x509.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "docker-machine"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return cert, string(certPEM), string(keyPEM)
+}
+
+func TestClientCertificate(t *testing.T) {
+	now := time.Now()
+	ca, certPEM, keyPEM := newTestCertificate(t, now.Add(-time.Hour), now.Add(time.Hour))
+	env := newTestEnv(t, ca)
+
+	dir := t.TempDir()
+	certPath := writeTestFile(t, filepath.Join(dir, "client.pem"), certPEM, 0600)
+	keyPath := writeTestFile(t, filepath.Join(dir, "client.key"), keyPEM, 0600)
+	d := env.newDriver(t, testFlags{"nutanix-client-cert": certPath, "nutanix-client-key": keyPath})
+
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	assertState(t, d, state.Running)
+
+	// The gateway rejects the connections without client certificate
+	d.ClientCert, d.ClientKey = "", ""
+	_, err = d.GetState()
+	if err == nil {
+		t.Fatal("expected GetState to fail without client certificate")
+	}
+
+	// Inline PEM
+	d.ClientCert, d.ClientKey = certPEM, keyPEM
+	assertState(t, d, state.Running)
+
+	// The certificate is presented on the v4 API connections too
+	d = env.newDriver(t, testFlags{"nutanix-api-version": apiVersionV4, "nutanix-client-cert": certPEM, "nutanix-client-key": keyPEM})
+	err = d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	assertState(t, d, state.Running)
+	d.ClientCert, d.ClientKey = "", ""
+	_, err = d.GetState()
+	if err == nil {
+		t.Fatal("expected the v4 GetState to fail without client certificate")
+	}
+}
+
+func TestClientCertificateErrors(t *testing.T) {
+	now := time.Now()
+	_, certPEM, keyPEM := newTestCertificate(t, now.Add(-time.Hour), now.Add(time.Hour))
+	_, _, otherKeyPEM := newTestCertificate(t, now.Add(-time.Hour), now.Add(time.Hour))
+	_, expiredPEM, expiredKeyPEM := newTestCertificate(t, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	_, futurePEM, futureKeyPEM := newTestCertificate(t, now.Add(time.Hour), now.Add(2*time.Hour))
+
+	tests := []struct {
+		name     string
+		cert     string
+		key      string
+		expected string
+	}{
+		{"missing key", certPEM, "", "must be set together"},
+		{"mismatched key", certPEM, otherKeyPEM, "invalid client certificate and key pair"},
+		{"expired", expiredPEM, expiredKeyPEM, "expired on"},
+		{"not yet valid", futurePEM, futureKeyPEM, "is not valid before"},
+		{"missing file", "/nonexistent/client.pem", keyPEM, "failed to read the client certificate"},
+	}
+
+	env := newTestEnv(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port := env.sim.endpoint()
+			opts := testFlags{
+				"nutanix-username":    simUsername,
+				"nutanix-password":    simPassword,
+				"nutanix-endpoint":    host,
+				"nutanix-port":        port,
+				"nutanix-cluster":     "PE1",
+				"nutanix-vm-network":  []string{"vlan-100"},
+				"nutanix-vm-image":    "ubuntu-22.04",
+				"nutanix-client-cert": tt.cert,
+				"nutanix-client-key":  tt.key,
+			}
+			err := NewDriver("pool1-abcde", t.TempDir()).SetConfigFromFlags(opts)
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Fatalf("expected error %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package driver
+
+import (
+	stdlog "log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/nutanix/docker-machine/utils"
+)
+
+// traceFile is the file of the machine store receiving the Prism Central HTTP traces
+const traceFile = "prism-trace.log"
+
+// wireTracer dumps the Prism Central requests and responses, redacted, to the trace file of a machine
+type wireTracer struct {
+	mu     sync.Mutex
+	path   string
+	logger *stdlog.Logger
+}
+
+// newWireTracer returns the tracer of the machine, nil when the tracing is disabled
+func (d *NutanixDriver) newWireTracer() *wireTracer {
+	if !d.Trace {
+		return nil
+	}
+	t := &wireTracer{path: d.ResolveStorePath(traceFile)}
+	t.logger = stdlog.New(t, "", stdlog.LstdFlags|stdlog.Lmicroseconds)
+	return t
+}
+
+// Write appends a redacted trace to the trace file.
+// The file is opened on each write, the driver process does not know when the operation ends.
+func (t *wireTracer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, err := os.OpenFile(t.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	_, err = f.WriteString(logRedaction.redact(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// traceRequest dumps a request, with its body
+func (t *wireTracer) traceRequest(req *http.Request) {
+	utils.DebugRequestTo(t.logger, req)
+}
+
+// traceResponse dumps a response, with its body, or the error of the request
+func (t *wireTracer) traceResponse(req *http.Request, resp *http.Response, err error) {
+	if err != nil {
+		t.logger.Printf("[DEBUG] %s %s failed: %v\n", req.Method, req.URL.Redacted(), err)
+		return
+	}
+	utils.DebugResponseTo(t.logger, resp)
+}
+
+// traceTransport traces each request sent to Prism Central and its response
+type traceTransport struct {
+	next   http.RoundTripper
+	tracer *wireTracer
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.tracer.traceRequest(req)
+	resp, err := t.next.RoundTrip(req)
+	t.tracer.traceResponse(req, resp, err)
+	return resp, err
+}
@@ -0,0 +1,74 @@
+package driver
+
+import (
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTraceCreate(t *testing.T) {
+	env := newTestEnv(t)
+	d := env.newDriver(t, testFlags{"nutanix-trace": true, "nutanix-cloud-init": "#cloud-config\nruncmd:\n  - echo trace\n"})
+
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	content, err := os.ReadFile(d.ResolveStorePath(traceFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := string(content)
+
+	for _, expected := range []string{"POST /api/nutanix/v3/vms HTTP/1.1", `"name":"pool1-abcde"`, "HTTP/1.1 202 Accepted", "Authorization: Basic ********", `"user_data":"********"`} {
+		if !strings.Contains(trace, expected) {
+			t.Errorf("expected %q in the trace", expected)
+		}
+	}
+	basicAuth := base64.StdEncoding.EncodeToString([]byte(simUsername + ":" + simPassword))
+	for _, secret := range []string{simPassword, basicAuth} {
+		if strings.Contains(trace, secret) {
+			t.Errorf("secret %q found in the trace", secret)
+		}
+	}
+}
+
+func TestTraceV4Client(t *testing.T) {
+	env := newTestEnv(t)
+	d := env.newDriver(t, testFlags{"nutanix-trace": true, "nutanix-api-version": apiVersionV4})
+
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	content, err := os.ReadFile(d.ResolveStorePath(traceFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := string(content)
+
+	for _, expected := range []string{"POST /api/vmm/v4.2/ahv/config/vms HTTP/1.1", "Ntnx-Request-Id: ", "Authorization: Basic ********"} {
+		if !strings.Contains(trace, expected) {
+			t.Errorf("expected %q in the trace", expected)
+		}
+	}
+	basicAuth := base64.StdEncoding.EncodeToString([]byte(simUsername + ":" + simPassword))
+	for _, secret := range []string{simPassword, basicAuth, v4ProxyTokenHeader} {
+		if strings.Contains(trace, secret) {
+			t.Errorf("%q found in the trace", secret)
+		}
+	}
+}
+
+func TestTraceDisabled(t *testing.T) {
+	env := newTestEnv(t)
+	d := env.newDriver(t, nil)
+	err := d.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := os.Stat(d.ResolveStorePath(traceFile)); !os.IsNotExist(err) {
+		t.Errorf("expected no trace file without nutanix-trace, got %v", err)
+	}
+}
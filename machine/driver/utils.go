@@ -1,16 +1,28 @@
 package driver
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"regexp"
+	"strings"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/nutanix/docker-machine/utils"
 
 	v3 "github.com/nutanix-cloud-native/prism-go-client/v3"
 	"gopkg.in/yaml.v3"
 )
 
+const apiKeyUsername = "X-ntnx-api-key"
+
+// errUnauthorized is returned by doPrismRequest when Prism Central rejects the credentials
+var errUnauthorized = errors.New("invalid Nutanix credentials")
+
 func isUUID(uuid string) bool {
 	uuidPattern := regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
 	return uuidPattern.MatchString(uuid)
@@ -91,77 +103,122 @@ func buildScalarNodes(key string) []*yaml.Node {
 // 	return n1, n2
 // }
 
-// GetGPUList retrieves a list of GPUs from the Nutanix Prism Element based on the provided GPU names and PE UUID.
-// It returns a slice of VMGpu pointers or an error if any issues occur during the retrieval
-func GetGPUList(ctx context.Context, conn *v3.Client, gpus []string, peUUID string) ([]*v3.VMGpu, error) {
-	resultGPUs := make([]*v3.VMGpu, 0)
-	for _, gpu := range gpus {
-		foundGPU, err := GetGPU(ctx, conn, peUUID, gpu)
+// getPrismEntity performs a GET request on the Prism Central v3 API for the endpoints not covered by the v3 client.
+// The response body is decoded in v.
+func getPrismEntity(ctx context.Context, creds connConfig, path string, v interface{}) error {
+	return doPrismRequest(ctx, creds, http.MethodGet, path, nil, v)
+}
+
+// doPrismRequest performs a request on the Prism Central v3 API for the endpoints not covered by the v3 client.
+// The body is encoded in JSON and the response body is decoded in v.
+func doPrismRequest(ctx context.Context, creds connConfig, method, path string, body, v interface{}) error {
+	transport, err := creds.roundTripper()
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	var reqBody io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		resultGPUs = append(resultGPUs, foundGPU)
+		reqBody = bytes.NewReader(buf)
 	}
-	return resultGPUs, nil
-}
 
-// GetGPU retrieves a specific GPU from the Nutanix Prism Element based on the provided GPU name and PE UUID.
-// It returns a VMGpu pointer or an error if the GPU is not found or if any issues occur during the retrieval.
-func GetGPU(ctx context.Context, conn *v3.Client, peUUID, gpu string) (*v3.VMGpu, error) {
-	if gpu == "" {
-		return nil, fmt.Errorf("gpu name must be passed in order to retrieve the GPU")
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("https://%s/api/nutanix/v3%s", creds.URL, path), reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if creds.APIKey != "" {
+		req.Header.Set(apiKeyUsername, creds.APIKey)
+	} else if strings.EqualFold(creds.Username, apiKeyUsername) {
+		req.Header.Set(apiKeyUsername, creds.Password)
+	} else {
+		req.SetBasicAuth(creds.Username, creds.Password)
 	}
 
-	log.Infof("Searching GPU %s in Prism Element with UUID %s", gpu, peUUID)
-	allGPUs, err := GetGPUsForPE(ctx, conn, peUUID)
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if len(allGPUs) == 0 {
-		return nil, fmt.Errorf("no available GPUs found in Prism Element cluster with UUID %s", peUUID)
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
 	}
-	for _, peGPU := range allGPUs {
-		if peGPU.Status != "UNUSED" {
-			continue
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s for %s", resp.Status, path)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// waitForTask waits for the end of a v3 task and returns an error if it does not succeed before the timeout
+func waitForTask(ctx context.Context, conn *v3.Client, taskUUID string, timeout int) error {
+	logTask(taskUUID)
+	for i := 0; i < timeout/5; i++ {
+		resp, err := conn.V3.GetTask(ctx, taskUUID)
+		if err != nil {
+			return err
 		}
-		if peGPU.Name == gpu {
-			log.Infof("GPU %s found with ID %d in Prism Element", peGPU.Name, *peGPU.DeviceID)
-			return &v3.VMGpu{
-				DeviceID: peGPU.DeviceID,
-				Mode:     &peGPU.Mode,
-				Vendor:   &peGPU.Vendor,
-			}, nil
+
+		switch *resp.Status {
+		case "SUCCEEDED":
+			return nil
+		case "FAILED":
+			return errors.New(strings.ReplaceAll(utils.StringValue(resp.ErrorDetail), "\n", " "))
 		}
+		<-time.After(5 * time.Second)
 	}
-	return nil, fmt.Errorf("no available GPU found in Prism Element that matches required GPU name: %s", gpu)
-
+	return fmt.Errorf("timeout waiting for task %s", taskUUID)
 }
 
-// GetGPUsForPE retrieves all GPUs associated with a specific Prism Element (PE) UUID.
-// It returns a slice of GPU pointers or an error if any issues occur during the retrieval.
-func GetGPUsForPE(ctx context.Context, conn *v3.Client, peUUID string) ([]*v3.GPU, error) {
-	gpus := make([]*v3.GPU, 0)
+// GetHostsForPE retrieves all hosts associated with a specific Prism Element (PE) UUID.
+// It returns a slice of HostResponse pointers or an error if any issues occur during the retrieval.
+func GetHostsForPE(ctx context.Context, conn *v3.Client, peUUID string) ([]*v3.HostResponse, error) {
+	peHosts := make([]*v3.HostResponse, 0)
 	hosts, err := conn.V3.ListAllHost(ctx)
 	if err != nil {
-		return gpus, err
+		return peHosts, err
 	}
 
 	for _, host := range hosts.Entities {
 		if host == nil ||
+			host.Metadata == nil ||
 			host.Status == nil ||
 			host.Status.ClusterReference == nil ||
-			host.Status.Resources == nil ||
-			len(host.Status.Resources.GPUList) == 0 ||
 			host.Status.ClusterReference.UUID != peUUID {
 			continue
 		}
+		peHosts = append(peHosts, host)
+	}
+	return peHosts, nil
+}
 
-		for _, peGpu := range host.Status.Resources.GPUList {
-			if peGpu == nil {
-				continue
-			}
-			gpus = append(gpus, peGpu)
+// splitVCPUs splits the total number of vCPUs in sockets and cores per socket.
+// With vNUMA, one socket is created per vNUMA node. Otherwise the requested number of cores per socket is kept.
+func splitVCPUs(total, cores, vnumaNodes int) (int, int, error) {
+	if vnumaNodes > 0 {
+		if total%vnumaNodes != 0 {
+			return 0, 0, fmt.Errorf("nutanix-vm-total-vcpus %d is not a multiple of nutanix-vm-vnuma-nodes %d", total, vnumaNodes)
 		}
+		return vnumaNodes, total / vnumaNodes, nil
+	}
+
+	if cores < 1 {
+		cores = 1
+	}
+	if total%cores != 0 {
+		return 0, 0, fmt.Errorf("nutanix-vm-total-vcpus %d is not a multiple of nutanix-vm-cores %d", total, cores)
 	}
-	return gpus, nil
+	return total / cores, cores, nil
 }
@@ -0,0 +1,108 @@
+package driver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// v4ProxyTokenHeader carries the token authenticating the v4 API clients to their loopback proxy
+const v4ProxyTokenHeader = "X-Nutanix-Driver-Proxy-Token"
+
+// v4Proxy is the loopback HTTP proxy the v4 API clients send their requests to.
+// The SDK builds its own transport, from its certificate verification switch and, only when it rebuilds the
+// transport, from its proxy setting: the clients send plain HTTP requests to this proxy, which forwards them to
+// Prism Central over HTTPS with the round tripper of the connection. So the v4 calls get the TLS configuration,
+// the proxy, the retries, the rate limit and the trace of the v3 calls.
+type v4Proxy struct {
+	server *http.Server
+	// port is the loopback port of the proxy
+	port int
+	// token authenticates the API clients of the connection, the loopback is shared with the other processes
+	token string
+	// target is the host:port of Prism Central
+	target string
+	next   http.RoundTripper
+	// clients counts the API clients sending their requests to the proxy, the proxy stops with the last one
+	clients atomic.Int32
+}
+
+// startV4Proxy starts a loopback proxy forwarding the requests for the target to the round tripper
+func startV4Proxy(target string, next http.RoundTripper) (*v4Proxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the v4 API client proxy: %v", err)
+	}
+
+	p := &v4Proxy{
+		port:   listener.Addr().(*net.TCPAddr).Port,
+		token:  rand.Text(),
+		target: target,
+		next:   next,
+	}
+	p.server = &http.Server{Handler: p, ReadHeaderTimeout: 30 * time.Second}
+	go func() { _ = p.server.Serve(listener) }()
+	return p, nil
+}
+
+// close stops the proxy and closes its connections
+func (p *v4Proxy) close() {
+	_ = p.server.Close()
+}
+
+// retainV4Proxy keeps the proxy running as long as the API client is reachable,
+// a call through an API instance can outlive the v4 client holding it.
+func retainV4Proxy[T any](apiClient *T, proxy *v4Proxy) {
+	proxy.clients.Add(1)
+	runtime.AddCleanup(apiClient, (*v4Proxy).release, proxy)
+}
+
+// release stops the proxy when the last of its API clients is garbage collected
+func (p *v4Proxy) release() {
+	if p.clients.Add(-1) == 0 {
+		p.close()
+	}
+}
+
+func (p *v4Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(v4ProxyTokenHeader)), []byte(p.token)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// The body is buffered so that the request can be retried
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, "https://"+p.target+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Del(v4ProxyTokenHeader)
+	req.Header.Del("Connection")
+
+	// The SDK reports the body of the error responses, so a TLS or proxy failure is reported as is
+	resp, err := p.next.RoundTrip(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
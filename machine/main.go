@@ -1,10 +1,29 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/docker/machine/libmachine/drivers/plugin"
 	"github.com/nutanix/docker-machine/machine/driver"
 )
 
 func main() {
+	// The log format (text or json) and level are read from the environment, the plugin has no flags
+	err := driver.ConfigureLogging(os.Getenv("NUTANIX_LOG_FORMAT"), os.Getenv("NUTANIX_LOG_LEVEL"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == driver.RotateCredentialsCommand {
+		err = driver.RotateCredentials(os.Args[2:], os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	plugin.RegisterDriver(driver.NewDriver("", ""))
 }
@@ -15,10 +15,9 @@ type MachineConfig struct {
 	VMCPUs      int
 	VMCores     int
 	MachineName string
-	VNICs       []string
-	VDisks      []string
-	SSHUser     string
-	SSHPass     string
+	Networks    []string
+	Image       string
+	Cluster     string
 	NutanixUser string
 	NutanixPass string
 	Endpoint    string
@@ -48,24 +47,20 @@ func (c MachineConfig) CreateMachine() ([]byte, error) {
 		c.NutanixPass,
 		"--nutanix-endpoint",
 		c.Endpoint,
+		"--nutanix-cluster",
+		c.Cluster,
 		"--nutanix-vm-mem",
 		fmt.Sprintf("%d", vmMem),
 		"--nutanix-vm-cpus",
 		fmt.Sprintf("%d", vmCPUs),
 		"--nutanix-vm-cores",
 		fmt.Sprintf("%d", vmCores),
-		"--nutanix-vm-ssh-username",
-		c.SSHUser,
-		"--nutanix-vm-ssh-password",
-		c.SSHPass,
+		"--nutanix-vm-image",
+		c.Image,
 	}
 
-	for _, nic := range c.VNICs {
-		args = append(args, "--nutanix-vm-network-uuid", nic)
-	}
-
-	for _, disk := range c.VDisks {
-		args = append(args, "--nutanix-vm-disk-uuid", disk)
+	for _, network := range c.Networks {
+		args = append(args, "--nutanix-vm-network", network)
 	}
 
 	args = append(args, c.MachineName)
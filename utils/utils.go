@@ -24,22 +24,32 @@ func ToJSONString(v interface{}) string {
 
 // DebugRequest ...
 func DebugRequest(req *http.Request) {
+	DebugRequestTo(log.Default(), req)
+}
+
+// DebugRequestTo dumps the request with its body to the logger
+func DebugRequestTo(logger *log.Logger, req *http.Request) {
 	requestDump, err := httputil.DumpRequest(req, true)
 	if err != nil {
-		log.Printf("[WARN] Error getting request's dump: %s\n", err)
+		logger.Printf("[WARN] Error getting request's dump: %s\n", err)
 	}
 
-	log.Printf("[DEBUG] %s\n", string(requestDump))
+	logger.Printf("[DEBUG] %s\n", string(requestDump))
 }
 
 // DebugResponse ...
 func DebugResponse(res *http.Response) {
+	DebugResponseTo(log.Default(), res)
+}
+
+// DebugResponseTo dumps the response with its body to the logger
+func DebugResponseTo(logger *log.Logger, res *http.Response) {
 	requestDump, err := httputil.DumpResponse(res, true)
 	if err != nil {
-		log.Printf("[WARN] Error getting response's dump: %s\n", err)
+		logger.Printf("[WARN] Error getting response's dump: %s\n", err)
 	}
 
-	log.Printf("[DEBUG] %s\n", string(requestDump))
+	logger.Printf("[DEBUG] %s\n", string(requestDump))
 }
 
 // ConvertMapString from interface to string